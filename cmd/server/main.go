@@ -1,43 +1,187 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"compress/gzip"
 	"os"
 	"path/filepath"
+	"wechat-reader/internal/logging"
+	"wechat-reader/internal/model"
 	"wechat-reader/internal/service"
+	"wechat-reader/internal/service/rewrite"
 	"wechat-reader/internal/storage"
+	"wechat-reader/internal/wxurl"
 )
 
+// 代理接口单个响应体的大小上限（解压后）
+const proxyMaxBodyBytes = 32 << 20
+
+// 代理页面注入的样式。微信的正文默认隐藏，由已删除的脚本显示
+const proxyPageStyle = `
+	img { max-width: 100%; height: auto; }
+	img[src=""] { display: none; }
+	body { padding: 20px; }
+	.rich_media_content { font-size: 16px; line-height: 1.6; }
+	#js_content { visibility: visible !important; opacity: 1 !important; }
+`
+
 func main() {
-	ctx := context.Background()
+	// 收到 Ctrl+C 或 SIGTERM 时取消 ctx，正在运行的抓取任务保存进度后退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 日志级别和格式由 LOG_LEVEL、LOG_FORMAT 环境变量控制
+	logger, err := logging.New(os.Stderr, logging.ConfigFromEnv(os.Getenv))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "初始化日志失败: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
 
 	// 获取当前工作目录
 	pwd, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		fatal("获取工作目录失败", err)
+	}
+
+	// DATABASE_URL 为 postgres:// 开头时使用 PostgreSQL，否则为 SQLite 数据库文件路径
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		dsn = filepath.Join(pwd, "data.db")
 	}
 
-	// 初始化数据库连接
-	db, err := storage.NewDatabase(ctx, filepath.Join(pwd, "data.db"))
+	// migrate 在打开数据库执行自动迁移之前处理，可以先查看待执行的迁移
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(ctx, dsn, os.Args[2:]); err != nil {
+			fatal("数据库迁移失败", err)
+		}
+		return
+	}
+
+	// 初始化数据库连接，启动时自动执行未执行的迁移
+	db, err := storage.NewStore(ctx, dsn)
 	if err != nil {
-		log.Fatal(err)
+		fatal("打开数据库失败", err)
 	}
 	defer db.Close(ctx)
 
+	// 出站请求只能访问微信的域名，不能访问内网地址
+	egress := service.NewEgress(egressConfig())
+
+	// 抓取任务和图片归档共用一个限速和重试策略
+	outbound := service.NewPolicy(egress, service.DefaultPolicyConfig())
+	// 代理接口由用户打开页面触发，使用单独的令牌桶，不与后台抓取抢占配额
+	interactive := service.NewPolicy(egress, service.InteractivePolicyConfig())
+
+	// 文章图片归档目录，默认为当前目录下的 images
+	imageDir := os.Getenv("IMAGE_DIR")
+	if imageDir == "" {
+		imageDir = filepath.Join(pwd, "images")
+	}
+	archiver := service.NewImageArchiver(imageDir, outbound)
+
+	// 命令行子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dedupe":
+			// 合并数据库中链接重复的文章
+			merged, err := db.MergeDuplicateArticles(ctx)
+			if err != nil {
+				fatal("合并重复文章失败", err)
+			}
+			slog.Info("合并重复文章完成", "merged", merged)
+			return
+		case "archive":
+			// 下载已保存文章中的图片，archive gc 清理不再引用的图片
+			if err := archive(ctx, db, archiver, os.Args[2:]); err != nil {
+				fatal("归档图片失败", err)
+			}
+			return
+		default:
+			slog.Error("未知命令", "command", os.Args[1])
+			os.Exit(1)
+		}
+	}
+
+	// 代理接口的响应缓存在磁盘上，重复打开同一篇文章不再请求微信
+	proxyCache, err := service.NewHTTPCache(interactive, proxyCacheConfig(pwd))
+	if err != nil {
+		fatal("初始化代理缓存失败", err)
+	}
+
+	// 代理接口边读边返回微信的响应，不在内存中缓存整个响应体
+	imageProxy := service.NewProxy(proxyCache, service.ProxyConfig{
+		RequestHeader: http.Header{
+			"User-Agent": {"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36"},
+			"Referer":    {"https://mp.weixin.qq.com/"},
+		},
+		MaxBodyBytes: proxyMaxBodyBytes,
+	})
+	pageProxy := service.NewProxy(proxyCache, service.ProxyConfig{
+		RequestHeader: http.Header{
+			"User-Agent":      {"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"},
+			"Accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+			"Accept-Language": {"zh-CN,zh;q=0.9"},
+			"Referer":         {"https://mp.weixin.qq.com/"},
+		},
+		ResponseHeader: http.Header{
+			"Content-Type":            {"text/html; charset=utf-8"},
+			"X-Frame-Options":         {"SAMEORIGIN"},
+			"Content-Security-Policy": {"frame-ancestors 'self'; script-src 'none'"},
+		},
+		MaxBodyBytes: proxyMaxBodyBytes,
+	})
+	wxProxy := service.NewProxy(proxyCache, service.ProxyConfig{
+		RequestHeader: http.Header{
+			"User-Agent":                {"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 MicroMessenger/7.0.20.1781(0x6700143B) NetType/WIFI MiniProgramEnv/Windows WindowsWechat/WMPF WindowsWechat(0x6309092b) XWEB/9053"},
+			"Accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"},
+			"Accept-Language":           {"zh-CN,zh;q=0.9,en;q=0.8"},
+			"Referer":                   {"https://mp.weixin.qq.com/"},
+			"Sec-Fetch-Dest":            {"document"},
+			"Sec-Fetch-Mode":            {"navigate"},
+			"Sec-Fetch-Site":            {"same-origin"},
+			"Sec-Fetch-User":            {"?1"},
+			"Upgrade-Insecure-Requests": {"1"},
+		},
+		ResponseHeader: http.Header{
+			"X-Frame-Options":         {"SAMEORIGIN"},
+			"Content-Security-Policy": {"frame-ancestors 'self'; img-src * data:; default-src 'self' 'unsafe-inline' 'unsafe-eval' https://*.weixin.qq.com https://*.qpic.cn"},
+		},
+		MaxBodyBytes: proxyMaxBodyBytes,
+	})
+
 	// 初始化爬虫服务
-	crawler := service.NewCrawler()
+	crawler := service.NewCrawler(service.WithFetcher(outbound), service.WithImageArchiver(archiver))
+
+	// 启动后台抓取任务
+	jobs := service.NewJobManager(crawler, db, 2)
+	if err := jobs.Start(ctx); err != nil {
+		fatal("启动抓取任务失败", err)
+	}
 
-	// API 处理函数
-	http.HandleFunc("/api/fetch", func(w http.ResponseWriter, r *http.Request) {
+	// 启动订阅定时刷新
+	scheduler := service.NewScheduler(db, jobs, time.Minute)
+	scheduler.Start(ctx)
+
+	// API 处理函数。不使用 http.DefaultServeMux，expvar 在其中注册的 /debug/vars 只在管理端口提供
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/fetch", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -58,35 +202,37 @@ func main() {
 			return
 		}
 
-		articles, err := crawler.FetchArticles(ctx, request.URL)
+		albumURL, err := wxurl.Normalize(request.URL)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		fmt.Println("articles:", articles)
-		// 保存到数据库
-		if err := db.SaveArticles(ctx, articles); err != nil {
+
+		// 抓取在后台任务中执行，通过 /api/jobs/{id} 查询进度
+		job, err := jobs.Submit(r.Context(), albumURL, model.JobModeFull)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// 返回结果
+		// 返回任务信息
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": true,
-			"data":    articles,
-			"message": "Articles fetched and saved successfully",
+			"data":    job,
+			"message": "Fetch job submitted",
 		})
 	})
 
-	// 获取文章列表
-	http.HandleFunc("/api/articles", func(w http.ResponseWriter, r *http.Request) {
+	// 获取抓取任务列表
+	mux.HandleFunc("/api/jobs", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		articles, err := db.GetArticles(ctx)
+		list, err := db.GetJobs(r.Context(), r.URL.Query().Get("status"), 50)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -95,155 +241,659 @@ func main() {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": true,
-			"data":    articles,
+			"data":    list,
 		})
 	})
 
-	// 获取主题列表
-	http.HandleFunc("/api/topics", func(w http.ResponseWriter, r *http.Request) {
+	// 获取抓取任务状态
+	mux.HandleFunc("/api/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		topics, err := db.GetTopics(ctx)
+		job, err := jobs.Get(r.Context(), r.PathValue("id"))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if job == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": true,
-			"data":    topics,
+			"data":    job,
 		})
 	})
 
-	// 添加图片代理接口
-	http.HandleFunc("/api/proxy/image", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+	// 取消抓取任务，已获取的文章会保存，之后可以从中断处继续
+	mux.HandleFunc("/api/jobs/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		imageURL := r.URL.Query().Get("url")
-		if imageURL == "" {
-			http.Error(w, "Image URL is required", http.StatusBadRequest)
+		job, err := jobs.Cancel(r.Context(), r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if job == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    job,
+		})
+	})
+
+	// 从记录的分页位置继续已取消或失败的任务
+	mux.HandleFunc("/api/jobs/{id}/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// 创建图片请求
-		req, err := http.NewRequest("GET", imageURL, nil)
+		job, err := jobs.Resume(r.Context(), r.PathValue("id"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if job == nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
 			return
 		}
 
-		// 添加必要的请求头
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36")
-		req.Header.Set("Referer", "https://mp.weixin.qq.com/")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    job,
+		})
+	})
+
+	// 从专辑已抓取到的最早位置继续抓取更早的文章
+	mux.HandleFunc("/api/albums/{id}/backfill", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-		// 发送请求
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		job, err := jobs.Backfill(r.Context(), r.PathValue("id"))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer resp.Body.Close()
+		if job == nil {
+			http.Error(w, "Album not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    job,
+		})
+	})
 
-		// 复制响应头
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
+	// 专辑订阅列表与新建订阅
+	mux.HandleFunc("/api/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			subs, err := db.GetSubscriptions(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data":    subs,
+			})
+
+		case http.MethodPost:
+			var request struct {
+				URL             string `json:"url"`
+				IntervalMinutes int    `json:"interval_minutes"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+
+			if request.URL == "" {
+				http.Error(w, "URL is required", http.StatusBadRequest)
+				return
+			}
+
+			// 默认每小时刷新一次
+			if request.IntervalMinutes == 0 {
+				request.IntervalMinutes = 60
+			}
+
+			sub, err := scheduler.Subscribe(r.Context(), request.URL, request.IntervalMinutes)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data":    sub,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// 取消专辑订阅
+	mux.HandleFunc("/api/subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := db.DeleteSubscription(r.Context(), r.PathValue("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		// 复制图片数据
-		io.Copy(w, resp.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
 	})
 
-	// 修改原有的代理接口
-	// 修改代理接口
-	http.HandleFunc("/api/proxy", func(w http.ResponseWriter, r *http.Request) {
+	// 获取文章列表，支持按主题、作者、发布时间过滤，排序和分页
+	mux.HandleFunc("/api/articles", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		targetURL := r.URL.Query().Get("url")
-		if targetURL == "" {
-			http.Error(w, "URL is required", http.StatusBadRequest)
+		query, err := parseArticleQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		list, err := db.QueryArticles(r.Context(), query)
+		if errors.Is(err, storage.ErrInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("Proxying request to: %s", targetURL)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"data":        list.Articles,
+			"next_cursor": list.NextCursor,
+			"total":       list.Total,
+		})
+	})
+
+	// 获取、删除或手动修改单篇文章
+	mux.HandleFunc("/api/articles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		switch r.Method {
+		case http.MethodGet:
+			article, err := db.GetArticle(r.Context(), id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if article == nil {
+				http.Error(w, "Article not found", http.StatusNotFound)
+				return
+			}
+
+			neighbors, err := db.GetArticleNeighbors(r.Context(), article.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data":    article,
+				"prev":    neighbors.Prev,
+				"next":    neighbors.Next,
+			})
+
+		case http.MethodPatch:
+			var patch storage.ArticlePatch
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if patch.Title != nil && strings.TrimSpace(*patch.Title) == "" {
+				http.Error(w, "Title must not be empty", http.StatusBadRequest)
+				return
+			}
+			if patch.Topic != nil && strings.TrimSpace(*patch.Topic) == "" {
+				http.Error(w, "Topic must not be empty", http.StatusBadRequest)
+				return
+			}
+
+			article, err := db.UpdateArticle(r.Context(), id, patch)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if article == nil {
+				http.Error(w, "Article not found", http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data":    article,
+			})
+
+		case http.MethodDelete:
+			found, err := db.DeleteArticle(r.Context(), id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !found {
+				http.Error(w, "Article not found", http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// 阅读视图：只显示清理后的正文，不执行脚本。正文尚未下载时跳转到代理的原文页面
+	mux.HandleFunc("/api/articles/{id}/reader", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-		// 创建代理请求
-		req, err := http.NewRequest("GET", targetURL, nil)
+		article, err := db.GetArticle(r.Context(), r.PathValue("id"))
 		if err != nil {
-			log.Printf("Error creating request: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if article == nil {
+			http.Error(w, "Article not found", http.StatusNotFound)
+			return
+		}
+		if article.Content == "" {
+			if article.URL == "" {
+				http.Error(w, "文章没有正文", http.StatusNotFound)
+				return
+			}
+			http.Redirect(w, r, "/api/proxy?url="+url.QueryEscape(article.URL), http.StatusFound)
+			return
+		}
 
-		// 设置请求头
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-		req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
-		req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
-		req.Header.Set("Accept-Encoding", "gzip")
-		req.Header.Set("Connection", "keep-alive")
-		req.Header.Set("Referer", "https://mp.weixin.qq.com/")
+		var buf bytes.Buffer
+		if err := service.RenderReader(&buf, article); err != nil {
+			slog.ErrorContext(r.Context(), "渲染阅读视图失败", "article_id", article.ID, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", service.ReaderCSP)
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(buf.Bytes())
+	})
 
-		client := &http.Client{
-			Timeout: 30 * time.Second,
+	// 导出为带 YAML front matter 的 Markdown。format=md 时归档的图片引用本服务的地址，
+	// format=zip 时与主题导出相同，Markdown 和归档的图片一起打包，不依赖本服务
+	mux.HandleFunc("/api/articles/{id}/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "md" && format != "zip" {
+			http.Error(w, "不支持的导出格式: "+format, http.StatusBadRequest)
+			return
 		}
 
-		resp, err := client.Do(req)
+		article, err := db.GetArticle(r.Context(), r.PathValue("id"))
 		if err != nil {
-			log.Printf("Error fetching content: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer resp.Body.Close()
+		if article == nil {
+			http.Error(w, "Article not found", http.StatusNotFound)
+			return
+		}
 
-		// 处理响应内容
-		var reader io.Reader = resp.Body
-		if resp.Header.Get("Content-Encoding") == "gzip" {
-			gzReader, err := gzip.NewReader(resp.Body)
+		if format == "zip" {
+			filename := strings.TrimSuffix(service.MarkdownFilename(article), ".md") + ".zip"
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+			z := service.NewMarkdownZip(w, archiver)
+			err := z.Add(article)
+			if err == nil {
+				err = z.Close()
+			}
 			if err != nil {
-				log.Printf("Error creating gzip reader: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				// 响应头已经发出，出错时只能中断
+				slog.ErrorContext(r.Context(), "导出文章失败", "article_id", article.ID, "error", err)
+			}
+			return
+		}
+
+		origin := requestOrigin(r)
+		md, err := service.ArticleMarkdown(article, func(src string) string {
+			if strings.HasPrefix(src, service.ArchivedImagePath) {
+				return origin + src
+			}
+			return src
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": service.MarkdownFilename(article)}))
+		io.WriteString(w, md)
+	})
+
+	// 修改文章的已读、星标、归档、阅读进度和最近打开时间
+	mux.HandleFunc("/api/articles/{id}/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var patch storage.ArticleStatePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		state, err := db.UpdateArticleState(r.Context(), r.PathValue("id"), patch)
+		if errors.Is(err, storage.ErrInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if state == nil {
+			http.Error(w, "Article not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    state,
+		})
+	})
+
+	markArticlesRead := func(w http.ResponseWriter, r *http.Request, albumID, topic string) {
+		marked, err := db.MarkArticlesRead(r.Context(), albumID, topic)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"marked":  marked,
+		})
+	}
+
+	// 把主题中的文章全部标记为已读。album_id 和 topic 都为空时标记全部文章
+	mux.HandleFunc("/api/topics/read", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			AlbumID string `json:"album_id"`
+			Topic   string `json:"topic"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		markArticlesRead(w, r, req.AlbumID, req.Topic)
+	})
+
+	// 把专辑中的文章全部标记为已读
+	mux.HandleFunc("/api/albums/{id}/read", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		markArticlesRead(w, r, r.PathValue("id"), "")
+	})
+
+	// 全文搜索标题和正文，支持 topic、from、to、limit 参数
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter, err := parseArticleQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		results, err := db.Search(r.Context(), storage.SearchQuery{
+			Query:   r.URL.Query().Get("q"),
+			Topic:   filter.Topic,
+			AlbumID: filter.AlbumID,
+			From:    filter.From,
+			To:      filter.To,
+			Limit:   filter.Limit,
+		})
+		if errors.Is(err, storage.ErrInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    results,
+		})
+	})
+
+	// 把主题或专辑中的文章导出为 zip，每篇一个 Markdown 文件，归档的图片放在 images 目录中。
+	// album_id 和 topic 都为空时导出全部文章
+	mux.HandleFunc("/api/topics/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if format := r.URL.Query().Get("format"); format != "" && format != "md" {
+			http.Error(w, "不支持的导出格式: "+format, http.StatusBadRequest)
+			return
+		}
+
+		query := storage.ArticleQuery{
+			Topic:   r.URL.Query().Get("topic"),
+			AlbumID: r.URL.Query().Get("album_id"),
+			Order:   "asc",
+			Limit:   100,
+		}
+		list, err := db.QueryArticles(r.Context(), query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		name := "全部文章"
+		if query.Topic != "" {
+			name = query.Topic
+		} else if query.AlbumID != "" {
+			name = query.AlbumID
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+
+		// 逐篇读取正文写入响应，响应头已经发出，出错时只能中断
+		z := service.NewMarkdownZip(w, archiver)
+		for {
+			for _, item := range list.Articles {
+				article, err := db.GetArticle(r.Context(), item.ID)
+				if err == nil && article != nil {
+					err = z.Add(article)
+				}
+				if err != nil {
+					slog.ErrorContext(r.Context(), "导出文章失败", "article_id", item.ID, "error", err)
+					return
+				}
+			}
+			if list.NextCursor == "" {
+				break
+			}
+			query.Cursor = list.NextCursor
+			if list, err = db.QueryArticles(r.Context(), query); err != nil {
+				slog.ErrorContext(r.Context(), "导出文章失败", "error", err)
 				return
 			}
-			defer gzReader.Close()
-			reader = gzReader
 		}
+		if err := z.Close(); err != nil {
+			slog.ErrorContext(r.Context(), "导出文章失败", "error", err)
+		}
+	})
 
-		body, err := io.ReadAll(reader)
+	// 获取主题列表及各主题的文章数、未读数和最新发布时间。
+	// 属于专辑的文章按专辑 ID 归类，其余按主题名称
+	mux.HandleFunc("/api/topics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		topics, err := db.GetTopics(r.Context())
 		if err != nil {
-			log.Printf("Error reading response body: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// 设置响应头
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
-		w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'; img-src * data:; default-src 'self' 'unsafe-inline' 'unsafe-eval' https://*.weixin.qq.com https://*.qpic.cn")
-		w.Header().Del("Content-Encoding") // 移除 gzip 编码头
-
-		// 处理内容并返回
-		content := string(body)
-		content = strings.ReplaceAll(content, `data-src="https://mmbiz.qpic.cn/`, `src="/wx-images/`)
-		content = strings.ReplaceAll(content, `src="https://mmbiz.qpic.cn/`, `src="/wx-images/`)
-		content = strings.ReplaceAll(content, `data-src="https://mmbiz.qlogo.cn/`, `src="/wx-qim/`)
-		content = strings.ReplaceAll(content, `src="https://mmbiz.qlogo.cn/`, `src="/wx-qim/`)
-		content = strings.ReplaceAll(content, `href="https://mp.weixin.qq.com/`, `href="/wx-mp/`)
-
-		// 添加基础样式和错误处理
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    topics,
+		})
+	})
+
+	// 获取已抓取的专辑
+	mux.HandleFunc("/api/albums", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		albums, err := db.GetAlbums(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    albums,
+		})
+	})
+
+	// 获取已保存文章的公众号
+	mux.HandleFunc("/api/accounts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		accounts, err := db.GetAccounts(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"data":    accounts,
+		})
+	})
+
+	// 添加图片代理接口
+	mux.HandleFunc("/api/proxy/image", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		imageURL := r.URL.Query().Get("url")
+		if imageURL == "" {
+			http.Error(w, "Image URL is required", http.StatusBadRequest)
+			return
+		}
+		imageProxy.Forward(w, r, imageURL)
+	})
+
+	// 修改代理接口
+	mux.HandleFunc("/api/proxy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		targetURL := r.URL.Query().Get("url")
+		if targetURL == "" {
+			http.Error(w, "URL is required", http.StatusBadRequest)
+			return
+		}
+
+		slog.DebugContext(r.Context(), "代理页面", "url", targetURL)
+
+		target, err := url.Parse(targetURL)
+		if err != nil || target.Host == "" {
+			http.Error(w, "无效的地址", http.StatusBadRequest)
+			return
+		}
+
 		// 添加新窗口打开按钮
-		originalURL := targetURL
+		originalURL := html.EscapeString(targetURL)
 		openButton := fmt.Sprintf(`
 			<div style="position: fixed; top: 20px; right: 20px; z-index: 1000;">
 				<a href="%s" target="_blank" style="
@@ -262,124 +912,254 @@ func main() {
 			</div>
 		`, originalURL)
 
-		content = strings.ReplaceAll(content, `<head>`, `<head>
-			<base target="_blank">
-			<style>
-				img { max-width: 100%; height: auto; }
-				img[src=""] { display: none; }
-				body { padding: 20px; }
-				.rich_media_content { font-size: 16px; line-height: 1.6; }
-			</style>
-			<script>
-				window.onerror = function(msg, url, line) {
-					console.error('Error: ' + msg + '\nURL: ' + url + '\nLine: ' + line);
-					return false;
-				};
-			</script>`)
-		content = strings.ReplaceAll(content, `<body>`, `<body>`+openButton)
-
-		// 设置响应头
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
-		w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'")
-
-		// 返回修改后的内容
-		if _, err := w.Write([]byte(content)); err != nil {
-			log.Printf("Error writing response: %v", err)
-		}
+		// 解析页面后改写图片和链接的地址，删除微信的脚本，正文默认隐藏，由样式显示
+		proxyURL := rewrite.ProxyURL(target)
+		pageProxy.ForwardRewrite(w, r, targetURL, rewrite.New(
+			rewrite.PromoteImages(proxyURL),
+			rewrite.RewriteLinks(proxyURL),
+			rewrite.StripScripts(),
+			rewrite.InjectHead(`<base target="_blank">`),
+			rewrite.InjectStyle(proxyPageStyle),
+			rewrite.InjectBody(openButton),
+		))
 	})
 
+	// 归档到本地的文章图片，文件名由内容决定，可以长期缓存
+	mux.Handle(service.ArchivedImagePath, archiver)
+
 	// 添加微信资源代理路由
-	http.HandleFunc("/wx-images/", func(w http.ResponseWriter, r *http.Request) {
-		proxyURL := "https://mmbiz.qpic.cn" + strings.TrimPrefix(r.URL.Path, "/wx-images")
-		proxyRequest(w, r, proxyURL)
+	mux.HandleFunc("/wx-images/", func(w http.ResponseWriter, r *http.Request) {
+		wxProxy.Forward(w, r, wxResourceURL("https://mmbiz.qpic.cn", "/wx-images", r))
 	})
 
-	http.HandleFunc("/wx-qim/", func(w http.ResponseWriter, r *http.Request) {
-		proxyURL := "https://mmbiz.qlogo.cn" + strings.TrimPrefix(r.URL.Path, "/wx-qim")
-		proxyRequest(w, r, proxyURL)
+	mux.HandleFunc("/wx-qim/", func(w http.ResponseWriter, r *http.Request) {
+		wxProxy.Forward(w, r, wxResourceURL("https://mmbiz.qlogo.cn", "/wx-qim", r))
 	})
 
-	http.HandleFunc("/wx-mp/", func(w http.ResponseWriter, r *http.Request) {
-		proxyURL := "https://mp.weixin.qq.com" + strings.TrimPrefix(r.URL.Path, "/wx-mp")
-		proxyRequest(w, r, proxyURL)
+	mux.HandleFunc("/wx-mp/", func(w http.ResponseWriter, r *http.Request) {
+		wxProxy.Forward(w, r, wxResourceURL("https://mp.weixin.qq.com", "/wx-mp", r))
 	})
 
 	// 静态文件服务
-	http.Handle("/", http.FileServer(http.Dir("/usr/share/nginx/html")))
+	mux.Handle("/", http.FileServer(http.Dir("/usr/share/nginx/html")))
 
 	// 健康检查
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	})
 
-	log.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatal(err)
+	// 每个请求带上请求 ID 并记录访问日志
+	server := &http.Server{Addr: ":8080", Handler: logging.Middleware(mux)}
+	go func() {
+		slog.Info("服务启动", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("服务异常退出", err)
+		}
+	}()
+
+	// 管理端口只提供运行统计，默认只监听本机
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	adminServer := &http.Server{Addr: adminAddr(), Handler: adminMux}
+	go func() {
+		slog.Info("管理端口启动", "addr", adminServer.Addr)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("管理端口异常退出", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("正在关闭服务")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("关闭服务失败", "error", err)
 	}
+	adminServer.Shutdown(shutdownCtx)
+	// 等待抓取任务保存进度
+	jobs.Wait()
 }
 
-// 通用代理处理函数
-func proxyRequest(w http.ResponseWriter, r *http.Request, targetURL string) {
-	req, err := http.NewRequest(r.Method, targetURL, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// parseArticleQuery 解析文章列表的查询参数。
+// from 和 to 可以是日期（2006-01-02，to 包含当天）或 RFC 3339 时间
+func parseArticleQuery(r *http.Request) (storage.ArticleQuery, error) {
+	params := r.URL.Query()
+	query := storage.ArticleQuery{
+		Topic:   params.Get("topic"),
+		AlbumID: params.Get("album_id"),
+		Author:  params.Get("author"),
+		Sort:    params.Get("sort"),
+		Order:   params.Get("order"),
+		Cursor:  params.Get("cursor"),
+	}
+
+	for _, p := range []struct {
+		name string
+		dest **bool
+	}{{"read", &query.Read}, {"starred", &query.Starred}, {"archived", &query.Archived}} {
+		s := params.Get(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return query, fmt.Errorf("无效的 %s: %s", p.name, s)
+		}
+		*p.dest = &v
 	}
 
-	// 添加微信相关请求头
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 MicroMessenger/7.0.20.1781(0x6700143B) NetType/WIFI MiniProgramEnv/Windows WindowsWechat/WMPF WindowsWechat(0x6309092b) XWEB/9053")
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7")
-	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en;q=0.8")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Referer", "https://mp.weixin.qq.com/")
-	req.Header.Set("Sec-Fetch-Dest", "document")
-	req.Header.Set("Sec-Fetch-Mode", "navigate")
-	req.Header.Set("Sec-Fetch-Site", "same-origin")
-	req.Header.Set("Sec-Fetch-User", "?1")
-	req.Header.Set("Upgrade-Insecure-Requests", "1")
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	if s := params.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return query, fmt.Errorf("无效的 limit: %s", s)
+		}
+		query.Limit = limit
+	}
+
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		s := params.Get(p.name)
+		if s == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			*p.dest = t
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return query, fmt.Errorf("无效的 %s: %s", p.name, s)
+		}
+		if p.name == "to" {
+			t = t.AddDate(0, 0, 1)
+		}
+		*p.dest = t
 	}
-	resp, err := client.Do(req)
+
+	return query, nil
+}
+
+// migrate 执行数据库迁移。migrate status 只查看当前版本和待执行的迁移
+func migrate(ctx context.Context, dsn string, args []string) error {
+	db, err := storage.OpenStore(ctx, dsn)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-	defer resp.Body.Close()
+	defer db.Close(ctx)
 
-	// 复制响应头
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+	if len(args) > 0 && args[0] == "status" {
+		status, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("当前版本: %d，最新版本: %d\n", status.Version, status.Latest)
+		for _, m := range status.Pending {
+			fmt.Printf("待执行: %d %s\n", m.Version, m.Name)
+		}
+		return nil
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("未知参数 %s", args[0])
 	}
 
-	// 处理响应内容
-	var reader io.Reader = resp.Body
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		gzReader, err := gzip.NewReader(resp.Body)
+	applied, err := db.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("数据库已是最新版本")
+	}
+	return nil
+}
+
+// archive 归档已保存文章中的图片。archive gc 删除没有文章引用的图片，
+// 最近一小时内下载的图片可能属于正在抓取的文章，不删除
+func archive(ctx context.Context, db storage.Store, archiver *service.ImageArchiver, args []string) error {
+	if len(args) > 0 && args[0] == "gc" {
+		removed, err := archiver.CollectGarbage(ctx, db, time.Hour)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return err
 		}
-		defer gzReader.Close()
-		reader = gzReader
+		slog.Info("清理图片完成", "removed", removed)
+		return nil
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("未知参数 %s", args[0])
 	}
 
-	body, err := io.ReadAll(reader)
+	updated, err := archiver.ArchiveArticles(ctx, db)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
+	slog.Info("归档图片完成", "articles", updated)
+	return nil
+}
 
-	// 设置响应头
-	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	w.Header().Set("X-Frame-Options", "SAMEORIGIN")
-	w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'; img-src * data:; default-src 'self' 'unsafe-inline' 'unsafe-eval' https://*.weixin.qq.com https://*.qpic.cn")
-	w.Header().Del("Content-Encoding") // 移除 gzip 编码头
+// fatal 输出错误日志后退出
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
 
-	// 返回处理后的内容
-	w.Write(body)
+// requestOrigin 浏览器访问本服务使用的协议和域名，用于生成导出文件中的绝对地址
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// wxResourceURL 把 /wx-images/ 等代理路径换回微信的地址，保留查询参数
+func wxResourceURL(base, prefix string, r *http.Request) string {
+	target := base + strings.TrimPrefix(r.URL.Path, prefix)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	return target
+}
+
+// egressConfig 出站请求允许访问的范围。EGRESS_ALLOW_HOSTS 可以追加允许的域名，多个用逗号分隔，
+// 写法与 EgressConfig.AllowedHosts 相同
+func egressConfig() service.EgressConfig {
+	config := service.DefaultEgressConfig()
+	for _, host := range strings.Split(os.Getenv("EGRESS_ALLOW_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			config.AllowedHosts = append(config.AllowedHosts, host)
+		}
+	}
+	return config
+}
+
+// adminAddr 管理端口的监听地址，由 ADMIN_ADDR 指定，默认只监听本机的 6060 端口
+func adminAddr() string {
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		return addr
+	}
+	return "127.0.0.1:6060"
+}
+
+// proxyCacheConfig 代理缓存的配置。CACHE_DIR 为缓存目录，默认为当前目录下的 cache；
+// CACHE_MAX_MB 为缓存大小上限，默认 256 MB。没有缓存头的响应按 service.WeChatDefaultTTL 缓存
+func proxyCacheConfig(pwd string) service.HTTPCacheConfig {
+	config := service.HTTPCacheConfig{
+		Dir:        os.Getenv("CACHE_DIR"),
+		MaxBytes:   256 << 20,
+		DefaultTTL: service.WeChatDefaultTTL,
+	}
+	if config.Dir == "" {
+		config.Dir = filepath.Join(pwd, "cache")
+	}
+	if s := os.Getenv("CACHE_MAX_MB"); s != "" {
+		if mb, err := strconv.Atoi(s); err == nil && mb > 0 {
+			config.MaxBytes = int64(mb) << 20
+		} else {
+			slog.Warn("无效的 CACHE_MAX_MB，使用默认值", "value", s)
+		}
+	}
+	return config
 }
@@ -0,0 +1,141 @@
+// Package logging 基于 log/slog 的结构化日志。
+// 请求 ID、任务 ID、专辑 ID 等通过 context 传递，同一个 ctx 下的日志自动带上这些字段
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Config 日志输出配置
+type Config struct {
+	// Level 最低输出级别：debug、info、warn、error，默认 info
+	Level string
+	// Format 输出格式：text 或 json，默认 text
+	Format string
+}
+
+// ConfigFromEnv 从 LOG_LEVEL 和 LOG_FORMAT 环境变量读取配置
+func ConfigFromEnv(getenv func(string) string) Config {
+	return Config{
+		Level:  getenv("LOG_LEVEL"),
+		Format: getenv("LOG_FORMAT"),
+	}
+}
+
+// New 按配置创建 logger，输出到 w
+func New(w io.Writer, config Config) (*slog.Logger, error) {
+	var level slog.Level
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return nil, fmt.Errorf("无效的日志级别 %q", config.Level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("无效的日志格式 %q", config.Format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+type contextKey struct{}
+
+// With 返回带有日志字段的 ctx，之后用该 ctx 输出的日志都会带上这些字段
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := append(attrsFrom(ctx), slog.Group("", args...).Value.Group()...)
+	return context.WithValue(ctx, contextKey{}, attrs)
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(contextKey{}).([]slog.Attr)
+	// 复制一份，避免多个 ctx 共用底层数组
+	return append([]slog.Attr(nil), attrs...)
+}
+
+// contextHandler 把 ctx 中的字段加到每条日志上
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		r.AddAttrs(attrsFrom(ctx)...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RequestIDHeader 请求 ID 的请求头和响应头
+const RequestIDHeader = "X-Request-ID"
+
+// Middleware 为每个请求分配请求 ID 并记录访问日志。
+// 客户端传入 X-Request-ID 时沿用，否则随机生成
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := With(r.Context(), "request_id", id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "处理请求",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// statusRecorder 记录响应状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap 供 http.ResponseController 使用
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
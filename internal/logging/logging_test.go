@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAddsContextAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Level: "debug", Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := With(context.Background(), "job_id", "job_1")
+	// 派生的 ctx 追加字段，不影响父 ctx
+	child := With(ctx, "album_id", "123")
+	logger.DebugContext(child, "hello", "pages", 2)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("output is not JSON: %q", buf.String())
+	}
+	if entry["job_id"] != "job_1" || entry["album_id"] != "123" || entry["pages"] != float64(2) {
+		t.Errorf("entry = %v", entry)
+	}
+
+	buf.Reset()
+	logger.InfoContext(ctx, "parent")
+	if bytes.Contains(buf.Bytes(), []byte("album_id")) {
+		t.Errorf("parent ctx picked up child attrs: %s", buf.String())
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, Config{Level: "verbose"}); err == nil {
+		t.Error("expected error for unknown level")
+	}
+	if _, err := New(&bytes.Buffer{}, Config{Format: "xml"}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+
+	var buf bytes.Buffer
+	logger, _ := New(&buf, Config{})
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("debug logged at default level: %s", buf.String())
+	}
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, Config{Format: "json"})
+	old := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(old)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "inside")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest("GET", "/api/articles", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(RequestIDHeader); got != "req-1" {
+		t.Errorf("response request id = %q, want req-1", got)
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["request_id"] != "req-1" {
+			t.Errorf("entry without request id: %s", line)
+		}
+	}
+	var access map[string]any
+	json.Unmarshal(lines[1], &access)
+	if access["status"] != float64(http.StatusTeapot) || access["path"] != "/api/articles" {
+		t.Errorf("access log = %v", access)
+	}
+}
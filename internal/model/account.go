@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// Account 公众号，Biz 为文章链接中的 __biz 参数
+type Account struct {
+	Biz          string    `json:"biz"`
+	Name         string    `json:"name"`
+	Avatar       string    `json:"avatar"`
+	ArticleCount int       `json:"article_count"` // 已保存的文章数，查询时统计
+	UpdateTime   time.Time `json:"update_time"`
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// Album 公众号专辑。Title 来自专辑页面，专辑改名后同一专辑下的文章仍然归在一起
+type Album struct {
+	ID           string    `json:"album_id"`
+	Biz          string    `json:"biz"`
+	Title        string    `json:"title"`
+	Description  string    `json:"description"`
+	Cover        string    `json:"cover"`
+	ArticleCount int       `json:"article_count"` // 专辑页面显示的文章数
+	SavedCount   int       `json:"saved_count"`   // 已保存的文章数，查询时统计
+	UpdateTime   time.Time `json:"update_time"`
+}
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// AlbumCursor 专辑翻页进度，记录最近一次向下翻页成功到达的位置
+type AlbumCursor struct {
+	AlbumID    string    `json:"album_id"`
+	URL        string    `json:"url"`
+	Msgid      string    `json:"msgid"`
+	Itemidx    int       `json:"itemidx"`
+	ReachedEnd bool      `json:"reached_end"` // continue_flag 为 0，已经到达专辑中最早的文章
+	UpdateTime time.Time `json:"update_time"`
+}
@@ -6,9 +6,13 @@ type Article struct {
     ID          string    `json:"id"`
     Title       string    `json:"title"`
     Author      string    `json:"author"`
-    Content     string    `json:"content"`
+    Account     string    `json:"account"`    // 公众号名称
+    Content     string    `json:"content,omitempty"` // 列表接口不返回正文
     URL         string    `json:"url"`
     Topic       string    `json:"topic"`      // 添加主题字段
+    AlbumID     string    `json:"album_id"`   // 所属专辑，手动修改主题后为空
+    Biz         string    `json:"biz"`        // 公众号标识
+    State       ArticleState `json:"state"`   // 阅读状态
     PublishTime time.Time `json:"publish_time"`
     CreateTime  time.Time `json:"create_time"`
 }
\ No newline at end of file
@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// ArticleState 文章的阅读状态，与文章内容分开保存，重新抓取时不受影响
+type ArticleState struct {
+	Read         bool       `json:"read"`
+	Starred      bool       `json:"starred"`
+	Archived     bool       `json:"archived"`
+	Progress     int        `json:"progress"`       // 阅读进度百分比，0 到 100
+	LastOpenTime *time.Time `json:"last_open_time"` // 最近一次打开的时间，没有打开过时为空
+}
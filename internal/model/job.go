@@ -0,0 +1,49 @@
+package model
+
+import "time"
+
+// 抓取任务状态
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// 抓取任务类型
+const (
+	// JobModeFull 抓取整个专辑，专辑上次没有抓完时从记录的分页位置继续
+	JobModeFull = "full"
+	// JobModeIncremental 从最新的文章开始，遇到已保存的文章即停止翻页
+	JobModeIncremental = "incremental"
+	// JobModeBackfill 从专辑记录的分页位置继续向更早的文章抓取
+	JobModeBackfill = "backfill"
+)
+
+// Job 后台抓取任务
+type Job struct {
+	ID              string    `json:"id"`
+	URL             string    `json:"url"`
+	Mode            string    `json:"mode"`
+	Status          string    `json:"status"`
+	PagesFetched    int       `json:"pages_fetched"`
+	ArticlesFound   int       `json:"articles_found"`
+	ContentsFetched int       `json:"contents_fetched"`
+	Errors          []string  `json:"errors"`
+	Error           string    `json:"error,omitempty"` // 导致任务失败的错误
+	ResumeMsgid     string    `json:"resume_msgid"`    // 中断时的分页位置，继续执行时从这里开始
+	ResumeItemidx   int       `json:"resume_itemidx"`
+	CreateTime      time.Time `json:"create_time"`
+	UpdateTime      time.Time `json:"update_time"`
+	// Owner 正在执行任务的服务实例，租约到 LeaseUntil 为止，过期后其他实例可以接手
+	Owner      string     `json:"owner,omitempty"`
+	LeaseUntil *time.Time `json:"lease_until,omitempty"`
+	// CancelRequested 已请求取消，由执行任务的实例停止
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+}
+
+// Finished 任务是否已结束
+func (j *Job) Finished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed || j.Status == JobStatusCancelled
+}
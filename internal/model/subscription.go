@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// Subscription 定时刷新的专辑订阅
+type Subscription struct {
+	AlbumID         string    `json:"album_id"`
+	URL             string    `json:"url"`
+	IntervalMinutes int       `json:"interval_minutes"`
+	LastJobID       string    `json:"last_job_id"`
+	LastRefreshTime time.Time `json:"last_refresh_time"`
+	NextRefreshTime time.Time `json:"next_refresh_time"`
+	CreateTime      time.Time `json:"create_time"`
+}
@@ -0,0 +1,370 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/service/rewrite"
+	"wechat-reader/internal/storage"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ArchivedImagePath 归档图片的访问路径前缀，后接图片内容的 SHA-256 和扩展名
+const ArchivedImagePath = "/archive/images/"
+
+// 单张图片的大小上限，超过时不归档
+const maxImageSize = 20 << 20
+
+// 需要归档的图片域名，其余图片保留原链接
+var archivedImageHosts = map[string]bool{
+	"mmbiz.qpic.cn":  true,
+	"mmbiz.qlogo.cn": true,
+}
+
+// 图片类型对应的扩展名，其他类型的图片不带扩展名
+var imageExtensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/svg+xml": ".svg",
+	"image/bmp":     ".bmp",
+}
+
+var (
+	// 归档图片的文件名
+	blobNameRegexp = regexp.MustCompile(`^([0-9a-f]{64})(\.[a-z]+)?$`)
+	// 正文中引用的归档图片
+	blobRefRegexp = regexp.MustCompile(regexp.QuoteMeta(ArchivedImagePath) + `([0-9a-f]{64})`)
+)
+
+// ImageArchiver 把文章正文中引用的微信图片下载到本地目录，并把正文改为引用本地文件。
+// 图片按内容的 SHA-256 命名，保存在以前两位命名的子目录中，相同的图片只保存一份。
+// 微信删除文章或图片链接失效后，已归档的图片仍然可以显示
+type ImageArchiver struct {
+	dir     string
+	fetcher Fetcher
+}
+
+// NewImageArchiver 把图片保存在 dir 中，用 fetcher 下载。限速和重试由 Policy 负责
+func NewImageArchiver(dir string, fetcher Fetcher) *ImageArchiver {
+	return &ImageArchiver{dir: dir, fetcher: fetcher}
+}
+
+// ArchiveContent 下载正文中 <img> 引用的微信图片并改写链接，原链接保存在 data-original-src 中。
+// 单张图片下载失败时保留原链接，返回改写后的正文和归档的图片数
+func (a *ImageArchiver) ArchiveContent(ctx context.Context, content string) (string, int, error) {
+	if !strings.Contains(content, "<img") {
+		return content, 0, nil
+	}
+
+	archived := 0
+	saved := make(map[string]string) // 同一篇文章中重复引用的图片只下载一次
+	archive := func(doc *goquery.Document) {
+		doc.Find("img").Each(func(_ int, img *goquery.Selection) {
+			if ctx.Err() != nil {
+				return
+			}
+			src := rewrite.ImageURL(img)
+			imageURL, ok := archivableImageURL(src)
+			if !ok {
+				return
+			}
+
+			path, ok := saved[imageURL]
+			if !ok {
+				name, err := a.fetch(ctx, imageURL)
+				if err != nil {
+					slog.WarnContext(ctx, "归档图片失败", "url", imageURL, "error", err)
+					return
+				}
+				path = ArchivedImagePath + name
+				saved[imageURL] = path
+			}
+			img.SetAttr("src", path)
+			img.SetAttr("data-original-src", src)
+			img.RemoveAttr("data-src")
+			archived++
+		})
+	}
+
+	html, err := rewrite.New(archive).Fragment(content)
+	if err != nil {
+		return content, 0, err
+	}
+	if archived == 0 {
+		return content, 0, nil
+	}
+	return html, archived, nil
+}
+
+// keepArchivedImages 把 content 中此前已归档、这次没有归档成功的图片改回 previous 中的本地路径，
+// 按 data-original-src 匹配原链接。重新抓取时图片暂时下载失败，正文不会丢掉已归档的图片，
+// 图片文件也不会因为没有引用而被清理
+func keepArchivedImages(previous, content string) string {
+	if !strings.Contains(previous, ArchivedImagePath) || !strings.Contains(content, "<img") {
+		return content
+	}
+
+	archived := make(map[string]string) // 原链接 -> 本地路径
+	for path, original := range archivedImageRefs(previous) {
+		archived[original] = path
+	}
+	if len(archived) == 0 {
+		return content
+	}
+
+	kept := 0
+	keep := func(doc *goquery.Document) {
+		doc.Find("img").Each(func(_ int, img *goquery.Selection) {
+			if strings.HasPrefix(img.AttrOr("src", ""), ArchivedImagePath) {
+				return
+			}
+			src := rewrite.ImageURL(img)
+			path, ok := archived[src]
+			if !ok {
+				return
+			}
+			img.SetAttr("src", path)
+			img.SetAttr("data-original-src", src)
+			img.RemoveAttr("data-src")
+			kept++
+		})
+	}
+	html, err := rewrite.New(keep).Fragment(content)
+	if err != nil || kept == 0 {
+		return content
+	}
+	return html
+}
+
+// archivedImageRefs 返回正文中已归档图片的本地路径和 data-original-src 中的原链接
+func archivedImageRefs(content string) map[string]string {
+	refs := make(map[string]string) // 本地路径 -> 原链接
+	collect := func(doc *goquery.Document) {
+		doc.Find("img[data-original-src]").Each(func(_ int, img *goquery.Selection) {
+			if src := img.AttrOr("src", ""); strings.HasPrefix(src, ArchivedImagePath) {
+				refs[src] = img.AttrOr("data-original-src", "")
+			}
+		})
+	}
+	if _, err := rewrite.New(collect).Fragment(content); err != nil {
+		return nil
+	}
+	return refs
+}
+
+// ArchiveArticles 归档已保存文章中尚未归档的图片，返回正文有修改的文章数。
+// 归档期间被重新抓取的文章不修改，下次执行时再处理
+func (a *ImageArchiver) ArchiveArticles(ctx context.Context, db storage.Store) (int, error) {
+	articles, err := db.GetArticles(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, article := range articles {
+		if ctx.Err() != nil {
+			return updated, ctx.Err()
+		}
+		content, n, err := a.ArchiveContent(ctx, article.Content)
+		if err != nil {
+			slog.WarnContext(ctx, "归档文章图片失败", "article_id", article.ID, "error", err)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		ok, err := db.ReplaceArticleContent(ctx, article.ID, article.Content, content)
+		if err != nil {
+			return updated, err
+		}
+		if ok {
+			slog.InfoContext(ctx, "已归档文章图片", "article_id", article.ID, "images", n)
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+// CollectGarbage 删除没有文章引用的图片，返回删除的文件数。
+// 修改时间在 grace 之内的图片不删除，正在抓取的文章可能已经下载了图片但还没有保存
+func (a *ImageArchiver) CollectGarbage(ctx context.Context, db storage.Store, grace time.Duration) (int, error) {
+	articles, err := db.GetArticles(ctx)
+	if err != nil {
+		return 0, err
+	}
+	referenced := make(map[string]bool)
+	for _, article := range articles {
+		for _, m := range blobRefRegexp.FindAllStringSubmatch(article.Content, -1) {
+			referenced[m[1]] = true
+		}
+	}
+
+	removed := 0
+	cutoff := time.Now().Add(-grace)
+	err = filepath.WalkDir(a.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == a.dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		m := blobNameRegexp.FindStringSubmatch(d.Name())
+		if d.IsDir() || m == nil || referenced[m[1]] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// ServeHTTP 返回归档的图片。文件名由内容决定，内容不会改变，可以长期缓存
+func (a *ImageArchiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, ArchivedImagePath)
+	m := blobNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(a.blobPath(name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+m[1]+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// SVG 等图片直接打开时可能执行其中的脚本，禁止加载任何资源并隔离为独立的源
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	w.Header().Set("Content-Disposition", "inline")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// fetch 下载图片并按内容保存，返回文件名
+func (a *ImageArchiver) fetch(ctx context.Context, imageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36")
+	req.Header.Set("Referer", "https://mp.weixin.qq.com/")
+
+	resp, err := a.fetcher.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("服务器返回错误状态码: %d", resp.StatusCode)
+	}
+	return a.save(resp.Body, resp.Header.Get("Content-Type"))
+}
+
+// save 把图片写入临时文件，计算出 SHA-256 后移动到对应的位置。已有相同内容的图片时直接使用
+func (a *ImageArchiver) save(body io.Reader, contentType string) (string, error) {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(a.dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, maxImageSize+1))
+	if err != nil {
+		return "", fmt.Errorf("读取图片失败: %v", err)
+	}
+	if n > maxImageSize {
+		return "", fmt.Errorf("图片超过 %d MB", maxImageSize>>20)
+	}
+
+	// 以图片内容判断类型，响应头中的类型不可靠
+	head := make([]byte, 512)
+	m, _ := tmp.ReadAt(head, 0)
+	mediaType := http.DetectContentType(head[:m])
+	if !strings.HasPrefix(mediaType, "image/") {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+		mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return "", fmt.Errorf("不是图片: %s", mediaType)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	name := hex.EncodeToString(hash.Sum(nil)) + imageExtensions[mediaType]
+	path := a.blobPath(name)
+	if _, err := os.Stat(path); err == nil {
+		// 更新修改时间，避免刚引用的图片被同时执行的 CollectGarbage 删除
+		now := time.Now()
+		return name, os.Chtimes(path, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// blobPath 图片文件的路径
+func (a *ImageArchiver) blobPath(name string) string {
+	return filepath.Join(a.dir, name[:2], name)
+}
+
+// archivableImageURL 判断图片地址是否需要归档，返回补全协议后的地址
+func archivableImageURL(src string) (string, bool) {
+	src = strings.TrimSpace(src)
+	if strings.HasPrefix(src, "//") {
+		src = "https:" + src
+	}
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !archivedImageHosts[u.Hostname()] {
+		return "", false
+	}
+	return u.String(), true
+}
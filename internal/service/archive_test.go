@@ -0,0 +1,200 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+// 最小的 PNG 文件头，足以被识别为 image/png
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+
+// 正文中归档后的 PNG 图片路径
+var archivedPNGRegexp = regexp.MustCompile(regexp.QuoteMeta(ArchivedImagePath) + `[0-9a-f]{64}\.png`)
+
+// imageFetcher 按完整 URL 返回图片，不存在时返回 404
+type imageFetcher struct {
+	images   map[string][]byte
+	requests []string
+}
+
+func (f *imageFetcher) Do(req *http.Request) (*http.Response, error) {
+	f.requests = append(f.requests, req.URL.String())
+	body, ok := f.images[req.URL.String()]
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusNotFound
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"image/png"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestArchiveContentRewritesImages(t *testing.T) {
+	const img = "https://mmbiz.qpic.cn/mmbiz_png/abc/640?wx_fmt=png&from=appmsg"
+	f := &imageFetcher{images: map[string][]byte{img: testPNG}}
+	dir := t.TempDir()
+	archiver := NewImageArchiver(dir, f)
+
+	content := `<p>正文</p><img data-src="https://mmbiz.qpic.cn/mmbiz_png/abc/640?wx_fmt=png&amp;from=appmsg" src=""/>` +
+		`<img src="https://mmbiz.qpic.cn/mmbiz_png/abc/640?wx_fmt=png&amp;from=appmsg"/>` +
+		`<img src="https://example.com/a.png"/>` +
+		`<img data-src="https://mmbiz.qpic.cn/missing/640"/>`
+	got, n, err := archiver.ArchiveContent(context.Background(), content)
+	if err != nil {
+		t.Fatalf("ArchiveContent: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("archived %d images, want 2", n)
+	}
+	// 同一张图片只下载一次，其他域名的图片不下载
+	if len(f.requests) != 2 {
+		t.Errorf("requests = %v", f.requests)
+	}
+
+	if !archivedPNGRegexp.MatchString(got) {
+		t.Fatalf("content not rewritten: %s", got)
+	}
+	for _, want := range []string{
+		`data-original-src="https://mmbiz.qpic.cn/mmbiz_png/abc/640?wx_fmt=png&amp;from=appmsg"`,
+		`<img src="https://example.com/a.png"/>`,
+		`<img data-src="https://mmbiz.qpic.cn/missing/640"/>`,
+		`<p>正文</p>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("content missing %s: %s", want, got)
+		}
+	}
+	if strings.Count(got, ArchivedImagePath) != 2 {
+		t.Errorf("content = %s", got)
+	}
+
+	// 没有需要归档的图片时原样返回
+	if got, n, _ := archiver.ArchiveContent(context.Background(), "<p>没有图片</p>"); got != "<p>没有图片</p>" || n != 0 {
+		t.Errorf("ArchiveContent without images = %q, %d", got, n)
+	}
+}
+
+func TestArchiveArticlesAndCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const img = "https://mmbiz.qpic.cn/mmbiz_jpg/xyz/0"
+	if err := db.SaveArticles(ctx, []model.Article{
+		{ID: "wx_1", Title: "有图片", Topic: "A", URL: "https://mp.weixin.qq.com/s?__biz=MzA=&mid=1&idx=1", Content: `<p>一</p><img data-src="` + img + `"/>`},
+		{ID: "wx_2", Title: "没有图片", Topic: "A", URL: "https://mp.weixin.qq.com/s?__biz=MzA=&mid=2&idx=1", Content: `<p>二</p>`},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	archiver := NewImageArchiver(dir, &imageFetcher{images: map[string][]byte{img: testPNG}})
+	updated, err := archiver.ArchiveArticles(ctx, db)
+	if err != nil || updated != 1 {
+		t.Fatalf("ArchiveArticles = %d, %v", updated, err)
+	}
+	article, err := db.GetArticle(ctx, "wx_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := archivedPNGRegexp.FindString(article.Content)
+	if path == "" {
+		t.Fatalf("content not rewritten: %s", article.Content)
+	}
+	// 再次执行时没有需要归档的图片
+	if updated, err := archiver.ArchiveArticles(ctx, db); err != nil || updated != 0 {
+		t.Errorf("second ArchiveArticles = %d, %v", updated, err)
+	}
+
+	// 归档的图片可以长期缓存
+	rec := httptest.NewRecorder()
+	archiver.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), testPNG) ||
+		rec.Header().Get("Content-Type") != "image/png" || !strings.Contains(rec.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("ServeHTTP = %d %v", rec.Code, rec.Header())
+	}
+	// 直接打开图片时不执行其中的脚本
+	if csp := rec.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "sandbox") || !strings.Contains(csp, "default-src 'none'") {
+		t.Errorf("Content-Security-Policy = %q", csp)
+	}
+	rec = httptest.NewRecorder()
+	archiver.ServeHTTP(rec, httptest.NewRequest("GET", ArchivedImagePath+"../data.db", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("ServeHTTP with bad name = %d", rec.Code)
+	}
+
+	// 没有文章引用的图片超过保留时间后删除
+	orphan, err := archiver.save(strings.NewReader("GIF89a orphan"), "image/gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := archiver.CollectGarbage(ctx, db, time.Hour); err != nil || removed != 0 {
+		t.Errorf("CollectGarbage within grace = %d, %v", removed, err)
+	}
+	if removed, err := archiver.CollectGarbage(ctx, db, 0); err != nil || removed != 1 {
+		t.Errorf("CollectGarbage = %d, %v", removed, err)
+	}
+	if _, err := os.Stat(archiver.blobPath(orphan)); !os.IsNotExist(err) {
+		t.Errorf("orphan still exists: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, strings.TrimPrefix(path, ArchivedImagePath)[:2])); err != nil {
+		t.Errorf("referenced image removed: %v", err)
+	}
+
+	// 删除文章后其图片也会被删除
+	if _, err := db.DeleteArticle(ctx, "wx_1"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := archiver.CollectGarbage(ctx, db, 0); err != nil || removed != 1 {
+		t.Errorf("CollectGarbage after delete = %d, %v", removed, err)
+	}
+}
+
+func TestRecrawlKeepsArchivedImages(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	const img = "https://mmbiz.qpic.cn/mmbiz_png/abc/640?wx_fmt=png"
+	const other = "https://mmbiz.qpic.cn/mmbiz_png/def/640"
+	article := model.Article{ID: "wx_1", Title: "有图片", Topic: "A", URL: "https://mp.weixin.qq.com/s?__biz=MzA=&mid=1&idx=1",
+		Content: `<p>一</p><img data-src="` + img + `"/>`}
+
+	archiver := NewImageArchiver(t.TempDir(), &imageFetcher{images: map[string][]byte{img: testPNG}})
+	content, n, err := archiver.ArchiveContent(ctx, article.Content)
+	if err != nil || n != 1 {
+		t.Fatalf("ArchiveContent = %d, %v", n, err)
+	}
+	article.Content = content
+	if err := db.SaveArticles(ctx, []model.Article{article}); err != nil {
+		t.Fatal(err)
+	}
+	path := archivedPNGRegexp.FindString(content)
+
+	// 重新抓取时图片下载失败，正文仍引用已归档的图片，新增的图片保留原链接
+	article.Content = `<p>一（修订）</p><img data-src="` + img + `"/><img data-src="` + other + `"/>`
+	m := NewJobManager(nil, db, 1)
+	if err := m.saveArticles(ctx, []model.Article{article}); err != nil {
+		t.Fatalf("saveArticles: %v", err)
+	}
+	saved, err := db.GetArticle(ctx, "wx_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<p>一（修订）</p>`, `src="` + path + `"`, `data-original-src="` + strings.ReplaceAll(img, "&", "&amp;") + `"`,
+		`<img data-src="` + other + `"/>`} {
+		if !strings.Contains(saved.Content, want) {
+			t.Errorf("content missing %s: %s", want, saved.Content)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/model"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var (
+	// 文章页面脚本中的发布时间，例如 var ct = "1700000000";
+	publishTimeRegexp = regexp.MustCompile(`var\s+ct\s*=\s*"(\d+)"`)
+	// 文章页面脚本中的公众号名称，例如 var nickname = htmlDecode("xxx");
+	nicknameRegexp = regexp.MustCompile(`var\s+nickname\s*=\s*(?:htmlDecode\()?"([^"]*)"`)
+)
+
+// ArticlePage 文章页面中解析出的内容
+type ArticlePage struct {
+	Content     string
+	Author      string
+	Account     string
+	PublishTime time.Time
+}
+
+// FetchContent 下载文章页面，填充正文、作者、公众号名称和发布时间。设置了 ImageArchiver 时同时归档正文中的图片
+func (c *Crawler) FetchContent(ctx context.Context, article *model.Article) error {
+	pageURL, err := c.endpoint(article.URL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 MicroMessenger/7.0.20.1781(0x6700143B) NetType/WIFI MiniProgramEnv/Windows WindowsWechat/WMPF WindowsWechat(0x6309092b) XWEB/9053")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9,en;q=0.8")
+	req.Header.Set("Referer", "https://mp.weixin.qq.com/")
+
+	resp, err := c.fetcher.Do(req)
+	if err != nil {
+		return fmt.Errorf("请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("服务器返回错误状态码: %d", resp.StatusCode)
+	}
+
+	// 请求经 Policy 重试、Egress 客户端发出，gzip 已由其 http.Transport 自动解压
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("读取响应失败: %v", err)
+	}
+
+	page, err := ParseArticlePage(body)
+	if err != nil {
+		return err
+	}
+
+	article.Content = page.Content
+	if c.archiver != nil {
+		// 图片归档失败时保留原链接，不影响正文保存
+		content, _, err := c.archiver.ArchiveContent(ctx, page.Content)
+		if err != nil {
+			slog.WarnContext(ctx, "归档文章图片失败", "article_id", article.ID, "error", err)
+		}
+		article.Content = content
+	}
+	if page.Author != "" {
+		article.Author = page.Author
+	}
+	if page.Account != "" {
+		article.Account = page.Account
+	}
+	if !page.PublishTime.IsZero() {
+		article.PublishTime = page.PublishTime
+	}
+	return nil
+}
+
+// FetchContents 依次抓取文章正文，单篇失败不影响其他文章，返回成功抓取的数量
+func (c *Crawler) FetchContents(ctx context.Context, articles []model.Article) int {
+	fetched := 0
+	for i := range articles {
+		// 任务取消或服务关闭时停止，已下载的正文保留
+		if ctx.Err() != nil {
+			break
+		}
+		if articles[i].URL == "" || articles[i].Content != "" {
+			continue
+		}
+
+		if err := c.FetchContent(ctx, &articles[i]); err != nil {
+			slog.WarnContext(ctx, "获取文章正文失败", "article_id", articles[i].ID, "url", articles[i].URL, "error", err)
+		} else {
+			fetched++
+		}
+	}
+	return fetched
+}
+
+// ParseArticlePage 从文章页面 HTML 中提取 #js_content 正文和元信息
+func ParseArticlePage(body []byte) (*ArticlePage, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("解析HTML失败: %v", err)
+	}
+
+	contentSel := doc.Find("#js_content")
+	if contentSel.Length() == 0 {
+		// 文章被删除或触发了验证页面
+		return nil, fmt.Errorf("未找到文章正文")
+	}
+
+	// 只保存 #js_content 内部的 HTML，容器上默认隐藏正文的 visibility 样式不会带上
+	content, err := contentSel.Html()
+	if err != nil {
+		return nil, fmt.Errorf("提取正文失败: %v", err)
+	}
+
+	page := &ArticlePage{
+		Content: strings.TrimSpace(content),
+	}
+
+	// 作者
+	page.Author = strings.TrimSpace(doc.Find("meta[name='author']").AttrOr("content", ""))
+	if page.Author == "" {
+		page.Author = strings.TrimSpace(doc.Find("#js_author_name").Text())
+	}
+
+	// 公众号名称
+	page.Account = strings.TrimSpace(doc.Find("#js_name").Text())
+	if page.Account == "" {
+		if matches := nicknameRegexp.FindSubmatch(body); len(matches) > 1 {
+			page.Account = strings.TrimSpace(string(matches[1]))
+		}
+	}
+
+	// 发布时间
+	if matches := publishTimeRegexp.FindSubmatch(body); len(matches) > 1 {
+		if ts, err := strconv.ParseInt(string(matches[1]), 10, 64); err == nil && ts > 0 {
+			page.PublishTime = time.Unix(ts, 0)
+		}
+	}
+
+	return page, nil
+}
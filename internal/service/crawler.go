@@ -7,37 +7,164 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"wechat-reader/internal/logging"
 	"wechat-reader/internal/model"
+	"wechat-reader/internal/wxurl"
 
 	"github.com/PuerkitoBio/goquery"
 )
 
+// DefaultBaseURL 微信公众平台接口地址
+const DefaultBaseURL = "https://mp.weixin.qq.com"
+
+// Fetcher 发送 HTTP 请求，*http.Client 实现了该接口，测试中可以替换为本地数据
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
 type Crawler struct {
-	client *http.Client
+	fetcher  Fetcher
+	baseURL  string
+	archiver *ImageArchiver
+}
+
+// CrawlerOption 配置 Crawler
+type CrawlerOption func(c *Crawler)
+
+// WithFetcher 替换发送请求的 Fetcher。限速和重试由 Policy 负责，
+// 替换后如需保留应传入 Policy
+func WithFetcher(fetcher Fetcher) CrawlerOption {
+	return func(c *Crawler) {
+		c.fetcher = fetcher
+	}
+}
+
+// WithBaseURL 替换请求公众平台时使用的地址，默认为 DefaultBaseURL。
+// 专辑页面、分页接口和文章正文的请求都发往 baseURL，路径和参数不变
+func WithBaseURL(baseURL string) CrawlerOption {
+	return func(c *Crawler) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithImageArchiver 抓取正文时把其中的图片归档到本地
+func WithImageArchiver(archiver *ImageArchiver) CrawlerOption {
+	return func(c *Crawler) {
+		c.archiver = archiver
+	}
 }
 
-func NewCrawler() *Crawler {
-	return &Crawler{
-		client: &http.Client{
+// endpoint 把公众号链接的协议和域名换成 baseURL，路径和参数不变
+func (c *Crawler) endpoint(rawURL string) (string, error) {
+	if c.baseURL == DefaultBaseURL {
+		return rawURL, nil
+	}
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return "", fmt.Errorf("无效的接口地址: %v", err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme, u.Host = base.Scheme, base.Host
+	u.Path = base.Path + u.Path
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+func NewCrawler(opts ...CrawlerOption) *Crawler {
+	c := &Crawler{
+		fetcher: NewPolicy(&http.Client{
 			Timeout: time.Second * 10,
-		},
+		}, DefaultPolicyConfig()),
+		baseURL: DefaultBaseURL,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Cursor 专辑分页位置，下一页从这篇文章之后开始
+type Cursor struct {
+	Msgid   string `json:"msgid"`
+	Itemidx int    `json:"itemidx"`
+}
+
+// Progress 抓取进度
+type Progress struct {
+	Pages    int    // 已获取的页数
+	Articles int    // 已解析的文章数
+	Cursor   Cursor // 已获取的最后一页的位置，用于断点续抓
+	End      bool   // 已到达专辑末尾，之后没有更早的文章
+	Err      error  // 不影响整体结果的错误（例如翻页失败）
+}
+
+// ProgressFunc 抓取进度回调
+type ProgressFunc func(p Progress)
+
+func (f ProgressFunc) report(p Progress) {
+	if f != nil {
+		f(p)
 	}
 }
 
+// CrawlOptions 控制一次专辑抓取
+type CrawlOptions struct {
+	// Progress 每获取一页后回调
+	Progress ProgressFunc
+	// Resume 不为空时从该位置之后继续翻页，而不是从专辑第一页之后
+	Resume *Cursor
+	// StopAt 对已抓取到的文章返回 true 时停止翻页，用于增量刷新。
+	// 专辑按发布时间倒序排列，遇到已有文章说明后面的都已保存过
+	StopAt func(article model.Article) bool
+	// Album 解析出专辑页面的专辑和公众号信息后回调，无法确定专辑 ID 或公众号时对应参数为 nil
+	Album func(album *model.Album, account *model.Account)
+}
+
+func (o CrawlOptions) stopAt(article model.Article) bool {
+	return o.StopAt != nil && o.StopAt(article)
+}
+
+var albumIDRegexp = regexp.MustCompile(`album_id=([^&#]+)`)
+
+// ExtractAlbumID 从专辑链接中提取 album_id，不存在时返回空字符串
+func ExtractAlbumID(albumURL string) string {
+	if matches := albumIDRegexp.FindStringSubmatch(albumURL); len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
+
 func (c *Crawler) FetchArticles(ctx context.Context, subscriptionURL string) ([]model.Article, error) {
+	return c.FetchArticlesWithOptions(ctx, subscriptionURL, CrawlOptions{})
+}
+
+// FetchArticlesWithOptions 与 FetchArticles 相同，可以汇报进度、断点续抓或提前停止翻页。
+// ctx 结束时返回已获取的文章和 ctx 的错误
+func (c *Crawler) FetchArticlesWithOptions(ctx context.Context, subscriptionURL string, opts CrawlOptions) ([]model.Article, error) {
+	progress := opts.Progress
 	// 验证URL是否为微信文章链接
-	if !strings.Contains(subscriptionURL, "mp.weixin.qq.com") {
+	if !wxurl.IsWechatURL(subscriptionURL) {
 		return nil, fmt.Errorf("无效的微信文章链接")
 	}
 
+	albumURL, err := c.endpoint(subscriptionURL)
+	if err != nil {
+		return nil, err
+	}
+
 	// 创建带有适当请求头的请求
-	req, err := http.NewRequest("GET", subscriptionURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", albumURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -56,20 +183,17 @@ func (c *Crawler) FetchArticles(ctx context.Context, subscriptionURL string) ([]
 	req.Header.Set("Sec-Fetch-User", "?1")
 	req.Header.Set("Upgrade-Insecure-Requests", "1")
 
-	// 打印请求信息
-	fmt.Printf("发送请求到: %s\n", subscriptionURL)
-	fmt.Printf("请求头: %+v\n", req.Header)
+	ctx = logging.With(ctx, "album_id", ExtractAlbumID(subscriptionURL))
+	slog.DebugContext(ctx, "请求专辑页面", "url", subscriptionURL, "header", req.Header)
 
 	// 发送请求
-	resp, err := c.client.Do(req)
+	resp, err := c.fetcher.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("请求失败: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// 打印响应状态
-	fmt.Printf("响应状态码: %d\n", resp.StatusCode)
-	fmt.Printf("响应头: %+v\n", resp.Header)
+	slog.DebugContext(ctx, "专辑页面响应", "status", resp.StatusCode, "header", resp.Header)
 
 	// 检查响应状态码
 	if resp.StatusCode != http.StatusOK {
@@ -98,7 +222,7 @@ func (c *Crawler) FetchArticles(ctx context.Context, subscriptionURL string) ([]
 		return nil, fmt.Errorf("服务器返回空响应")
 	}
 
-	fmt.Println(string(body))
+	slog.DebugContext(ctx, "专辑页面内容", "body", string(body))
 
 	// 解析HTML内容
 	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
@@ -113,13 +237,19 @@ func (c *Crawler) FetchArticles(ctx context.Context, subscriptionURL string) ([]
 		fullText := strings.TrimSpace(s.Text())
 		// 移除可能的前缀和多余空格
 		topic = strings.TrimSpace(strings.TrimPrefix(fullText, ""))
-		fmt.Printf("提取到的主题文本: %s\n", topic)
+		slog.DebugContext(ctx, "提取到主题", "topic", topic)
 	})
 
 	if topic == "" {
 		topic = "未分类" // 设置默认主题
 	}
 
+	albumID := ExtractAlbumID(subscriptionURL)
+	album, account := parseAlbumInfo(doc, subscriptionURL)
+	if opts.Album != nil && (album != nil || account != nil) {
+		opts.Album(album, account)
+	}
+
 	msgid := ""
 	itemidx := 0
 
@@ -128,11 +258,13 @@ func (c *Crawler) FetchArticles(ctx context.Context, subscriptionURL string) ([]
 	if len(articles) == 0 {
 		// 从文章列表中提取文章信息
 		doc.Find(".album__list.js_album_list .album__list-item.js_album_item.js_wx_tap_highlight.wx_tap_cell").Each(func(i int, s *goquery.Selection) {
-			id := fmt.Sprintf("article_%d_%d", time.Now().Unix(), i)
-
 			// 从 data-link 和 data-title 属性获取文章信息
-			link, exists := s.Attr("data-link")
-			if !exists || !strings.Contains(link, "mp.weixin.qq.com") {
+			rawLink, exists := s.Attr("data-link")
+			if !exists {
+				return
+			}
+			link, err := wxurl.Normalize(rawLink)
+			if err != nil {
 				return
 			}
 
@@ -163,24 +295,30 @@ func (c *Crawler) FetchArticles(ctx context.Context, subscriptionURL string) ([]
 				}
 			}
 
+			link = wxurl.WithMessage(link, msgid, itemidxT)
 			article := model.Article{
-				ID:          id,
+				ID:          wxurl.ArticleID(link),
 				Title:       title,
 				URL:         link,
 				Topic:       topic,
+				AlbumID:     albumID,
+				Biz:         wxurl.Parse(link).Biz,
 				PublishTime: publishTime,
 				CreateTime:  time.Now(),
 			}
 			articles = append(articles, article)
-			fmt.Printf("从文章列表解析到文章: %+v\n", article)
+			slog.DebugContext(ctx, "从文章列表解析到文章", "article_id", article.ID, "title", article.Title, "url", article.URL)
 		})
 
 		// 如果从文章列表中没有找到文章，尝试从其他链接中查找
 		if len(articles) == 0 {
 			doc.Find("a[href*='mp.weixin.qq.com']").Each(func(i int, s *goquery.Selection) {
-				id := fmt.Sprintf("article_%d_%d", time.Now().Unix(), i)
-				link, exists := s.Attr("href")
-				if !exists || strings.Contains(link, "javascript:") {
+				rawLink, exists := s.Attr("href")
+				if !exists || strings.Contains(rawLink, "javascript:") {
+					return
+				}
+				link, err := wxurl.Normalize(rawLink)
+				if err != nil {
 					return
 				}
 
@@ -190,44 +328,125 @@ func (c *Crawler) FetchArticles(ctx context.Context, subscriptionURL string) ([]
 				}
 
 				article := model.Article{
-					ID:          id,
+					ID:          wxurl.ArticleID(link),
 					Title:       title,
 					URL:         link,
 					Topic:       topic,
+					AlbumID:     albumID,
+					Biz:         wxurl.Parse(link).Biz,
 					PublishTime: time.Now(),
 					CreateTime:  time.Now(),
 				}
 				articles = append(articles, article)
-				fmt.Printf("从其他链接解析到文章: %+v\n", article)
+				slog.DebugContext(ctx, "从其他链接解析到文章", "article_id", article.ID, "title", article.Title, "url", article.URL)
 			})
 		}
 	}
 
-	// 在获取完初始文章后，尝试获取更多文章
-	if len(articles) > 0 {
-		// 从 URL 中提取 topic_id
-		topicID := ""
-		if matches := regexp.MustCompile(`album_id=([^&]+)`).FindStringSubmatch(subscriptionURL); len(matches) > 1 {
-			topicID = matches[1]
+	// 增量刷新时，第一页遇到已有文章就不再翻页
+	reachedKnown := false
+	for i, article := range articles {
+		if opts.stopAt(article) {
+			articles = articles[:i]
+			reachedKnown = true
+			break
+		}
+	}
 
+	cursor := Cursor{Msgid: msgid, Itemidx: itemidx}
+	if opts.Resume != nil && opts.Resume.Msgid != "" {
+		cursor = *opts.Resume
+	}
+	last := Progress{Pages: 1, Articles: len(articles), Cursor: cursor}
+	progress.report(last)
+
+	// 在获取完初始文章后，尝试获取更多文章
+	if len(articles) > 0 && !reachedKnown {
+		if albumID != "" {
 			// 获取更多文章
-			moreArticles, err := c.fetchMoreArticles(ctx, topicID, topic, msgid, itemidx)
+			found := len(articles)
+			moreOpts := opts
+			moreOpts.Progress = func(p Progress) {
+				last = Progress{Pages: 1 + p.Pages, Articles: found + p.Articles, Cursor: p.Cursor, End: p.End}
+				progress.report(last)
+			}
+			moreArticles, err := c.fetchMoreArticles(ctx, albumID, topic, cursor.Msgid, cursor.Itemidx, moreOpts)
+			// 出错时保留已经获取到的部分
+			articles = append(articles, moreArticles...)
 			if err != nil {
-				fmt.Printf("获取更多文章时出错: %v\n", err)
-			} else {
-				articles = append(articles, moreArticles...)
+				if ctx.Err() != nil {
+					return articles, ctx.Err()
+				}
+				slog.WarnContext(ctx, "获取更多文章时出错", "error", err)
+				last.Err = fmt.Errorf("获取更多文章时出错: %v", err)
+				progress.report(last)
 			}
 		}
 	}
 
-	// 打印最终结果
-	fmt.Printf("总共解析到 %d 篇文章\n", len(articles))
-	for i, article := range articles {
-		fmt.Printf("文章 %d: %+v\n", i+1, article)
-	}
+	slog.InfoContext(ctx, "专辑抓取完成", "articles", len(articles), "pages", last.Pages)
 	return articles, nil
 }
 
+var albumCountRegexp = regexp.MustCompile(`\d+`)
+
+// parseAlbumInfo 从专辑页面提取专辑和公众号信息。
+// 公众号标识优先取专辑链接中的 __biz，没有时取第一篇文章链接中的
+func parseAlbumInfo(doc *goquery.Document, albumURL string) (*model.Album, *model.Account) {
+	text := func(selectors ...string) string {
+		for _, sel := range selectors {
+			if v := strings.TrimSpace(doc.Find(sel).First().Text()); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	attr := func(name string, selectors ...string) string {
+		for _, sel := range selectors {
+			if v, ok := doc.Find(sel).First().Attr(name); ok && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v)
+			}
+		}
+		return ""
+	}
+
+	biz := wxurl.Parse(albumURL).Biz
+	if biz == "" {
+		biz = wxurl.Parse(attr("data-link", ".js_album_item[data-link]")).Biz
+	}
+	now := time.Now()
+
+	var account *model.Account
+	if biz != "" {
+		account = &model.Account{
+			Biz:        biz,
+			Name:       text(".album__author-name", "#js_name"),
+			Avatar:     attr("src", ".album__author-avatar img", "img.album__author-avatar"),
+			UpdateTime: now,
+		}
+	}
+
+	albumID := ExtractAlbumID(albumURL)
+	if albumID == "" {
+		return nil, account
+	}
+	album := &model.Album{
+		ID:          albumID,
+		Biz:         biz,
+		Title:       text("#js_tag_name"),
+		Description: text(".album__desc", ".album__label-desc"),
+		Cover:       attr("content", "meta[property='og:image']"),
+		UpdateTime:  now,
+	}
+	if album.Title == "" {
+		album.Title = "未分类"
+	}
+	if m := albumCountRegexp.FindString(text(".js_count", ".album__num")); m != "" {
+		album.ArticleCount, _ = strconv.Atoi(m)
+	}
+	return album, account
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -255,7 +474,7 @@ type WeixinArticle struct {
 	Itemidx    string `json:"itemidx"`
 }
 
-func (c *Crawler) fetchMoreArticles(ctx context.Context, topicID string, topic string, msgid string, itemidex int) ([]model.Article, error) {
+func (c *Crawler) fetchMoreArticles(ctx context.Context, topicID string, topic string, msgid string, itemidex int, opts CrawlOptions) ([]model.Article, error) {
 	var allArticles []model.Article
 	processedURLs := make(map[string]bool)
 
@@ -269,9 +488,15 @@ func (c *Crawler) fetchMoreArticles(ctx context.Context, topicID string, topic s
 	}
 	hasMore := true
 	batchSize := 10
+	pages := 0
 
 	for hasMore {
-		url := "https://mp.weixin.qq.com/mp/appmsgalbum"
+		// 每页之前检查一次，Fetcher 不一定会理会 ctx
+		if err := ctx.Err(); err != nil {
+			return allArticles, err
+		}
+
+		url := c.baseURL + "/mp/appmsgalbum"
 		params := map[string]string{
 			"action":   "getalbum",
 			"album_id": topicID,
@@ -294,32 +519,39 @@ func (c *Crawler) fetchMoreArticles(ctx context.Context, topicID string, topic s
 		// 创建请求
 		req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 		if err != nil {
-			return nil, fmt.Errorf("创建请求失败: %v", err)
+			return allArticles, fmt.Errorf("创建请求失败: %v", err)
 		}
 
 		req.Header.Set("Accept", "application/json")
 		req.Header.Set("Referer", fmt.Sprintf("https://mp.weixin.qq.com/mp/appmsgalbum?action=getalbum&album_id=%s", topicID))
 
 		// 发送请求
-		resp, err := c.client.Do(req)
+		resp, err := c.fetcher.Do(req)
 		if err != nil {
-			return nil, fmt.Errorf("请求失败: %v", err)
+			return allArticles, fmt.Errorf("请求失败: %w", err)
 		}
-		defer resp.Body.Close()
 
 		// 解析响应
 		var result WeixinResponse
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			return nil, fmt.Errorf("解析响应失败: %v", err)
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return allArticles, fmt.Errorf("解析响应失败: %w", err)
 		}
 
 		if result.BaseResp.Ret != 0 {
-			return nil, fmt.Errorf("API返回错误码: %d", result.BaseResp.Ret)
+			return allArticles, fmt.Errorf("API返回错误码: %d", result.BaseResp.Ret)
 		}
 
 		newArticlesCount := 0
+		reachedKnown := false
 		for _, wxArticle := range result.GetalbumResp.ArticleList {
-			if !processedURLs[wxArticle.URL] {
+			link, err := wxurl.Normalize(wxArticle.URL)
+			if err != nil {
+				continue
+			}
+			link = wxurl.WithMessage(link, wxArticle.Msgid, wxArticle.Itemidx)
+			if !processedURLs[link] {
 				// 将字符串类型的创建时间转换为int64
 				createTimeInt, err := strconv.ParseInt(wxArticle.CreateTime, 10, 64)
 				if err != nil {
@@ -328,31 +560,35 @@ func (c *Crawler) fetchMoreArticles(ctx context.Context, topicID string, topic s
 				}
 
 				article := model.Article{
-					ID:          fmt.Sprintf("article_%d_%d", time.Now().Unix(), len(allArticles)),
+					ID:          wxurl.ArticleID(link),
 					Title:       wxArticle.Title,
-					URL:         wxArticle.URL,
+					URL:         link,
 					Topic:       topic,
+					AlbumID:     topicID,
+					Biz:         wxurl.Parse(link).Biz,
 					PublishTime: time.Unix(createTimeInt, 0),
 					CreateTime:  time.Now(),
 				}
+				if opts.stopAt(article) {
+					reachedKnown = true
+					break
+				}
 				allArticles = append(allArticles, article)
-				processedURLs[wxArticle.URL] = true
+				processedURLs[link] = true
 				newArticlesCount++
 			}
 		}
 
-		if newArticlesCount == 0 || len(result.GetalbumResp.ArticleList) == 0 {
-			break
-		}
-
 		// 更新下一次请求的参数
-		lastArticle := result.GetalbumResp.ArticleList[len(result.GetalbumResp.ArticleList)-1]
-		nextMsgid = lastArticle.Msgid
-		itemidx, err := strconv.Atoi(lastArticle.Itemidx)
-		if err != nil {
-			nextItemidx = 0
-		} else {
-			nextItemidx = itemidx
+		if len(result.GetalbumResp.ArticleList) > 0 {
+			lastArticle := result.GetalbumResp.ArticleList[len(result.GetalbumResp.ArticleList)-1]
+			nextMsgid = lastArticle.Msgid
+			itemidx, err := strconv.Atoi(lastArticle.Itemidx)
+			if err != nil {
+				nextItemidx = 0
+			} else {
+				nextItemidx = itemidx
+			}
 		}
 
 		cf, err := strconv.ParseInt(result.GetalbumResp.ContinueFlag, 10, 64)
@@ -362,8 +598,24 @@ func (c *Crawler) fetchMoreArticles(ctx context.Context, topicID string, topic s
 			hasMore = false
 		}
 
-		// 添加延时避免被封
-		time.Sleep(2 * time.Second)
+		pages++
+		slog.DebugContext(ctx, "获取到专辑分页",
+			"page", pages,
+			"articles", len(result.GetalbumResp.ArticleList),
+			"continue_flag", result.GetalbumResp.ContinueFlag,
+			"msgid", nextMsgid,
+			"itemidx", nextItemidx,
+		)
+		opts.Progress.report(Progress{
+			Pages:    pages,
+			Articles: len(allArticles),
+			Cursor:   Cursor{Msgid: nextMsgid, Itemidx: nextItemidx},
+			End:      !hasMore || len(result.GetalbumResp.ArticleList) == 0,
+		})
+
+		if reachedKnown || newArticlesCount == 0 || len(result.GetalbumResp.ArticleList) == 0 {
+			break
+		}
 	}
 
 	return allArticles, nil
@@ -0,0 +1,420 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/wxurl"
+)
+
+const testAlbumURL = "https://mp.weixin.qq.com/mp/appmsgalbum?__biz=MzAxNDUzMzkyMg==&action=getalbum&album_id=3753566456137924612&scene=173#wechat_redirect"
+
+// fixtureFetcher 用 testdata 中录制的响应代替真实请求：
+// 专辑页面返回 album，分页接口按顺序返回 pages
+type fixtureFetcher struct {
+	t         *testing.T
+	album     string
+	gzipAlbum bool
+	pages     []string
+	requests  []*http.Request
+}
+
+func (f *fixtureFetcher) Do(req *http.Request) (*http.Response, error) {
+	f.requests = append(f.requests, req)
+
+	if req.URL.Query().Get("f") != "json" {
+		body := readFixture(f.t, f.album)
+		header := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+		if f.gzipAlbum {
+			body = gzipBytes(f.t, body)
+			header.Set("Content-Encoding", "gzip")
+		}
+		return fixtureResponse(req, header, body), nil
+	}
+
+	pageRequests := 0
+	for _, r := range f.requests {
+		if r.URL.Query().Get("f") == "json" {
+			pageRequests++
+		}
+	}
+	if pageRequests > len(f.pages) {
+		return nil, errors.New("unexpected page request: " + req.URL.String())
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	return fixtureResponse(req, header, readFixture(f.t, f.pages[pageRequests-1])), nil
+}
+
+// pageRequests 返回发往分页接口的请求
+func (f *fixtureFetcher) pageRequests() []*http.Request {
+	var reqs []*http.Request
+	for _, r := range f.requests {
+		if r.URL.Query().Get("f") == "json" {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+func fixtureResponse(req *http.Request, header http.Header, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture %s: %v", name, err)
+	}
+	return data
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newFixtureCrawler(f *fixtureFetcher) *Crawler {
+	return NewCrawler(WithFetcher(f))
+}
+
+func TestFetchArticlesPaginates(t *testing.T) {
+	f := &fixtureFetcher{
+		t:     t,
+		album: "album.html",
+		pages: []string{"album_page_1.json", "album_page_2.json"},
+	}
+
+	var pages, found int
+	var end bool
+	articles, err := newFixtureCrawler(f).FetchArticlesWithOptions(context.Background(), testAlbumURL, CrawlOptions{
+		Progress: func(p Progress) {
+			if p.Err != nil {
+				t.Errorf("unexpected progress error: %v", p.Err)
+			}
+			if end {
+				t.Errorf("progress reported after reaching the end of the album")
+			}
+			pages, found, end = p.Pages, p.Articles, p.End
+		},
+	})
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+
+	wantTitles := []string{
+		"特斯拉命运的齿轮始于2006｜Golden Idea",
+		"德州仪器：始于1930，6个金点子塑造的万亿灯塔公司",
+		"硅谷教父Paul Graham眼中的创业金点子｜Golden Idea",
+		"英伟达：从显卡到AI的三十年",
+		"最早的一篇",
+	}
+	if len(articles) != len(wantTitles) {
+		t.Fatalf("got %d articles, want %d", len(articles), len(wantTitles))
+	}
+	for i, article := range articles {
+		if article.Title != wantTitles[i] {
+			t.Errorf("article %d title = %q, want %q", i, article.Title, wantTitles[i])
+		}
+		if article.Topic != "AmazingFounder" {
+			t.Errorf("article %d topic = %q, want AmazingFounder", i, article.Topic)
+		}
+		if strings.Contains(article.URL, "chksm") || !strings.HasPrefix(article.URL, "https://") {
+			t.Errorf("article %d url not normalized: %s", i, article.URL)
+		}
+		if article.ID != wxurl.ArticleID(article.URL) {
+			t.Errorf("article %d id = %s, want id derived from url", i, article.ID)
+		}
+	}
+
+	if got := articles[4].PublishTime.Unix(); got != 1734660000 {
+		t.Errorf("publish time from create_time = %d, want 1734660000", got)
+	}
+	if pages != 3 || found != 5 || !end {
+		t.Errorf("progress = %d pages / %d articles / end %v, want 3 / 5 / true", pages, found, end)
+	}
+
+	// 每一页都从上一页最后一篇文章继续
+	reqs := f.pageRequests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d page requests, want 2", len(reqs))
+	}
+	wantCursors := [][2]string{{"2247488648", "1"}, {"2247488554", "1"}}
+	for i, req := range reqs {
+		q := req.URL.Query()
+		if q.Get("album_id") != "3753566456137924612" {
+			t.Errorf("page %d album_id = %q", i, q.Get("album_id"))
+		}
+		if q.Get("begin_msgid") != wantCursors[i][0] || q.Get("begin_itemidx") != wantCursors[i][1] {
+			t.Errorf("page %d cursor = %s/%s, want %s/%s", i,
+				q.Get("begin_msgid"), q.Get("begin_itemidx"), wantCursors[i][0], wantCursors[i][1])
+		}
+	}
+}
+
+func TestFetchArticlesParsesAlbumInfo(t *testing.T) {
+	f := &fixtureFetcher{t: t, album: "album.html", pages: []string{"album_page_2.json"}}
+
+	var album *model.Album
+	var account *model.Account
+	articles, err := newFixtureCrawler(f).FetchArticlesWithOptions(context.Background(), testAlbumURL, CrawlOptions{
+		Album: func(al *model.Album, acc *model.Account) {
+			album, account = al, acc
+		},
+	})
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+
+	if album == nil || account == nil {
+		t.Fatalf("album callback = %v, %v", album, account)
+	}
+	if album.ID != "3753566456137924612" || album.Biz != "MzAxNDUzMzkyMg==" || album.Title != "AmazingFounder" ||
+		album.Description != "创业者的金点子" || album.ArticleCount != 5 ||
+		album.Cover != "https://mmbiz.qpic.cn/mmbiz_jpg/album_cover/0?wx_fmt=jpeg" {
+		t.Errorf("album = %+v", album)
+	}
+	if account.Biz != "MzAxNDUzMzkyMg==" || account.Name != "金沙江创投" || account.Avatar != "https://wx.qlogo.cn/mmhead/avatar/0" {
+		t.Errorf("account = %+v", account)
+	}
+	for i, article := range articles {
+		if article.AlbumID != album.ID || article.Biz != account.Biz {
+			t.Errorf("article %d album/biz = %q/%q", i, article.AlbumID, article.Biz)
+		}
+	}
+}
+
+func TestFetchArticlesStopsOnContinueFlag(t *testing.T) {
+	f := &fixtureFetcher{
+		t:     t,
+		album: "album.html",
+		// 第二页 continue_flag 为 0，不应再请求第三页
+		pages: []string{"album_page_2.json"},
+	}
+
+	articles, err := newFixtureCrawler(f).FetchArticles(context.Background(), testAlbumURL)
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+	if len(articles) != 3 {
+		t.Errorf("got %d articles, want 3", len(articles))
+	}
+	if n := len(f.pageRequests()); n != 1 {
+		t.Errorf("got %d page requests, want 1", n)
+	}
+}
+
+func TestFetchArticlesGzipAlbum(t *testing.T) {
+	f := &fixtureFetcher{
+		t:         t,
+		album:     "album.html",
+		gzipAlbum: true,
+		pages:     []string{"album_page_2.json"},
+	}
+
+	articles, err := newFixtureCrawler(f).FetchArticles(context.Background(), testAlbumURL)
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+	if len(articles) != 3 || articles[0].Topic != "AmazingFounder" {
+		t.Errorf("gzip album not decoded: %d articles, topic %q", len(articles), articles[0].Topic)
+	}
+}
+
+func TestFetchArticlesKeepsFirstPageOnRetError(t *testing.T) {
+	f := &fixtureFetcher{
+		t:     t,
+		album: "album.html",
+		pages: []string{"album_ret_error.json"},
+	}
+
+	var progressErr error
+	articles, err := newFixtureCrawler(f).FetchArticlesWithOptions(context.Background(), testAlbumURL, CrawlOptions{
+		Progress: func(p Progress) {
+			if p.Err != nil {
+				progressErr = p.Err
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+	if len(articles) != 2 {
+		t.Errorf("got %d articles, want the 2 from the album page", len(articles))
+	}
+	if progressErr == nil || !strings.Contains(progressErr.Error(), "200013") {
+		t.Errorf("progress error = %v, want ret 200013", progressErr)
+	}
+}
+
+func TestFetchArticlesStopAtKnownArticle(t *testing.T) {
+	f := &fixtureFetcher{
+		t:     t,
+		album: "album.html",
+		pages: []string{"album_page_1.json", "album_page_2.json"},
+	}
+
+	known := wxurl.ArticleID("https://mp.weixin.qq.com/s?__biz=MzAxNDUzMzkyMg==&mid=2247488554&idx=1")
+	articles, err := newFixtureCrawler(f).FetchArticlesWithOptions(context.Background(), testAlbumURL, CrawlOptions{
+		StopAt: func(article model.Article) bool {
+			return article.ID == known
+		},
+	})
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+	if len(articles) != 3 {
+		t.Errorf("got %d articles, want 3 before the known one", len(articles))
+	}
+	if n := len(f.pageRequests()); n != 1 {
+		t.Errorf("got %d page requests, want 1", n)
+	}
+}
+
+func TestFetchArticlesResumesFromCursor(t *testing.T) {
+	f := &fixtureFetcher{
+		t:     t,
+		album: "album.html",
+		pages: []string{"album_page_2.json"},
+	}
+
+	articles, err := newFixtureCrawler(f).FetchArticlesWithOptions(context.Background(), testAlbumURL, CrawlOptions{
+		Resume: &Cursor{Msgid: "2247488554", Itemidx: 1},
+	})
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+	if len(articles) != 3 {
+		t.Errorf("got %d articles, want 3", len(articles))
+	}
+
+	q := f.pageRequests()[0].URL.Query()
+	if q.Get("begin_msgid") != "2247488554" || q.Get("begin_itemidx") != "1" {
+		t.Errorf("resumed from %s/%s, want 2247488554/1", q.Get("begin_msgid"), q.Get("begin_itemidx"))
+	}
+}
+
+func TestFetchArticlesCancelledKeepsPartialResults(t *testing.T) {
+	f := &fixtureFetcher{
+		t:     t,
+		album: "album.html",
+		pages: []string{"album_page_1.json", "album_page_2.json"},
+	}
+
+	// 第一页分页数据返回后取消，第二次翻页前应当停止
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var cursor Cursor
+	articles, err := newFixtureCrawler(f).FetchArticlesWithOptions(ctx, testAlbumURL, CrawlOptions{
+		Progress: func(p Progress) {
+			cursor = p.Cursor
+			if p.Pages == 2 {
+				cancel()
+			}
+		},
+	})
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if len(articles) != 4 {
+		t.Errorf("got %d articles, want the 4 fetched before cancelling", len(articles))
+	}
+	if cursor != (Cursor{Msgid: "2247488554", Itemidx: 1}) {
+		t.Errorf("cursor = %+v, want last article of the first page", cursor)
+	}
+}
+
+func TestFetchArticlesRejectsOtherHosts(t *testing.T) {
+	f := &fixtureFetcher{t: t, album: "album.html"}
+
+	_, err := newFixtureCrawler(f).FetchArticles(context.Background(), "https://example.com/mp/appmsgalbum?album_id=1")
+	if err == nil {
+		t.Fatal("expected error for non-WeChat URL")
+	}
+	if len(f.requests) != 0 {
+		t.Errorf("made %d requests for a rejected URL", len(f.requests))
+	}
+}
+
+func TestFetchArticlesUsesBaseURL(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch {
+		case r.URL.Query().Get("f") == "json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(readFixture(t, "album_page_2.json"))
+		case r.URL.Path == "/wx/mp/appmsgalbum":
+			w.Write(readFixture(t, "album.html"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// 专辑页面、分页接口和正文都发往 baseURL
+	c := NewCrawler(WithFetcher(server.Client()), WithBaseURL(server.URL+"/wx"))
+	articles, err := c.FetchArticles(context.Background(), testAlbumURL)
+	if err != nil {
+		t.Fatalf("FetchArticles: %v", err)
+	}
+	if len(articles) == 0 || articles[0].Topic != "AmazingFounder" {
+		t.Fatalf("got %+v", articles)
+	}
+	// 保存的链接仍是公众号的地址
+	if !strings.HasPrefix(articles[0].URL, "https://"+wxurl.Host+"/") {
+		t.Errorf("article URL = %s", articles[0].URL)
+	}
+	// 测试服务没有正文页面，只检查请求地址
+	_ = c.FetchContent(context.Background(), &articles[0])
+
+	want := []string{"/wx/mp/appmsgalbum", "/wx/mp/appmsgalbum", "/wx/s"}
+	if got := strings.Join(paths, ","); got != strings.Join(want, ",") {
+		t.Errorf("request paths = %s, want %s", got, strings.Join(want, ","))
+	}
+}
+
+func TestFetchMoreArticlesUsesBaseURL(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(readFixture(t, "album_page_2.json"))
+	}))
+	defer server.Close()
+
+	c := NewCrawler(WithFetcher(server.Client()), WithBaseURL(server.URL+"/"))
+	articles, err := c.fetchMoreArticles(context.Background(), "3753566456137924612", "AmazingFounder", "2247488554", 1, CrawlOptions{})
+	if err != nil {
+		t.Fatalf("fetchMoreArticles: %v", err)
+	}
+	if gotPath != "/mp/appmsgalbum" {
+		t.Errorf("request path = %q, want /mp/appmsgalbum", gotPath)
+	}
+	if len(articles) != 1 || articles[0].Topic != "AmazingFounder" {
+		t.Errorf("got %+v", articles)
+	}
+}
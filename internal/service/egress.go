@@ -0,0 +1,256 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrEgressDenied 请求的地址不在允许的域名中，或者解析到了内网地址
+	ErrEgressDenied = errors.New("不允许访问该地址")
+	// ErrResponseTooLarge 响应超过大小上限
+	ErrResponseTooLarge = errors.New("响应过大")
+	// ErrReadTimeout 读取响应体时上游长时间没有发送数据
+	ErrReadTimeout = errors.New("读取响应超时")
+)
+
+// 不允许访问的地址段：本机、内网、链路本地（包括云服务器的元数据地址）、组播和保留地址，以及内嵌 IPv4 地址的 NAT64 和 6to4 地址段
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/3"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// EgressConfig 出站请求允许访问的范围
+type EgressConfig struct {
+	// AllowedHosts 允许访问的域名。以 . 开头时匹配该域名的所有子域名，例如 .qpic.cn；
+	// 带端口时只匹配该端口，例如 127.0.0.1:8081
+	AllowedHosts []string
+	// AllowPrivate 允许连接内网和本机地址，只用于测试或访问内网部署的镜像
+	AllowPrivate bool
+	// MaxResponseBytes 响应体的大小上限
+	MaxResponseBytes int64
+	// ResponseHeaderTimeout 发送请求后等待响应头的时间
+	ResponseHeaderTimeout time.Duration
+	// IdleTimeout 读取响应体时等待上游数据的时间。只限制上游没有数据的时间，
+	// 不限制整个响应的读取时间，视频等大文件可以持续传输
+	IdleTimeout time.Duration
+}
+
+// DefaultEgressConfig 只允许访问公众号页面、接口和图片的域名
+func DefaultEgressConfig() EgressConfig {
+	return EgressConfig{
+		AllowedHosts: []string{
+			"mp.weixin.qq.com",
+			"res.wx.qq.com",
+			".qpic.cn",
+			".qlogo.cn",
+		},
+		MaxResponseBytes:      32 << 20,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleTimeout:           30 * time.Second,
+	}
+}
+
+// Egress 检查出站请求的地址后发送请求，实现了 Fetcher。
+// 域名不在允许的范围内时直接拒绝；连接时检查解析出的 IP，域名解析到内网地址（包括 DNS 重绑定）时拒绝；
+// 重定向的目标同样检查。响应体超过大小上限时读取返回 ErrResponseTooLarge
+type Egress struct {
+	config EgressConfig
+	client *http.Client
+}
+
+// NewEgress 按 config 创建出站请求的客户端。不使用 HTTP_PROXY 等代理设置，代理地址通常在内网
+func NewEgress(config EgressConfig) *Egress {
+	e := &Egress{config: config}
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   e.checkDial,
+	}
+	e.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("重定向次数过多")
+			}
+			return e.CheckURL(req.URL)
+		},
+	}
+	return e
+}
+
+// CheckURL 检查地址的协议、域名和端口是否允许访问。
+// 允许的域名没有写端口时只能访问 http 和 https 的默认端口
+func (e *Egress) CheckURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: 不支持的协议 %q", ErrEgressDenied, u.Scheme)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	for _, allowed := range e.config.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if strings.Contains(allowed, ":") {
+			if net.JoinHostPort(host, port) == allowed {
+				return nil
+			}
+			continue
+		}
+		if port != "" && port != "80" && port != "443" {
+			continue
+		}
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s 不在允许的范围内", ErrEgressDenied, u.Host)
+}
+
+// Do 检查地址后发送请求
+func (e *Egress) Do(req *http.Request) (*http.Response, error) {
+	if err := e.CheckURL(req.URL); err != nil {
+		return nil, err
+	}
+	var cancel context.CancelCauseFunc
+	if e.config.IdleTimeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithCancelCause(req.Context())
+		req = req.WithContext(ctx)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		if cancel != nil {
+			cancel(nil)
+		}
+		return nil, err
+	}
+	if cancel != nil {
+		resp.Body = newIdleBody(resp.Body, req.Context(), cancel, e.config.IdleTimeout)
+	}
+
+	max := e.config.MaxResponseBytes
+	if max > 0 {
+		if resp.ContentLength > max {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: %d 字节", ErrResponseTooLarge, resp.ContentLength)
+		}
+		resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: max}
+	}
+	return resp, nil
+}
+
+// checkDial 在建立连接前检查解析出的 IP，此时域名已经解析，不受 DNS 重绑定影响
+func (e *Egress) checkDial(network, address string, _ syscall.RawConn) error {
+	if e.config.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: 无效的地址 %s", ErrEgressDenied, host)
+	}
+	if blockedAddr(addr) {
+		return fmt.Errorf("%w: %s 是内网地址", ErrEgressDenied, addr)
+	}
+	return nil
+}
+
+// blockedAddr 判断 IP 是否为不允许访问的地址，IPv4 映射的 IPv6 地址按 IPv4 判断
+func blockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// idleBody 每次读取时等待上游数据超过 timeout 就取消请求，读取返回 ErrReadTimeout。
+// 两次读取之间不计时，下游读得慢时不会中断
+type idleBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	idle   time.Duration
+}
+
+func newIdleBody(body io.ReadCloser, ctx context.Context, cancel context.CancelCauseFunc, idle time.Duration) *idleBody {
+	timer := time.AfterFunc(idle, func() { cancel(ErrReadTimeout) })
+	timer.Stop()
+	return &idleBody{ReadCloser: body, ctx: ctx, cancel: cancel, timer: timer, idle: idle}
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.idle)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && context.Cause(b.ctx) == ErrReadTimeout {
+		err = fmt.Errorf("%w: %v 内没有收到数据", ErrReadTimeout, b.idle)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
+// limitedBody 读取超过 remaining 字节时返回 ErrResponseTooLarge
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// 多读一个字节，用来判断是否超过上限
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressCheckURL(t *testing.T) {
+	e := NewEgress(DefaultEgressConfig())
+	for _, tc := range []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://mp.weixin.qq.com/s?__biz=MzA=", true},
+		{"http://mp.weixin.qq.com/s?__biz=MzA=", true},
+		{"https://mmbiz.qpic.cn/mmbiz_png/abc/640", true},
+		{"https://MMBIZ.QLOGO.CN./mmbiz/abc", true},
+		{"https://mp.weixin.qq.com:443/s", true},
+		{"https://mp.weixin.qq.com:8080/s", false},
+		{"https://qpic.cn.evil.com/a.png", false},
+		{"https://evilqpic.cn/a.png", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://localhost:8080/api/articles", false},
+		{"file:///etc/passwd", false},
+		{"gopher://mp.weixin.qq.com/", false},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.CheckURL(u)
+		if allowed := err == nil; allowed != tc.allowed {
+			t.Errorf("CheckURL(%s) = %v, want allowed %v", tc.url, err, tc.allowed)
+		}
+		if err != nil && !errors.Is(err, ErrEgressDenied) {
+			t.Errorf("CheckURL(%s) error = %v, want ErrEgressDenied", tc.url, err)
+		}
+	}
+}
+
+func TestBlockedAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.20.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.100.100.200", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"2002:c0a8:0101::1", true},
+		{"2002:7f00:0001::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"183.3.226.35", false},
+		{"240e:e9:6002::1", false},
+	} {
+		if got := blockedAddr(netip.MustParseAddr(tc.addr)); got != tc.blocked {
+			t.Errorf("blockedAddr(%s) = %v, want %v", tc.addr, got, tc.blocked)
+		}
+	}
+}
+
+func TestEgressBlocksPrivateAddressAtDial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	// 域名在允许的范围内，但解析到了本机地址
+	u, _ := url.Parse(server.URL)
+	config := DefaultEgressConfig()
+	config.AllowedHosts = []string{"localhost:" + u.Port()}
+	e := NewEgress(config)
+
+	req, _ := http.NewRequest("GET", "http://localhost:"+u.Port()+"/", nil)
+	resp, err := e.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, ErrEgressDenied) {
+		t.Errorf("Do = %v, want ErrEgressDenied", err)
+	}
+}
+
+func TestEgressRevalidatesRedirects(t *testing.T) {
+	var target string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, target, http.StatusFound)
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 100)))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	config := DefaultEgressConfig()
+	config.AllowedHosts = []string{u.Host}
+	config.AllowPrivate = true
+	config.MaxResponseBytes = 10
+	e := NewEgress(config)
+
+	get := func(path string) (string, error) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		resp, err := e.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// 重定向到允许的地址
+	target = server.URL + "/ok"
+	if body, err := get("/redirect"); err != nil || body != "ok" {
+		t.Errorf("redirect to allowed host = %q, %v", body, err)
+	}
+	// 重定向到其他地址
+	target = "http://localhost:" + u.Port() + "/ok"
+	if _, err := get("/redirect"); !errors.Is(err, ErrEgressDenied) {
+		t.Errorf("redirect to other host error = %v, want ErrEgressDenied", err)
+	}
+	// 响应超过大小上限
+	if _, err := get("/large"); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("large response error = %v, want ErrResponseTooLarge", err)
+	}
+}
+
+func TestEgressIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 持续发送的响应总时间超过 IdleTimeout，停止发送的响应在 IdleTimeout 后中断
+		for i := 0; i < 6; i++ {
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+			delay := 50 * time.Millisecond
+			if r.URL.Path == "/stalled" && i == 2 {
+				delay = time.Second
+			}
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	config := DefaultEgressConfig()
+	config.AllowedHosts = []string{u.Host}
+	config.AllowPrivate = true
+	config.IdleTimeout = 200 * time.Millisecond
+	e := NewEgress(config)
+
+	get := func(path string) (string, error) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		resp, err := e.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if body, err := get("/streaming"); err != nil || body != "xxxxxx" {
+		t.Errorf("streaming response = %q, %v", body, err)
+	}
+	if body, err := get("/stalled"); !errors.Is(err, ErrReadTimeout) || body != "xxx" {
+		t.Errorf("stalled response = %q, %v; want ErrReadTimeout after 3 bytes", body, err)
+	}
+}
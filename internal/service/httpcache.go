@@ -0,0 +1,550 @@
+package service
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 代理缓存统计，通过 /debug/vars 查看
+var httpCacheStats = expvar.NewMap("httpcache")
+
+// 缓存文件名为请求地址和 cacheKeyHeaders 的 SHA-256
+var cacheKeyRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// cacheKeyHeaders 计入缓存 key 的请求头。不同的代理接口以不同的客户端身份请求同一个地址，
+// 微信可能返回不同的内容，各自分开缓存
+var cacheKeyHeaders = []string{"User-Agent", "Accept", "Accept-Language", "Referer"}
+
+// HTTPCacheConfig 代理缓存的配置
+type HTTPCacheConfig struct {
+	// Dir 缓存目录
+	Dir string
+	// MaxBytes 缓存的总大小上限，超过时删除最久未使用的响应。单个响应超过上限的 1/8 时不缓存
+	MaxBytes int64
+	// DefaultTTL 按响应的地址返回上游没有 Cache-Control max-age 或 Expires 时的缓存时间，
+	// 为 nil 或返回 0 时不缓存这类响应。重定向后的响应按最终地址计算
+	DefaultTTL func(u *url.URL) time.Duration
+}
+
+// WeChatDefaultTTL 微信响应没有缓存头时的缓存时间：图片缓存 24 小时；文章页面缓存 10 分钟，
+// 重复阅读同一篇文章不再请求微信，文章被修改或删除后也能较快更新；
+// 接口和被重定向到验证页面等其他地址的响应不缓存
+func WeChatDefaultTTL(u *url.URL) time.Duration {
+	switch host := strings.ToLower(u.Hostname()); {
+	case archivedImageHosts[host]:
+		return 24 * time.Hour
+	case host == "mp.weixin.qq.com" && (u.Path == "/s" || strings.HasPrefix(u.Path, "/s/")):
+		return 10 * time.Minute
+	}
+	return 0
+}
+
+// HTTPCache 把 GET 请求的响应缓存在磁盘上，实现了 Fetcher。
+// 按上游的 Cache-Control 和 Expires 判断是否过期，过期后带 ETag 和 Last-Modified 向上游确认，
+// 上游请求失败或返回 5xx 时返回过期的缓存。返回的响应带有 X-Cache 头：HIT、MISS、REVALIDATED 或 STALE
+type HTTPCache struct {
+	fetcher Fetcher
+	config  HTTPCacheConfig
+
+	mu    sync.Mutex
+	lru   *list.List               // 最近使用的在前
+	items map[string]*list.Element // 缓存 key 对应的 lru 元素
+	size  int64
+}
+
+// cacheItem lru 中的一项
+type cacheItem struct {
+	key  string
+	size int64
+}
+
+// cacheEntry 缓存文件的第一行，之后是响应体
+type cacheEntry struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Vary       http.Header `json:"vary"` // 响应 Vary 中列出的请求头的值
+	StoreTime  time.Time   `json:"store_time"`
+	Expires    time.Time   `json:"expires"`
+}
+
+// NewHTTPCache 用 fetcher 发送未命中的请求，加载 config.Dir 中已有的缓存
+func NewHTTPCache(fetcher Fetcher, config HTTPCacheConfig) (*HTTPCache, error) {
+	c := &HTTPCache{
+		fetcher: fetcher,
+		config:  config,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	if err := c.load(); err != nil {
+		return nil, fmt.Errorf("加载缓存目录失败: %v", err)
+	}
+	return c, nil
+}
+
+// Do 发送请求，新鲜的缓存直接返回。只缓存没有 Range 的 GET 请求和状态码 200 的响应
+func (c *HTTPCache) Do(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return c.fetcher.Do(req)
+	}
+
+	key := cacheKey(req)
+	entry, body := c.open(key, req)
+	if entry != nil && time.Now().Before(entry.Expires) {
+		httpCacheStats.Add("hits", 1)
+		c.touch(key)
+		return entry.response(req, body, "HIT"), nil
+	}
+
+	// 过期的缓存带上校验信息，内容未变时上游返回 304
+	upstream := req
+	if entry != nil {
+		etag, lastModified := entry.Header.Get("ETag"), entry.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			upstream = req.Clone(req.Context())
+			if etag != "" {
+				upstream.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				upstream.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	resp, err := c.fetcher.Do(upstream)
+	if entry != nil && (err != nil || resp.StatusCode >= 500) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		httpCacheStats.Add("stale", 1)
+		slog.WarnContext(req.Context(), "请求失败，返回过期的缓存", "url", req.URL.Redacted(), "error", err)
+		return entry.response(req, body, "STALE"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		httpCacheStats.Add("revalidated", 1)
+		// 304 中的头覆盖缓存的头，并重新计算过期时间
+		for k, v := range resp.Header {
+			if k != "Content-Length" && k != "Set-Cookie" {
+				entry.Header[k] = v
+			}
+		}
+		ttl, ok := freshness(entry.Header, c.defaultTTL(req.URL))
+		if !ok {
+			return entry.response(req, body, "REVALIDATED"), nil
+		}
+		entry.StoreTime = time.Now()
+		entry.Expires = entry.StoreTime.Add(ttl)
+
+		// 响应体不变，从原缓存文件复制到写入新头的文件，不读入内存。之后返回新文件，
+		// 写入失败时原文件仍在，返回原文件
+		err := c.store(key, entry, body)
+		body.Close()
+		if err != nil {
+			slog.Warn("写入代理缓存失败", "url", entry.URL, "error", err)
+		}
+		stored, body := c.open(key, req)
+		if stored == nil {
+			return nil, fmt.Errorf("读取代理缓存失败")
+		}
+		return stored.response(req, body, "REVALIDATED"), nil
+	}
+	if entry != nil {
+		body.Close()
+	}
+
+	httpCacheStats.Add("misses", 1)
+	resp.Header.Set("X-Cache", "MISS")
+	return c.storeResponse(key, req, resp), nil
+}
+
+// storeResponse 缓存可以缓存的响应。响应体边读边返回，同时写入临时文件，
+// 读完整个响应体后才写入缓存；超过单个响应上限、读取出错或提前关闭时放弃缓存
+func (c *HTTPCache) storeResponse(key string, req *http.Request, resp *http.Response) *http.Response {
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+	final := req.URL
+	if resp.Request != nil {
+		final = resp.Request.URL
+	}
+	ttl, ok := freshness(resp.Header, c.defaultTTL(final))
+	if !ok || resp.Header.Get("Vary") == "*" {
+		return resp
+	}
+	limit := c.config.MaxBytes / 8
+	if resp.ContentLength > limit {
+		return resp
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Set-Cookie")
+	header.Del("X-Cache")
+	vary := http.Header{}
+	for _, name := range strings.Split(resp.Header.Get("Vary"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+		}
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     header,
+		Vary:       vary,
+		StoreTime:  now,
+		Expires:    now.Add(ttl),
+	}
+	tmp, w, err := c.create(entry)
+	if err != nil {
+		slog.Warn("写入代理缓存失败", "url", entry.URL, "error", err)
+		return resp
+	}
+	resp.Body = &cachingBody{body: resp.Body, cache: c, key: key, entry: entry, tmp: tmp, w: w, limit: limit}
+	return resp
+}
+
+// cachingBody 把读到的响应体同时写入临时文件，读到末尾时写入缓存
+type cachingBody struct {
+	body  io.ReadCloser
+	cache *HTTPCache
+	key   string
+	entry *cacheEntry
+	tmp   *os.File // 放弃或写入缓存后为 nil
+	w     *bufio.Writer
+	n     int64
+	limit int64
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.tmp == nil {
+		return n, err
+	}
+	if n > 0 {
+		b.n += int64(n)
+		if b.n > b.limit {
+			b.abort()
+			return n, err
+		}
+		if _, werr := b.w.Write(p[:n]); werr != nil {
+			slog.Warn("写入代理缓存失败", "url", b.entry.URL, "error", werr)
+			b.abort()
+			return n, err
+		}
+	}
+	switch {
+	case err == io.EOF:
+		tmp := b.tmp
+		b.tmp = nil
+		if cerr := b.cache.commit(b.key, tmp, b.w); cerr != nil {
+			slog.Warn("写入代理缓存失败", "url", b.entry.URL, "error", cerr)
+		} else {
+			b.cache.stored(b.key)
+		}
+	case err != nil:
+		b.abort()
+	}
+	return n, err
+}
+
+// Close 没有读完响应体时放弃缓存
+func (b *cachingBody) Close() error {
+	if b.tmp != nil {
+		b.abort()
+	}
+	return b.body.Close()
+}
+
+func (b *cachingBody) abort() {
+	b.tmp.Close()
+	os.Remove(b.tmp.Name())
+	b.tmp = nil
+}
+
+// defaultTTL 地址为 u 的响应没有缓存头时的缓存时间，返回 0 时不缓存
+func (c *HTTPCache) defaultTTL(u *url.URL) time.Duration {
+	if c.config.DefaultTTL == nil {
+		return 0
+	}
+	return c.config.DefaultTTL(u)
+}
+
+// open 打开缓存文件，不存在、无法读取或 Vary 不匹配时返回 nil
+func (c *HTTPCache) open(key string, req *http.Request) (*cacheEntry, io.ReadCloser) {
+	c.mu.Lock()
+	_, ok := c.items[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, nil
+	}
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	var entry cacheEntry
+	if err != nil || json.Unmarshal(line, &entry) != nil || entry.URL != req.URL.String() {
+		f.Close()
+		return nil, nil
+	}
+	for name, values := range entry.Vary {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			f.Close()
+			return nil, nil
+		}
+	}
+	return &entry, struct {
+		io.Reader
+		io.Closer
+	}{r, f}
+}
+
+// store 把 body 写入缓存文件，超过总大小上限时删除最久未使用的响应
+func (c *HTTPCache) store(key string, entry *cacheEntry, body io.Reader) error {
+	tmp, w, err := c.create(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := c.commit(key, tmp, w); err != nil {
+		return err
+	}
+	c.stored(key)
+	return nil
+}
+
+// stored 记录写入的缓存文件，超过总大小上限时删除最久未使用的响应
+func (c *HTTPCache) stored(key string) {
+	httpCacheStats.Add("stores", 1)
+
+	info, err := os.Stat(c.path(key))
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(key, info.Size())
+	c.evict()
+}
+
+// create 创建临时文件并写入缓存文件的第一行，之后写入响应体，由 commit 改名为缓存文件
+func (c *HTTPCache) create(entry *cacheEntry) (*os.File, *bufio.Writer, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp, err := os.CreateTemp(c.config.Dir, ".tmp-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	w.Write(line)
+	w.WriteByte('\n')
+	return tmp, w, nil
+}
+
+// commit 把写完的临时文件改名为 key 的缓存文件，失败时删除临时文件
+func (c *HTTPCache) commit(key string, tmp *os.File, w *bufio.Writer) error {
+	defer os.Remove(tmp.Name())
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// touch 把缓存标记为最近使用。文件的修改时间同时更新，重启后按修改时间恢复使用顺序
+func (c *HTTPCache) touch(key string) {
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+}
+
+// add 记录新写入的缓存，调用时持有 c.mu
+func (c *HTTPCache) add(key string, size int64) {
+	if e, ok := c.items[key]; ok {
+		item := e.Value.(*cacheItem)
+		c.size += size - item.size
+		httpCacheStats.Add("bytes", size-item.size)
+		item.size = size
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&cacheItem{key: key, size: size})
+	c.size += size
+	httpCacheStats.Add("bytes", size)
+	httpCacheStats.Add("entries", 1)
+}
+
+// evict 删除最久未使用的缓存直到总大小不超过上限，调用时持有 c.mu
+func (c *HTTPCache) evict() {
+	for c.size > c.config.MaxBytes && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		item := e.Value.(*cacheItem)
+		c.lru.Remove(e)
+		delete(c.items, item.key)
+		c.size -= item.size
+		httpCacheStats.Add("bytes", -item.size)
+		httpCacheStats.Add("entries", -1)
+		httpCacheStats.Add("evictions", 1)
+		if err := os.Remove(c.path(item.key)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("删除代理缓存失败", "key", item.key, "error", err)
+		}
+	}
+}
+
+// load 按修改时间恢复缓存的使用顺序，并删除上次退出时残留的临时文件
+func (c *HTTPCache) load() error {
+	if err := os.MkdirAll(c.config.Dir, 0755); err != nil {
+		return err
+	}
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(c.config.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return os.Remove(path)
+		}
+		if !cacheKeyRegexp.MatchString(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{d.Name(), info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.add(f.key, f.size)
+	}
+	c.evict()
+	return nil
+}
+
+func (c *HTTPCache) path(key string) string {
+	return filepath.Join(c.config.Dir, key[:2], key)
+}
+
+// cacheKey 由请求地址和 cacheKeyHeaders 计算缓存 key
+func cacheKey(req *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, req.URL.String())
+	for _, name := range cacheKeyHeaders {
+		io.WriteString(h, "\n"+strings.Join(req.Header.Values(name), ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// response 用缓存的头和响应体构造响应
+func (e *cacheEntry) response(req *http.Request, body io.ReadCloser, status string) *http.Response {
+	header := e.Header.Clone()
+	header.Set("X-Cache", status)
+	header.Set("Age", strconv.Itoa(int(time.Since(e.StoreTime).Seconds())))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+}
+
+// freshness 按响应头计算缓存时间，no-store 时返回 false。响应头没有给出缓存时间时使用 defaultTTL，
+// defaultTTL 为 0 时不缓存。代理缓存只为本服务的用户使用，private 的响应同样缓存
+func freshness(header http.Header, defaultTTL time.Duration) (time.Duration, bool) {
+	maxAge, noCache := -1, false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		switch name {
+		case "no-store":
+			return 0, false
+		case "no-cache":
+			// 可以缓存，但每次使用前都要向上游确认
+			noCache = true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				maxAge = seconds
+			}
+		}
+	}
+	if noCache {
+		return 0, true
+	}
+	if maxAge >= 0 {
+		age, _ := strconv.Atoi(header.Get("Age"))
+		return time.Duration(maxAge-age) * time.Second, true
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// 无效的 Expires 表示已经过期
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return t.Sub(date), true
+	}
+	return defaultTTL, defaultTTL > 0
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestHTTPCache(t *testing.T, dir string, client *http.Client, maxBytes int64) *HTTPCache {
+	t.Helper()
+	c, err := NewHTTPCache(client, HTTPCacheConfig{Dir: dir, MaxBytes: maxBytes, DefaultTTL: func(u *url.URL) time.Duration {
+		if u.Hostname() == "127.0.0.1" {
+			return time.Minute
+		}
+		return 0
+	}})
+	if err != nil {
+		t.Fatalf("NewHTTPCache: %v", err)
+	}
+	return c
+}
+
+// get 发送 GET 请求，返回响应体和 X-Cache
+func get(t *testing.T, c *HTTPCache, url string) (string, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Do(%s): %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body), resp.Header.Get("X-Cache")
+}
+
+func TestHTTPCacheHonorsCacheControl(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte("body " + r.URL.Path))
+	}))
+	defer server.Close()
+	c := newTestHTTPCache(t, t.TempDir(), server.Client(), 1<<20)
+
+	for _, tc := range []struct {
+		path  string
+		calls int32
+		cache []string
+	}{
+		{"/fresh", 1, []string{"MISS", "HIT", "HIT"}},
+		{"/default", 1, []string{"MISS", "HIT"}},
+		{"/no-store", 2, []string{"MISS", "MISS"}},
+		{"/etag", 3, []string{"MISS", "REVALIDATED", "REVALIDATED"}},
+	} {
+		calls.Store(0)
+		for i, want := range tc.cache {
+			body, status := get(t, c, server.URL+tc.path)
+			if body != "body "+tc.path || status != want {
+				t.Errorf("%s request %d = %q, %s; want %s", tc.path, i, body, status, want)
+			}
+		}
+		if calls.Load() != tc.calls {
+			t.Errorf("%s server called %d times, want %d", tc.path, calls.Load(), tc.calls)
+		}
+	}
+}
+
+func TestHTTPCacheServesStaleOnError(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	c := newTestHTTPCache(t, t.TempDir(), server.Client(), 1<<20)
+
+	get(t, c, server.URL)
+	failing.Store(true)
+	if body, status := get(t, c, server.URL); body != "ok" || status != "STALE" {
+		t.Errorf("got %q, %s; want stale ok", body, status)
+	}
+}
+
+func TestHTTPCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	// 每个缓存文件约 400 字节，上限只够放两个
+	dir := t.TempDir()
+	c := newTestHTTPCache(t, dir, server.Client(), 1000)
+	get(t, c, server.URL+"/a")
+	get(t, c, server.URL+"/b")
+	get(t, c, server.URL+"/a") // a 最近使用过，写入 c 时删除 b
+	get(t, c, server.URL+"/c")
+	if calls.Load() != 3 {
+		t.Fatalf("server called %d times, want 3", calls.Load())
+	}
+
+	// 重启后从磁盘恢复
+	c = newTestHTTPCache(t, dir, server.Client(), 1000)
+	for _, tc := range []struct{ path, want string }{{"/a", "HIT"}, {"/c", "HIT"}, {"/b", "MISS"}} {
+		if _, status := get(t, c, server.URL+tc.path); status != tc.want {
+			t.Errorf("%s = %s, want %s", tc.path, status, tc.want)
+		}
+	}
+}
+
+func TestHTTPCacheKeysAndDefaultTTL(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte("ua " + r.UserAgent()))
+	}))
+	defer server.Close()
+	c := newTestHTTPCache(t, t.TempDir(), server.Client(), 1<<20)
+
+	// 同一地址以不同的 User-Agent 请求时分开缓存
+	for i, tc := range []struct{ ua, want string }{{"a", "MISS"}, {"b", "MISS"}, {"a", "HIT"}, {"b", "HIT"}} {
+		req, _ := http.NewRequest("GET", server.URL+"/page", nil)
+		req.Header.Set("User-Agent", tc.ua)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ua "+tc.ua || resp.Header.Get("X-Cache") != tc.want {
+			t.Errorf("request %d = %q, %s; want ua %s, %s", i, body, resp.Header.Get("X-Cache"), tc.ua, tc.want)
+		}
+	}
+
+	// DefaultTTL 返回 0 的域名，没有缓存头的响应不缓存
+	other := strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/page"
+	for i := 0; i < 2; i++ {
+		if _, status := get(t, c, other); status != "MISS" {
+			t.Errorf("request %d to another host = %s, want MISS", i, status)
+		}
+	}
+}
+
+func TestHTTPCacheStreamsResponse(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/large" {
+			// 分块发送，没有 Content-Length
+			for i := 0; i < 200; i++ {
+				w.Write([]byte(strings.Repeat("x", 1024)))
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("rest"))
+	}))
+	defer server.Close()
+	c := newTestHTTPCache(t, t.TempDir(), server.Client(), 1<<20)
+
+	// 上游还在发送时，已收到的部分就可以读到
+	req, _ := http.NewRequest("GET", server.URL+"/stream", nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first " {
+		t.Fatalf("first read = %q, %v", buf, err)
+	}
+	// 没有读完就关闭时不缓存，读完后缓存
+	resp.Body.Close()
+	close(release)
+	for _, want := range []string{"MISS", "HIT"} {
+		if body, status := get(t, c, server.URL+"/stream"); body != "first rest" || status != want {
+			t.Errorf("/stream = %q, %s; want %s", body, status, want)
+		}
+	}
+
+	// 超过单个响应上限时完整返回但不缓存
+	for i := 0; i < 2; i++ {
+		if body, status := get(t, c, server.URL+"/large"); len(body) != 200*1024 || status != "MISS" {
+			t.Errorf("/large request %d = %d bytes, %s; want MISS", i, len(body), status)
+		}
+	}
+}
+
+// pageFetcher 按路径返回没有缓存头的页面，/s/moved 重定向到验证页面
+type pageFetcher struct {
+	calls map[string]int
+}
+
+func (f *pageFetcher) Do(req *http.Request) (*http.Response, error) {
+	f.calls[req.URL.Path]++
+	final := req
+	if req.URL.Path == "/s/moved" {
+		final = req.Clone(req.Context())
+		final.URL, _ = url.Parse("https://mp.weixin.qq.com/mp/wappoc_appmsgcaptcha")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:       io.NopCloser(strings.NewReader("page " + req.URL.Path)),
+		Request:    final,
+	}, nil
+}
+
+func TestHTTPCacheWeChatDefaultTTL(t *testing.T) {
+	f := &pageFetcher{calls: make(map[string]int)}
+	c, err := NewHTTPCache(f, HTTPCacheConfig{Dir: t.TempDir(), MaxBytes: 1 << 20, DefaultTTL: WeChatDefaultTTL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 文章页面没有缓存头时同样缓存，重复阅读不再请求微信；接口和验证页面不缓存
+	for _, tc := range []struct {
+		path  string
+		calls int
+	}{
+		{"/s/abc", 1},
+		{"/s", 1},
+		{"/mp/getappmsgext", 2},
+		{"/s/moved", 2},
+	} {
+		for i := 0; i < 2; i++ {
+			if body, _ := get(t, c, "https://mp.weixin.qq.com"+tc.path); body != "page "+tc.path {
+				t.Errorf("%s = %q", tc.path, body)
+			}
+		}
+		if f.calls[tc.path] != tc.calls {
+			t.Errorf("%s fetched %d times, want %d", tc.path, f.calls[tc.path], tc.calls)
+		}
+	}
+
+	if ttl := WeChatDefaultTTL(&url.URL{Host: "mmbiz.qpic.cn", Path: "/mmbiz_png/a/640"}); ttl != 24*time.Hour {
+		t.Errorf("image TTL = %v", ttl)
+	}
+}
+
+func TestHTTPCacheRevalidateUpdatesEntry(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			// 内容未变，新的头给出缓存时间
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+	c := newTestHTTPCache(t, t.TempDir(), server.Client(), 1<<20)
+
+	// 确认后缓存文件的头和过期时间更新，响应体不变
+	for i, want := range []string{"MISS", "REVALIDATED", "HIT"} {
+		if body, status := get(t, c, server.URL+"/a"); len(body) != 1000 || status != want {
+			t.Errorf("request %d = %d bytes, %s; want %s", i, len(body), status, want)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("server called %d times, want 2", calls.Load())
+	}
+}
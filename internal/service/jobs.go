@@ -0,0 +1,548 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"wechat-reader/internal/logging"
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/storage"
+)
+
+var (
+	// errJobCancelled 任务被用户取消，用于区分服务关闭导致的中断
+	errJobCancelled = errors.New("任务已取消")
+	// errJobLeaseLost 任务租约过期后被其他实例接手，本实例停止执行且不再修改任务
+	errJobLeaseLost = errors.New("任务已由其他实例接手")
+)
+
+// JobManager 在后台执行抓取任务，任务状态保存在数据库中。
+// 多个实例共用数据库时，每个任务由领取到租约的实例执行，执行期间定期延长租约，
+// 实例退出后租约过期的任务由其他实例接手
+type JobManager struct {
+	crawler *Crawler
+	db      storage.Store
+	workers int
+	queue   chan string
+	wg      sync.WaitGroup
+
+	owner     string        // 本实例的标识，记录在领取的任务上
+	lease     time.Duration // 任务租约时长，也是检查可领取任务的间隔
+	heartbeat time.Duration // 延长租约的间隔
+
+	mu      sync.Mutex
+	running map[string]context.CancelCauseFunc // 正在执行的任务
+	queued  map[string]bool                    // 已在队列中等待的任务，避免重复排队
+}
+
+func NewJobManager(crawler *Crawler, db storage.Store, workers int) *JobManager {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &JobManager{
+		crawler:   crawler,
+		db:        db,
+		workers:   workers,
+		queue:     make(chan string, 100),
+		owner:     newOwnerID(),
+		lease:     time.Minute,
+		heartbeat: 10 * time.Second,
+		running:   make(map[string]context.CancelCauseFunc),
+		queued:    make(map[string]bool),
+	}
+}
+
+// Start 启动 worker，并定期排队可以领取的任务：排队中的任务，以及执行实例已退出、
+// 租约过期的任务。ctx 结束时正在执行的任务会保存已获取的文章和分页位置，
+// 之后由本实例重启或其他实例从中断处继续
+func (m *JobManager) Start(ctx context.Context) error {
+	ids, err := m.claimable(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < m.workers; i++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.worker(ctx)
+		}()
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.sweep(ctx, ids)
+	}()
+
+	return nil
+}
+
+// sweep 把可领取的任务排入队列，之后每个租约周期重新检查一次。
+// 任务可能超过队列容量，等待 worker 取走后继续排队，不丢弃任务
+func (m *JobManager) sweep(ctx context.Context, ids []string) {
+	ticker := time.NewTicker(m.lease)
+	defer ticker.Stop()
+
+	for {
+		for _, id := range ids {
+			if !m.markQueued(id) {
+				continue
+			}
+			slog.InfoContext(ctx, "排队未完成的任务", "job_id", id)
+			select {
+			case m.queue <- id:
+			case <-ctx.Done():
+				// 没有排上的任务仍是排队中，下次启动时继续
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if ids, err = m.claimable(ctx); err != nil {
+			slog.ErrorContext(ctx, "检查未完成的任务失败", "error", err)
+		}
+	}
+}
+
+// claimable 返回可以领取的任务 ID，按创建时间从早到晚排列。
+// 已请求取消、但执行实例没来得及停止就退出的任务直接标记为已取消
+func (m *JobManager) claimable(ctx context.Context) ([]string, error) {
+	var unfinished []model.Job
+	for _, status := range []string{model.JobStatusRunning, model.JobStatusPending} {
+		jobs, err := m.db.GetJobs(ctx, status, math.MaxInt32)
+		if err != nil {
+			return nil, err
+		}
+		unfinished = append(unfinished, jobs...)
+	}
+
+	now := time.Now()
+	ids := make([]string, 0, len(unfinished))
+	for i := len(unfinished) - 1; i >= 0; i-- {
+		job := unfinished[i]
+		if job.Status == model.JobStatusRunning {
+			if job.LeaseUntil != nil && job.LeaseUntil.After(now) {
+				continue
+			}
+			if job.CancelRequested {
+				job.Status = model.JobStatusCancelled
+				job.UpdateTime = now
+				if err := m.db.SaveJob(ctx, &job); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		ids = append(ids, job.ID)
+	}
+	return ids, nil
+}
+
+// Submit 创建抓取任务并放入队列，mode 为 model.JobMode* 之一。
+// 队列已满时任务保持排队中，稍后由 sweep 排入
+func (m *JobManager) Submit(ctx context.Context, url string, mode string) (*model.Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &model.Job{
+		ID:         id,
+		URL:        url,
+		Mode:       mode,
+		Status:     model.JobStatusPending,
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	if err := m.db.SaveJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	m.enqueue(ctx, job.ID)
+	return job, nil
+}
+
+// Backfill 为专辑创建回填任务，从记录的最早位置继续抓取更早的文章。
+// 专辑没有翻页记录时返回 nil
+func (m *JobManager) Backfill(ctx context.Context, albumID string) (*model.Job, error) {
+	cursor, err := m.db.GetAlbumCursor(ctx, albumID)
+	if err != nil || cursor == nil {
+		return nil, err
+	}
+	return m.Submit(ctx, cursor.URL, model.JobModeBackfill)
+}
+
+// Wait 等待所有 worker 退出，在 Start 的 ctx 结束后调用
+func (m *JobManager) Wait() {
+	m.wg.Wait()
+}
+
+// Cancel 取消任务：排队中的任务直接标记为已取消，正在执行的任务保存已获取的部分后停止。
+// 任务在其他实例上执行时，由该实例在下次延长租约时停止。任务不存在时返回 nil
+func (m *JobManager) Cancel(ctx context.Context, id string) (*model.Job, error) {
+	m.mu.Lock()
+	cancel, ok := m.running[id]
+	m.mu.Unlock()
+	if ok {
+		cancel(errJobCancelled)
+		return m.db.GetJob(ctx, id)
+	}
+
+	found, err := m.db.RequestJobCancel(ctx, id)
+	if err != nil || !found {
+		return nil, err
+	}
+	return m.db.GetJob(ctx, id)
+}
+
+// Resume 重新执行已取消或失败的任务，从记录的分页位置继续。任务不存在时返回 nil
+func (m *JobManager) Resume(ctx context.Context, id string) (*model.Job, error) {
+	job, err := m.db.GetJob(ctx, id)
+	if err != nil || job == nil {
+		return job, err
+	}
+	if job.Status != model.JobStatusCancelled && job.Status != model.JobStatusFailed {
+		return nil, fmt.Errorf("任务状态为 %s，不能继续执行", job.Status)
+	}
+
+	job.Status = model.JobStatusPending
+	job.Error = ""
+	job.UpdateTime = time.Now()
+	if err := m.db.SaveJob(ctx, job); err != nil {
+		return nil, err
+	}
+	m.enqueue(ctx, job.ID)
+	return job, nil
+}
+
+// Get 获取任务状态
+func (m *JobManager) Get(ctx context.Context, id string) (*model.Job, error) {
+	return m.db.GetJob(ctx, id)
+}
+
+// enqueue 把任务放入队列，任务已在队列中时不重复排队。
+// 队列已满时任务保持排队中，由 sweep 下次检查时排入
+func (m *JobManager) enqueue(ctx context.Context, id string) {
+	if !m.markQueued(id) {
+		return
+	}
+	select {
+	case m.queue <- id:
+	default:
+		m.mu.Lock()
+		delete(m.queued, id)
+		m.mu.Unlock()
+		slog.InfoContext(ctx, "任务队列已满，稍后排队", "job_id", id)
+	}
+}
+
+// markQueued 记录任务已排队，任务已在队列中时返回 false
+func (m *JobManager) markQueued(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.queued[id] {
+		return false
+	}
+	m.queued[id] = true
+	return true
+}
+
+func (m *JobManager) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-m.queue:
+			if err := m.run(ctx, id); errors.Is(err, errJobLeaseLost) {
+				slog.WarnContext(ctx, "任务租约已失效，停止执行", "job_id", id)
+			} else if err != nil {
+				slog.ErrorContext(ctx, "执行任务失败", "job_id", id, "error", err)
+			}
+		}
+	}
+}
+
+// update 修改本实例正在执行的任务并写回数据库。任务已被其他实例接手或租约已过期时不写入，
+// 返回 errJobLeaseLost，避免覆盖接手的实例写入的进度
+func (m *JobManager) update(ctx context.Context, job *model.Job, fn func(job *model.Job)) error {
+	fn(job)
+	job.UpdateTime = time.Now()
+	ok, err := m.db.UpdateJob(ctx, job, m.owner)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errJobLeaseLost
+	}
+	return nil
+}
+
+func (m *JobManager) run(ctx context.Context, id string) error {
+	m.mu.Lock()
+	delete(m.queued, id)
+	m.mu.Unlock()
+
+	// 领取任务，同一个任务同时只由一个实例执行
+	claimed, err := m.db.ClaimJob(ctx, id, m.owner, time.Now().Add(m.lease))
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		slog.DebugContext(ctx, "任务已结束或由其他实例执行", "job_id", id)
+		return nil
+	}
+	job, err := m.db.GetJob(ctx, id)
+	if err != nil || job == nil {
+		return err
+	}
+
+	albumID := ExtractAlbumID(job.URL)
+	ctx = logging.With(ctx, "job_id", id, "album_id", albumID)
+	slog.InfoContext(ctx, "开始执行任务", "mode", job.Mode, "url", job.URL)
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	m.mu.Lock()
+	m.running[id] = cancel
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, id)
+		m.mu.Unlock()
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go m.renewLease(ctx, id, cancel, stop)
+
+	if err := m.update(ctx, job, func(job *model.Job) {
+		job.PagesFetched = 0
+		job.ArticlesFound = 0
+		job.ContentsFetched = 0
+		job.Errors = nil
+		job.Error = ""
+	}); err != nil {
+		return err
+	}
+
+	albumCursor, err := m.db.GetAlbumCursor(ctx, albumID)
+	if err != nil {
+		return m.fail(ctx, job, err)
+	}
+	// 增量任务只从最新的文章往下翻，专辑已有翻页记录时不覆盖
+	saveAlbumCursor := albumID != "" && (job.Mode != model.JobModeIncremental || albumCursor == nil)
+
+	opts := CrawlOptions{
+		Progress: func(p Progress) {
+			// 进度写入失败不影响抓取，任务已被其他实例接手时停止
+			if err := m.update(ctx, job, func(job *model.Job) {
+				job.PagesFetched = p.Pages
+				job.ArticlesFound = p.Articles
+				job.ResumeMsgid = p.Cursor.Msgid
+				job.ResumeItemidx = p.Cursor.Itemidx
+				if p.Err != nil {
+					job.Errors = append(job.Errors, p.Err.Error())
+				}
+			}); errors.Is(err, errJobLeaseLost) {
+				cancel(errJobLeaseLost)
+				return
+			}
+			if saveAlbumCursor && p.Cursor.Msgid != "" {
+				_ = m.db.SaveAlbumCursor(ctx, &model.AlbumCursor{
+					AlbumID:    albumID,
+					URL:        job.URL,
+					Msgid:      p.Cursor.Msgid,
+					Itemidx:    p.Cursor.Itemidx,
+					ReachedEnd: p.End,
+					UpdateTime: time.Now(),
+				})
+			}
+		},
+		Album: func(album *model.Album, account *model.Account) {
+			// 专辑信息保存失败不影响抓取，文章仍按页面上的主题保存
+			if account != nil {
+				if err := m.db.SaveAccount(ctx, account); err != nil {
+					slog.WarnContext(ctx, "保存公众号信息失败", "biz", account.Biz, "error", err)
+				}
+			}
+			if album != nil {
+				if err := m.db.SaveAlbum(ctx, album); err != nil {
+					slog.WarnContext(ctx, "保存专辑信息失败", "error", err)
+				}
+			}
+		},
+	}
+	switch {
+	case job.ResumeMsgid != "":
+		// 任务本身中断过，从中断处继续
+		opts.Resume = &Cursor{Msgid: job.ResumeMsgid, Itemidx: job.ResumeItemidx}
+	case albumCursor == nil || job.Mode == model.JobModeIncremental:
+	case job.Mode == model.JobModeBackfill || !albumCursor.ReachedEnd:
+		// 回填总是从专辑最早的位置继续；完整抓取在专辑上次没有抓完时从断点继续，
+		// 已经抓完的专辑重新从头抓取
+		opts.Resume = &Cursor{Msgid: albumCursor.Msgid, Itemidx: albumCursor.Itemidx}
+	}
+	if job.Mode == model.JobModeIncremental {
+		opts.StopAt = func(article model.Article) bool {
+			exists, err := m.db.HasArticle(ctx, article.URL)
+			return err == nil && exists
+		}
+	}
+
+	articles, err := m.crawler.FetchArticlesWithOptions(jobCtx, job.URL, opts)
+	if jobCtx.Err() != nil {
+		return m.interrupt(ctx, jobCtx, job, articles)
+	}
+	if err != nil {
+		return m.fail(ctx, job, err)
+	}
+
+	// 下载文章正文，便于离线阅读
+	fetched := m.crawler.FetchContents(jobCtx, articles)
+	if err := m.update(ctx, job, func(job *model.Job) {
+		job.ArticlesFound = len(articles)
+		job.ContentsFetched = fetched
+	}); err != nil {
+		return err
+	}
+	if jobCtx.Err() != nil {
+		return m.interrupt(ctx, jobCtx, job, articles)
+	}
+
+	if err := m.saveArticles(ctx, articles); err != nil {
+		return m.fail(ctx, job, err)
+	}
+
+	slog.InfoContext(ctx, "任务完成", "articles", len(articles), "contents", fetched)
+	return m.update(ctx, job, func(job *model.Job) {
+		job.Status = model.JobStatusSucceeded
+		job.ResumeMsgid = ""
+		job.ResumeItemidx = 0
+	})
+}
+
+// renewLease 在任务执行期间定期延长租约，直到 stop 关闭。无法延长时停止任务：
+// 其他实例请求了取消时按用户取消处理，租约已被其他实例接手时放弃执行
+func (m *JobManager) renewLease(ctx context.Context, id string, cancel context.CancelCauseFunc, stop <-chan struct{}) {
+	ticker := time.NewTicker(m.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ok, err := m.db.RenewJobLease(ctx, id, m.owner, time.Now().Add(m.lease))
+		if err != nil {
+			// 暂时无法访问数据库时继续执行，租约过期前还有机会延长
+			slog.WarnContext(ctx, "延长任务租约失败", "error", err)
+			continue
+		}
+		if ok {
+			continue
+		}
+
+		job, err := m.db.GetJob(ctx, id)
+		if err != nil {
+			slog.WarnContext(ctx, "读取任务失败", "error", err)
+			continue
+		}
+		if job != nil && job.CancelRequested {
+			cancel(errJobCancelled)
+		} else {
+			cancel(errJobLeaseLost)
+		}
+		return
+	}
+}
+
+// interrupt 保存中断前已获取的文章。用户取消的任务标记为已取消，
+// 服务关闭导致的中断重新标记为排队中，由本实例重启或其他实例从记录的分页位置继续。
+// 任务已被其他实例接手时只保存文章，不修改任务
+func (m *JobManager) interrupt(ctx, jobCtx context.Context, job *model.Job, articles []model.Article) error {
+	// 服务关闭时 ctx 已结束，保存部分结果不能再使用它
+	ctx = context.WithoutCancel(ctx)
+
+	if err := m.saveArticles(ctx, articles); err != nil {
+		return m.fail(ctx, job, err)
+	}
+
+	cause := context.Cause(jobCtx)
+	if cause == errJobLeaseLost {
+		slog.WarnContext(ctx, "任务已由其他实例接手，已保存部分文章", "articles", len(articles))
+		return nil
+	}
+	status := model.JobStatusPending
+	if cause == errJobCancelled {
+		status = model.JobStatusCancelled
+	}
+	slog.InfoContext(ctx, "任务中断，已保存部分文章", "articles", len(articles), "status", status)
+
+	return m.update(ctx, job, func(job *model.Job) {
+		job.Status = status
+		job.ArticlesFound = len(articles)
+	})
+}
+
+// saveArticles 保存抓取的文章。文章已保存过时，保留这次没能重新归档的图片的本地路径
+func (m *JobManager) saveArticles(ctx context.Context, articles []model.Article) error {
+	for i := range articles {
+		if articles[i].Content == "" {
+			continue
+		}
+		previous, err := m.db.GetArticle(ctx, articles[i].ID)
+		if err != nil {
+			return err
+		}
+		if previous != nil {
+			articles[i].Content = keepArchivedImages(previous.Content, articles[i].Content)
+		}
+	}
+	return m.db.SaveArticles(ctx, articles)
+}
+
+func (m *JobManager) fail(ctx context.Context, job *model.Job, cause error) error {
+	if err := m.update(ctx, job, func(job *model.Job) {
+		job.Status = model.JobStatusFailed
+		job.Error = cause.Error()
+	}); err != nil {
+		return err
+	}
+	return cause
+}
+
+// newOwnerID 生成本实例的标识，由主机名、进程号和随机数组成，便于在任务上看出执行的实例
+func newOwnerID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("生成任务 ID 失败: %v", err)
+	}
+	return "job_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/storage"
+)
+
+func newTestDatabase(t *testing.T) *storage.Database {
+	t.Helper()
+	ctx := context.Background()
+	db, err := storage.NewDatabase(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() { db.Close(ctx) })
+	return db
+}
+
+// runJob 提交任务并同步执行，返回执行后的任务状态
+func runJob(t *testing.T, m *JobManager, mode string) *model.Job {
+	t.Helper()
+	if _, err := m.Submit(context.Background(), testAlbumURL, mode); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	return runQueued(t, m)
+}
+
+// runQueued 在当前 goroutine 执行队列中的下一个任务
+func runQueued(t *testing.T, m *JobManager) *model.Job {
+	t.Helper()
+	ctx := context.Background()
+	id := <-m.queue
+	if err := m.run(ctx, id); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	job, err := m.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return job
+}
+
+func TestJobsResumeFromAlbumCursor(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	albumID := ExtractAlbumID(testAlbumURL)
+
+	// 第二页翻页失败，专辑记录停在第一页分页数据的末尾
+	f := &fixtureFetcher{t: t, album: "album.html", pages: []string{"album_page_1.json", "album_ret_error.json"}}
+	job := runJob(t, NewJobManager(newFixtureCrawler(f), db, 1), model.JobModeFull)
+	if job.Status != model.JobStatusSucceeded || len(job.Errors) != 1 {
+		t.Fatalf("first job = %s with errors %v, want succeeded with the page error", job.Status, job.Errors)
+	}
+	cursor, err := db.GetAlbumCursor(ctx, albumID)
+	if err != nil || cursor == nil {
+		t.Fatalf("GetAlbumCursor = %v, %v", cursor, err)
+	}
+	if cursor.Msgid != "2247488554" || cursor.Itemidx != 1 || cursor.ReachedEnd {
+		t.Errorf("cursor = %+v, want 2247488554/1 not at the end", cursor)
+	}
+	// 专辑和公众号信息随文章一起保存
+	albums, err := db.GetAlbums(ctx)
+	if err != nil || len(albums) != 1 || albums[0].Title != "AmazingFounder" || albums[0].SavedCount != job.ArticlesFound {
+		t.Errorf("GetAlbums = %+v, %v; want AmazingFounder with %d articles", albums, err, job.ArticlesFound)
+	}
+	if accounts, err := db.GetAccounts(ctx); err != nil || len(accounts) != 1 || accounts[0].Name != "金沙江创投" {
+		t.Errorf("GetAccounts = %+v, %v", accounts, err)
+	}
+
+	// 再次抓取从记录的位置继续，并到达专辑末尾
+	f = &fixtureFetcher{t: t, album: "album.html", pages: []string{"album_page_2.json"}}
+	runJob(t, NewJobManager(newFixtureCrawler(f), db, 1), model.JobModeFull)
+	if q := f.pageRequests()[0].URL.Query(); q.Get("begin_msgid") != "2247488554" {
+		t.Errorf("second job started at %s, want the stored cursor", q.Get("begin_msgid"))
+	}
+	if cursor, _ = db.GetAlbumCursor(ctx, albumID); !cursor.ReachedEnd {
+		t.Errorf("cursor = %+v, want reached end", cursor)
+	}
+
+	// 专辑抓完后，增量任务不修改记录，回填仍从最早的位置开始
+	f = &fixtureFetcher{t: t, album: "album.html", pages: []string{"album_page_1.json", "album_page_2.json"}}
+	runJob(t, NewJobManager(newFixtureCrawler(f), db, 1), model.JobModeIncremental)
+	if after, _ := db.GetAlbumCursor(ctx, albumID); *after != *cursor {
+		t.Errorf("incremental job changed cursor to %+v", after)
+	}
+
+	f = &fixtureFetcher{t: t, album: "album.html", pages: []string{"album_page_2.json"}}
+	m := NewJobManager(newFixtureCrawler(f), db, 1)
+	if job, err := m.Backfill(ctx, albumID); err != nil || job == nil {
+		t.Fatalf("Backfill = %v, %v", job, err)
+	}
+	runQueued(t, m)
+	if q := f.pageRequests()[0].URL.Query(); q.Get("begin_msgid") != cursor.Msgid {
+		t.Errorf("backfill started at %s, want the earliest stored position %s", q.Get("begin_msgid"), cursor.Msgid)
+	}
+}
+
+func TestJobsStartRequeuesAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := newTestDatabase(t)
+
+	// 未完成的任务超过队列容量
+	m := NewJobManager(nil, db, 1)
+	total := cap(m.queue) + 50
+	for i := 0; i < total; i++ {
+		job := &model.Job{ID: fmt.Sprintf("job_%03d", i), URL: testAlbumURL, Status: model.JobStatusPending,
+			CreateTime: time.Unix(int64(i), 0), UpdateTime: time.Unix(int64(i), 0)}
+		if err := db.SaveJob(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 不启动 worker，由测试取走队列中的任务
+	m.workers = 0
+	if err := m.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	for i := 0; i < total; i++ {
+		select {
+		case id := <-m.queue:
+			// 按创建时间从早到晚排队
+			if want := fmt.Sprintf("job_%03d", i); id != want {
+				t.Fatalf("queued %s, want %s", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d jobs requeued", i, total)
+		}
+	}
+	cancel()
+	m.Wait()
+}
+
+func TestJobsSubmitWhenQueueFull(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	m := NewJobManager(nil, db, 1)
+	m.queue = make(chan string, 1)
+
+	if _, err := m.Submit(ctx, testAlbumURL, model.JobModeFull); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	// 队列已满时任务保持排队中，由 sweep 稍后排入
+	job, err := m.Submit(ctx, testAlbumURL, model.JobModeFull)
+	if err != nil {
+		t.Fatalf("Submit with full queue: %v", err)
+	}
+	if stored, _ := db.GetJob(ctx, job.ID); stored == nil || stored.Status != model.JobStatusPending {
+		t.Fatalf("job = %+v, want pending", stored)
+	}
+	ids, err := m.claimable(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || (ids[0] != job.ID && ids[1] != job.ID) {
+		t.Errorf("claimable = %v, want both jobs", ids)
+	}
+}
+
+// blockingFetcher 收到请求后一直等待，直到请求被取消
+type blockingFetcher struct {
+	started chan struct{}
+}
+
+func (f *blockingFetcher) Do(req *http.Request) (*http.Response, error) {
+	close(f.started)
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestJobsCancelFromAnotherReplica(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	f := &blockingFetcher{started: make(chan struct{})}
+	a := NewJobManager(NewCrawler(WithFetcher(f)), db, 1)
+	a.heartbeat = 10 * time.Millisecond
+	b := NewJobManager(nil, db, 1)
+
+	job, err := a.Submit(ctx, testAlbumURL, model.JobModeFull)
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- a.run(ctx, <-a.queue) }()
+	<-f.started
+
+	// 任务已由 a 领取，b 不会重复执行
+	if err := b.run(ctx, job.ID); err != nil {
+		t.Fatalf("run on another replica: %v", err)
+	}
+	if got, _ := db.GetJob(ctx, job.ID); got.Status != model.JobStatusRunning || got.Owner != a.owner {
+		t.Fatalf("job = %+v, want running on a", got)
+	}
+
+	// b 收到的取消请求由 a 在延长租约时执行
+	if _, err := b.Cancel(ctx, job.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job kept running after cancel request")
+	}
+	if got, _ := db.GetJob(ctx, job.ID); got.Status != model.JobStatusCancelled {
+		t.Errorf("job status = %s, want cancelled", got.Status)
+	}
+}
@@ -0,0 +1,516 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/service/rewrite"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// 转换 Markdown 时连同内容一起忽略的元素
+var markdownSkipped = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "head": true,
+	"iframe": true, "object": true, "embed": true, "video": true, "audio": true,
+	"svg": true, "math": true, "canvas": true, "form": true, "input": true, "button": true,
+	"select": true, "textarea": true, "mp-common-profile": true,
+}
+
+// 转换 Markdown 时作为段落处理的元素。公众号编辑器用多层 <section> 排版，嵌套的段落不会产生多余的空行
+var markdownBlocks = map[string]bool{
+	"p": true, "section": true, "div": true, "article": true, "header": true, "footer": true,
+	"figure": true, "figcaption": true, "center": true, "dl": true, "dt": true, "dd": true,
+}
+
+var (
+	// 需要转义的 Markdown 字符
+	markdownEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`, `<`, `\<`)
+	// 文件名中不允许的字符
+	filenameRegexp = regexp.MustCompile(`[\x00-\x1f/\\:*?"<>|#^\[\]]+`)
+	// 连续的空行
+	blankLinesRegexp = regexp.MustCompile(`\n{3,}`)
+)
+
+// 转换过程中使用的占位字符，生成结果前替换。缩进用 indent 表示，不会被去除行首空白时删掉
+const (
+	hardBreak   = "\x00"
+	indent      = "\x02"
+	preSentinel = "\x01"
+)
+
+// ArticleMarkdown 把文章转换为带 YAML front matter（标题、作者、公众号、主题、原文链接和发布时间）的 Markdown。
+// image 改写图片地址，例如把归档图片改为本地文件，为 nil 时使用原地址
+func ArticleMarkdown(article *model.Article, image func(src string) string) (string, error) {
+	var b strings.Builder
+	b.WriteString("---\n")
+	writeFrontMatter(&b, "title", article.Title)
+	writeFrontMatter(&b, "author", article.Author)
+	writeFrontMatter(&b, "account", article.Account)
+	writeFrontMatter(&b, "topic", article.Topic)
+	writeFrontMatter(&b, "url", article.URL)
+	if !article.PublishTime.IsZero() {
+		fmt.Fprintf(&b, "published: %s\n", article.PublishTime.Format(time.RFC3339))
+	}
+	b.WriteString("---\n")
+
+	if article.Content != "" {
+		body, err := htmlToMarkdown(article.Content, image)
+		if err != nil {
+			return "", err
+		}
+		if body != "" {
+			b.WriteString("\n" + body + "\n")
+		}
+	}
+	return b.String(), nil
+}
+
+// MarkdownFilename 导出文件的名称：去掉文件名中不允许的字符后的标题，标题为空时使用文章 ID
+func MarkdownFilename(article *model.Article) string {
+	name := strings.TrimSpace(filenameRegexp.ReplaceAllString(article.Title, " "))
+	name = strings.Join(strings.Fields(name), " ")
+	if utf8.RuneCountInString(name) > 80 {
+		name = string([]rune(name)[:80])
+	}
+	name = strings.Trim(name, ". ")
+	if name == "" {
+		name = article.ID
+	}
+	return name + ".md"
+}
+
+// writeFrontMatter 写入一个 YAML 字段。字符串使用 JSON 格式，JSON 字符串同时是合法的 YAML
+func writeFrontMatter(b *strings.Builder, key, value string) {
+	if value == "" {
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(value)
+	fmt.Fprintf(b, "%s: %s\n", key, strings.TrimSpace(buf.String()))
+}
+
+// MarkdownZip 把文章逐篇写入 zip，每篇一个 .md 文件。归档到本地的图片一起写入 images 目录，
+// 正文中以相对路径引用，解压后可以直接放进 Obsidian 等笔记软件
+type MarkdownZip struct {
+	zw       *zip.Writer
+	archiver *ImageArchiver
+	names    map[string]bool // 已使用的文件名
+	images   map[string]bool // 已写入的图片
+	exists   map[string]bool // 已检查过的图片文件是否存在
+}
+
+// NewMarkdownZip 创建写入 w 的导出文件，archiver 为 nil 时不导出图片
+func NewMarkdownZip(w io.Writer, archiver *ImageArchiver) *MarkdownZip {
+	return &MarkdownZip{
+		zw:       zip.NewWriter(w),
+		archiver: archiver,
+		names:    make(map[string]bool),
+		images:   make(map[string]bool),
+		exists:   make(map[string]bool),
+	}
+}
+
+// Add 写入一篇文章，标题相同的文章在文件名后加序号。
+// 归档的图片文件已被删除时引用 data-original-src 中的原链接
+func (z *MarkdownZip) Add(article *model.Article) error {
+	var images []string
+	var originals map[string]string
+	md, err := ArticleMarkdown(article, func(src string) string {
+		name, ok := strings.CutPrefix(src, ArchivedImagePath)
+		if !ok || z.archiver == nil || blobNameRegexp.FindStringSubmatch(name) == nil {
+			return src
+		}
+		if !z.hasImage(name) {
+			if originals == nil {
+				originals = archivedImageRefs(article.Content)
+			}
+			if original := originals[src]; original != "" {
+				return original
+			}
+			return src
+		}
+		images = append(images, name)
+		return "images/" + name
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range images {
+		if err := z.addImage(name); err != nil {
+			return err
+		}
+	}
+
+	filename := MarkdownFilename(article)
+	base := strings.TrimSuffix(filename, ".md")
+	for i := 2; z.names[filename]; i++ {
+		filename = base + " (" + strconv.Itoa(i) + ").md"
+	}
+	z.names[filename] = true
+
+	modified := article.PublishTime
+	if modified.IsZero() {
+		modified = article.CreateTime
+	}
+	w, err := z.zw.CreateHeader(&zip.FileHeader{Name: filename, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, md)
+	return err
+}
+
+// hasImage 检查归档的图片文件是否存在，同一张图片只检查一次
+func (z *MarkdownZip) hasImage(name string) bool {
+	exists, ok := z.exists[name]
+	if !ok {
+		_, err := os.Stat(z.archiver.blobPath(name))
+		exists = err == nil
+		z.exists[name] = exists
+	}
+	return exists
+}
+
+// addImage 写入归档的图片，同一张图片只写一次
+func (z *MarkdownZip) addImage(name string) error {
+	if z.images[name] {
+		return nil
+	}
+	z.images[name] = true
+
+	f, err := os.Open(z.archiver.blobPath(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 图片已经压缩过，不再压缩
+	w, err := z.zw.CreateHeader(&zip.FileHeader{Name: "images/" + name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Close 写入 zip 的目录
+func (z *MarkdownZip) Close() error {
+	return z.zw.Close()
+}
+
+// htmlToMarkdown 把正文 HTML 转换为 Markdown
+func htmlToMarkdown(content string, image func(string) string) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("解析正文失败: %v", err)
+	}
+	// 懒加载图片的地址在 data-src 中
+	rewrite.PromoteImages(func(src string) string {
+		if strings.HasPrefix(src, "//") {
+			src = "https:" + src
+		}
+		if image != nil {
+			src = image(src)
+		}
+		return src
+	})(doc)
+
+	c := &markdownConverter{}
+	var b strings.Builder
+	for _, body := range doc.Find("body").Nodes {
+		b.WriteString(c.children(body))
+	}
+	md := c.normalize(b.String())
+	md = strings.ReplaceAll(md, indent, " ")
+	for i, pre := range c.pres {
+		md = strings.Replace(md, preSentinel+strconv.Itoa(i)+preSentinel, pre, 1)
+	}
+	return md, nil
+}
+
+// markdownConverter 递归转换 HTML 节点。段落的边界用空行表示，最后由 normalize 合并多余的空行
+type markdownConverter struct {
+	pres []string // 代码块的内容，转换完成后替换占位符，不参与空白处理
+}
+
+func (c *markdownConverter) children(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(c.node(child))
+	}
+	return b.String()
+}
+
+func (c *markdownConverter) node(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return markdownEscaper.Replace(collapseSpace(n.Data))
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	tag := strings.ToLower(n.Data)
+	switch {
+	case markdownSkipped[tag]:
+		return ""
+	case markdownBlocks[tag]:
+		return "\n\n" + c.children(n) + "\n\n"
+	}
+
+	switch tag {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := c.inline(n)
+		if text == "" {
+			return ""
+		}
+		return "\n\n" + strings.Repeat("#", int(tag[1]-'0')) + " " + text + "\n\n"
+	case "br":
+		return hardBreak
+	case "hr":
+		return "\n\n---\n\n"
+	case "strong", "b":
+		return c.wrap(n, "**")
+	case "em", "i":
+		return c.wrap(n, "*")
+	case "del", "s", "strike":
+		return c.wrap(n, "~~")
+	case "code":
+		text := collapseSpace(textContent(n))
+		if strings.TrimSpace(text) == "" {
+			return ""
+		}
+		fence := "`"
+		for strings.Contains(text, fence) {
+			fence += "`"
+		}
+		return fence + text + fence
+	case "pre":
+		c.pres = append(c.pres, "```\n"+strings.Trim(preText(n), "\n")+"\n```")
+		return "\n\n" + preSentinel + strconv.Itoa(len(c.pres)-1) + preSentinel + "\n\n"
+	case "a":
+		text := strings.TrimSpace(c.children(n))
+		href := strings.TrimSpace(attr(n, "href"))
+		if text == "" || href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+			return text
+		}
+		return "[" + text + "](" + markdownURL(href) + ")"
+	case "img":
+		src := attr(n, "src")
+		if src == "" || strings.HasPrefix(src, "data:") {
+			return ""
+		}
+		return "![" + markdownEscaper.Replace(collapseSpace(attr(n, "alt"))) + "](" + markdownURL(src) + ")"
+	case "blockquote":
+		lines := strings.Split(c.normalize(c.children(n)), "\n")
+		for i, line := range lines {
+			if line == "" {
+				lines[i] = ">"
+			} else {
+				lines[i] = "> " + line
+			}
+		}
+		return "\n\n" + strings.Join(lines, "\n") + "\n\n"
+	case "ul", "ol":
+		return "\n\n" + c.list(n, tag == "ol") + "\n\n"
+	case "table":
+		return "\n\n" + c.table(n) + "\n\n"
+	}
+	return c.children(n)
+}
+
+// inline 转换为一行文字，用于标题和表格
+func (c *markdownConverter) inline(n *html.Node) string {
+	s := strings.ReplaceAll(c.children(n), hardBreak, " ")
+	return strings.Join(strings.Fields(strings.ReplaceAll(s, "\n", " ")), " ")
+}
+
+// wrap 用强调标记包住内容。标记内侧不能有空白，空白移到标记外
+func (c *markdownConverter) wrap(n *html.Node, mark string) string {
+	s := c.children(n)
+	if strings.Contains(s, "\n") {
+		// 强调中包含段落时不加标记
+		return s
+	}
+	text := strings.TrimSpace(s)
+	if text == "" || text == hardBreak {
+		return s
+	}
+	lead := s[:len(s)-len(strings.TrimLeft(s, " "))]
+	trail := s[len(strings.TrimRight(s, " ")):]
+	return lead + mark + text + mark + trail
+}
+
+// list 转换列表，列表项中换行的内容按标记的宽度缩进
+func (c *markdownConverter) list(n *html.Node, ordered bool) string {
+	var items []string
+	num := 1
+	if ordered {
+		if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+			num = start
+		}
+	}
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || strings.ToLower(li.Data) != "li" {
+			continue
+		}
+		marker := "- "
+		if ordered {
+			marker = strconv.Itoa(num) + ". "
+			num++
+		}
+		lines := strings.Split(c.normalize(c.children(li)), "\n")
+		for i := 1; i < len(lines); i++ {
+			if lines[i] != "" {
+				lines[i] = strings.Repeat(indent, utf8.RuneCountInString(marker)) + lines[i]
+			}
+		}
+		items = append(items, marker+strings.Join(lines, "\n"))
+	}
+	return strings.Join(items, "\n")
+}
+
+// table 转换为 GFM 表格，第一行作为表头
+func (c *markdownConverter) table(n *html.Node) string {
+	var rows [][]string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch strings.ToLower(child.Data) {
+			case "tr":
+				var row []string
+				for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.Data == "td" || cell.Data == "th") {
+						row = append(row, strings.ReplaceAll(c.inline(cell), "|", `\|`))
+					}
+				}
+				if len(row) > 0 {
+					rows = append(rows, row)
+				}
+			case "thead", "tbody", "tfoot":
+				walk(child)
+			}
+		}
+	}
+	walk(n)
+	if len(rows) == 0 {
+		return ""
+	}
+
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row))
+	}
+	lines := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		for len(row) < width {
+			row = append(row, "")
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", width))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// normalize 整理转换结果：去掉行首尾的空白，换行改为 Markdown 的硬换行，合并连续的空行
+func (c *markdownConverter) normalize(s string) string {
+	s = strings.ReplaceAll(s, hardBreak, "\\\n")
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Trim(line, " \t")
+	}
+	for i, line := range lines {
+		// 段落末尾和空行中的硬换行没有意义，例如公众号常用的 <p><br></p>
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") && (i+1 == len(lines) || lines[i+1] == "" || lines[i+1] == "\\") {
+			lines[i] = strings.TrimRight(strings.TrimSuffix(line, "\\"), " \t")
+		}
+	}
+	s = strings.Join(lines, "\n")
+	s = blankLinesRegexp.ReplaceAllString(s, "\n\n")
+	return strings.Trim(s, "\n")
+}
+
+// collapseSpace 把连续的空白（包括 &nbsp;）合并为一个空格
+func collapseSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// textContent 节点中的文字，<br> 转换为换行，用于代码块
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(strings.ReplaceAll(n.Data, "\u00a0", " "))
+		case n.Type == html.ElementNode && n.Data == "br":
+			b.WriteByte('\n')
+		default:
+			for child := n.FirstChild; child != nil; child = child.NextSibling {
+				walk(child)
+			}
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+// preText 代码块的文字。公众号的代码块中每行是一个 <code>
+func preText(n *html.Node) string {
+	var lines []string
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || child.Data != "code" {
+			return textContent(n)
+		}
+		lines = append(lines, textContent(child))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// markdownURL 转义链接中的空格和括号
+func markdownURL(u string) string {
+	return strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29").Replace(strings.TrimSpace(u))
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+func TestArticleMarkdown(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "article_content.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "article_content.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := ArticleMarkdown(&model.Article{
+		ID:          "wx_1",
+		Title:       `标题: "引号"`,
+		Author:      "作者",
+		Topic:       "主题",
+		URL:         "https://mp.weixin.qq.com/s/abc",
+		PublishTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CST", 8*3600)),
+		Content:     string(content),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md != string(want) {
+		t.Errorf("ArticleMarkdown =\n%s\nwant\n%s", md, want)
+	}
+}
+
+func TestMarkdownZip(t *testing.T) {
+	archiver := NewImageArchiver(t.TempDir(), nil)
+	name, err := archiver.save(bytes.NewReader(testPNG), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := `<p><img src="` + ArchivedImagePath + name + `"></p>`
+
+	var buf bytes.Buffer
+	z := NewMarkdownZip(&buf, archiver)
+	for _, article := range []model.Article{
+		{ID: "a", Title: "同名/文章", Content: content},
+		{ID: "b", Title: "同名/文章", Content: content},
+		{ID: "c", Title: ""},
+	} {
+		if err := z.Add(&article); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	wantNames := "images/" + name + ",同名 文章.md,同名 文章 (2).md,c.md"
+	if got := strings.Join(names, ","); got != wantNames {
+		t.Errorf("files = %s, want %s", got, wantNames)
+	}
+	if !strings.Contains(files["同名 文章.md"], "![](images/"+name+")") {
+		t.Errorf("image not referenced locally:\n%s", files["同名 文章.md"])
+	}
+	if files["images/"+name] != string(testPNG) {
+		t.Errorf("image content mismatch")
+	}
+}
+
+func TestMarkdownZipMissingImage(t *testing.T) {
+	archiver := NewImageArchiver(t.TempDir(), nil)
+	const missing = "0000000000000000000000000000000000000000000000000000000000000000.png"
+	const original = "https://mmbiz.qpic.cn/mmbiz_png/abc/640"
+	article := &model.Article{ID: "a", Title: "图片已删除",
+		Content: `<p><img src="` + ArchivedImagePath + missing + `" data-original-src="` + original + `"></p>`}
+
+	var buf bytes.Buffer
+	z := NewMarkdownZip(&buf, archiver)
+	if err := z.Add(article); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 图片文件不存在时不写入 images，改为引用原链接
+	if len(zr.File) != 1 || zr.File[0].Name != "图片已删除.md" {
+		t.Fatalf("files = %v", zr.File)
+	}
+	rc, _ := zr.File[0].Open()
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if !strings.Contains(string(data), "![]("+original+")") {
+		t.Errorf("image not linked to the original URL:\n%s", data)
+	}
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 出站请求统计，通过 /debug/vars 查看
+var outboundStats = expvar.NewMap("outbound")
+
+// Limit 单个域名的令牌桶参数
+type Limit struct {
+	Rate  float64 // 每秒补充的令牌数
+	Burst int     // 桶容量
+}
+
+// PolicyConfig 出站请求策略
+type PolicyConfig struct {
+	// DefaultLimit 未在 HostLimits 中配置的域名使用的限速
+	DefaultLimit Limit
+	// HostLimits 按域名配置的限速
+	HostLimits map[string]Limit
+	// MaxAttempts 单个请求最多尝试的次数，包含第一次
+	MaxAttempts int
+	// BaseDelay 和 MaxDelay 控制指数退避的范围
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// RetryRetCodes 需要重试的 base_resp.ret，一般是微信的频率限制
+	RetryRetCodes []int
+}
+
+// DefaultPolicyConfig 默认策略：公众号页面和接口每 2 秒一个请求，图片域名放宽
+func DefaultPolicyConfig() PolicyConfig {
+	return PolicyConfig{
+		DefaultLimit: Limit{Rate: 10, Burst: 20},
+		HostLimits: map[string]Limit{
+			"mp.weixin.qq.com": {Rate: 0.5, Burst: 2},
+		},
+		MaxAttempts:   4,
+		BaseDelay:     time.Second,
+		MaxDelay:      30 * time.Second,
+		RetryRetCodes: []int{200013},
+	}
+}
+
+// InteractivePolicyConfig 用户打开页面时代理请求使用的策略。与抓取使用不同的 Policy，
+// 令牌桶相互独立，不会排在批量抓取的请求后面；重试次数少、等待时间短，不让浏览器长时间等待
+func InteractivePolicyConfig() PolicyConfig {
+	return PolicyConfig{
+		DefaultLimit: Limit{Rate: 20, Burst: 40},
+		HostLimits: map[string]Limit{
+			"mp.weixin.qq.com": {Rate: 2, Burst: 10},
+		},
+		MaxAttempts:   2,
+		BaseDelay:     500 * time.Millisecond,
+		MaxDelay:      2 * time.Second,
+		RetryRetCodes: []int{200013},
+	}
+}
+
+// Policy 对所有发往微信的请求统一限速和重试，实现了 Fetcher
+type Policy struct {
+	fetcher Fetcher
+	config  PolicyConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewPolicy 用 fetcher 发送请求，按 config 限速和重试
+func NewPolicy(fetcher Fetcher, config PolicyConfig) *Policy {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+	return &Policy{
+		fetcher: fetcher,
+		config:  config,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Do 等待令牌后发送请求，遇到 5xx、超时或频率限制时按指数退避重试。
+// 只有没有请求体的请求会重试
+func (p *Policy) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Hostname()
+	retryable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	for attempt := 1; ; attempt++ {
+		if err := p.bucket(host).wait(ctx); err != nil {
+			return nil, err
+		}
+
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		outboundStats.Add("requests", 1)
+		resp, err := p.fetcher.Do(req)
+		reason, retryAfter := p.shouldRetry(resp, err)
+		if reason == "" {
+			if err != nil {
+				outboundStats.Add("errors", 1)
+			}
+			return resp, err
+		}
+
+		if !retryable || attempt >= p.config.MaxAttempts {
+			outboundStats.Add("exhausted", 1)
+			slog.WarnContext(ctx, "请求重试后仍然失败", "url", req.URL.Redacted(), "attempts", attempt, "reason", reason)
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		delay := p.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		outboundStats.Add("retries", 1)
+		slog.InfoContext(ctx, "请求失败，稍后重试", "url", req.URL.Redacted(), "reason", reason, "delay", delay.Round(time.Millisecond), "attempt", attempt)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// shouldRetry 返回重试原因，不需要重试时返回空字符串
+func (p *Policy) shouldRetry(resp *http.Response, err error) (string, time.Duration) {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return "请求超时", 0
+		}
+		return "", 0
+	}
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Sprintf("状态码 %d", resp.StatusCode), retryAfter(resp)
+	}
+
+	if len(p.config.RetryRetCodes) > 0 && strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		if ret, ok := peekRetCode(resp); ok {
+			for _, code := range p.config.RetryRetCodes {
+				if ret == code {
+					return fmt.Sprintf("ret %d", ret), 0
+				}
+			}
+		}
+	}
+
+	return "", 0
+}
+
+// backoff 第 attempt 次失败后的等待时间，带随机抖动
+func (p *Policy) backoff(attempt int) time.Duration {
+	delay := p.config.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.config.MaxDelay {
+		delay = p.config.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// 在 [delay/2, delay) 之间随机，避免多个请求同时重试
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (p *Policy) bucket(host string) *tokenBucket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.buckets[host]
+	if !ok {
+		limit, ok := p.config.HostLimits[host]
+		if !ok {
+			limit = p.config.DefaultLimit
+		}
+		b = newTokenBucket(limit)
+		p.buckets[host] = b
+	}
+	return b
+}
+
+// maxRetCodeBody 检查 base_resp.ret 时最多读取的响应体大小，
+// 错误响应都很短，超过的直接放行
+const maxRetCodeBody = 4 << 10
+
+// peekRetCode 读取 JSON 响应中的 base_resp.ret，响应体读取后恢复原样
+func peekRetCode(resp *http.Response) (int, bool) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRetCodeBody+1))
+	if len(body) > maxRetCodeBody {
+		// 响应较大，把读出的前缀接回去，剩余部分继续流式读取
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return 0, false
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0, false
+	}
+
+	var result struct {
+		BaseResp *struct {
+			Ret int `json:"ret"`
+		} `json:"base_resp"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.BaseResp == nil {
+		return 0, false
+	}
+	return result.BaseResp.Ret, true
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+// tokenBucket 令牌桶限速器
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit Limit) *tokenBucket {
+	if limit.Burst <= 0 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// wait 阻塞直到取得一个令牌或 ctx 结束
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b.limit.Rate <= 0 {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+		if b.tokens > float64(b.limit.Burst) {
+			b.tokens = float64(b.limit.Burst)
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+		b.mu.Unlock()
+
+		outboundStats.Add("throttled", 1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
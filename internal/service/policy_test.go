@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPolicyConfig() PolicyConfig {
+	return PolicyConfig{
+		MaxAttempts:   3,
+		BaseDelay:     time.Millisecond,
+		MaxDelay:      5 * time.Millisecond,
+		RetryRetCodes: []int{200013},
+	}
+}
+
+func TestPolicyRetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	policy := NewPolicy(server.Client(), testPolicyConfig())
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := policy.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got %d %q, want 200 ok", resp.StatusCode, body)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("server called %d times, want 3", calls.Load())
+	}
+}
+
+func TestPolicyGivesUpAfterMaxAttempts(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	policy := NewPolicy(server.Client(), testPolicyConfig())
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := policy.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the last 503", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("server called %d times, want 3", calls.Load())
+	}
+}
+
+func TestPolicyRetriesRetCodes(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if calls.Add(1) == 1 {
+			w.Write([]byte(`{"base_resp":{"ret":200013}}`))
+			return
+		}
+		w.Write([]byte(`{"base_resp":{"ret":0}}`))
+	}))
+	defer server.Close()
+
+	policy := NewPolicy(server.Client(), testPolicyConfig())
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := policy.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 检查 ret 后响应体仍然完整
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != `{"base_resp":{"ret":0}}` {
+		t.Errorf("body = %q", body)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("server called %d times, want 2", calls.Load())
+	}
+}
+
+func TestPolicyPassesLargeJSONThrough(t *testing.T) {
+	var calls atomic.Int32
+	large := `{"base_resp":{"ret":200013},"pad":"` + strings.Repeat("x", maxRetCodeBody) + `"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(large))
+	}))
+	defer server.Close()
+
+	policy := NewPolicy(server.Client(), testPolicyConfig())
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := policy.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 超过上限的响应不检查 ret，读出的前缀接回后响应体仍然完整
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != large {
+		t.Errorf("body length = %d, want %d", len(body), len(large))
+	}
+	if calls.Load() != 1 {
+		t.Errorf("server called %d times, want 1", calls.Load())
+	}
+}
+
+func TestPolicyDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	policy := NewPolicy(server.Client(), testPolicyConfig())
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := policy.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if calls.Load() != 1 {
+		t.Errorf("server called %d times, want 1", calls.Load())
+	}
+}
+
+func TestTokenBucketThrottles(t *testing.T) {
+	b := newTokenBucket(Limit{Rate: 100, Burst: 1})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := b.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 第一个令牌立即可用，后两个各需要约 10ms
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("3 tokens took %v, want at least ~20ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b = newTokenBucket(Limit{Rate: 0.001, Burst: 1})
+	b.wait(ctx)
+	if err := b.wait(ctx); err != context.Canceled {
+		t.Errorf("wait on cancelled context = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 发往上游的 Accept-Encoding。br 需要第三方库才能解压，不向上游请求
+const upstreamAcceptEncoding = "gzip, deflate"
+
+// errUnsupportedEncoding 需要解压但不支持响应的压缩格式
+var errUnsupportedEncoding = errors.New("不支持的压缩格式")
+
+// ProxyConfig 反向代理的配置
+type ProxyConfig struct {
+	// RequestHeader 发往上游时设置的请求头，例如 User-Agent 和 Referer
+	RequestHeader http.Header
+	// ResponseHeader 返回给浏览器时设置的响应头，例如 X-Frame-Options
+	ResponseHeader http.Header
+	// MaxBodyBytes 解压后响应体的大小上限，超过时中断响应
+	MaxBodyBytes int64
+}
+
+// BodyRewriter 修改上游返回的正文，rewrite.Rewriter 实现了该接口
+type BodyRewriter interface {
+	Rewrite(w io.Writer, r io.Reader) error
+}
+
+// Proxy 基于 httputil.ReverseProxy 把浏览器的请求转发到微信，响应体边读边写，不在内存中缓存。
+// 上游请求通过 fetcher 发送，可以叠加缓存、限速和出站限制。
+// Range 请求原样转发；浏览器不支持上游的压缩格式或需要修改正文时先解压
+type Proxy struct {
+	config ProxyConfig
+	rp     *httputil.ReverseProxy
+}
+
+// forwardKey 在 context 中传递本次转发的目标和替换规则
+type forwardKey struct{}
+
+type forward struct {
+	target   *url.URL
+	header   http.Header // 浏览器原始的请求头
+	rewriter BodyRewriter
+}
+
+// NewProxy 创建反向代理，上游请求由 fetcher 发送
+func NewProxy(fetcher Fetcher, config ProxyConfig) *Proxy {
+	p := &Proxy{config: config}
+	p.rp = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      fetcherTransport{fetcher},
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleError,
+		FlushInterval:  100 * time.Millisecond,
+	}
+	return p
+}
+
+// Forward 把请求转发到 target
+func (p *Proxy) Forward(w http.ResponseWriter, r *http.Request, target string) {
+	p.forward(w, r, target, nil)
+}
+
+// ForwardRewrite 把请求转发到 target，并用 rewriter 修改成功返回的正文。修改需要完整的正文，
+// 此时读取完整的响应后再返回，不转发 Range，ETag 由修改后的内容计算
+func (p *Proxy) ForwardRewrite(w http.ResponseWriter, r *http.Request, target string, rewriter BodyRewriter) {
+	p.forward(w, r, target, rewriter)
+}
+
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, target string, rewriter BodyRewriter) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		http.Error(w, "无效的地址", http.StatusBadRequest)
+		return
+	}
+	f := &forward{target: u, header: r.Header.Clone(), rewriter: rewriter}
+	p.rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardKey{}, f)))
+}
+
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	f := pr.In.Context().Value(forwardKey{}).(*forward)
+	out := pr.Out
+	out.URL = f.target
+	out.Host = f.target.Host
+	out.RequestURI = ""
+
+	// 浏览器的 Cookie 和认证信息属于本服务，不发给微信
+	out.Header.Del("Cookie")
+	out.Header.Del("Authorization")
+	out.Header.Del("Origin")
+	for k, v := range p.config.RequestHeader {
+		out.Header[k] = v
+	}
+	// 固定上游的压缩格式，缓存的响应对所有浏览器通用
+	out.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+
+	// 条件请求在收到完整响应后由 notModified 判断，上游总是返回完整内容，可以写入缓存
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if f.rewriter != nil {
+		out.Header.Del("Range")
+		out.Header.Del("If-Range")
+	}
+}
+
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	f := resp.Request.Context().Value(forwardKey{}).(*forward)
+	resp.Header.Del("Set-Cookie")
+
+	hasBody := resp.Request.Method != http.MethodHead && resp.StatusCode != http.StatusNotModified && resp.StatusCode != http.StatusNoContent
+	rewrite := f.rewriter != nil && hasBody && resp.StatusCode == http.StatusOK
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		encoding = ""
+	}
+
+	if hasBody && encoding != "" && (rewrite || !acceptsEncoding(f.header.Get("Accept-Encoding"), encoding)) {
+		if err := decodeBody(resp, encoding); err != nil {
+			return err
+		}
+	}
+	if max := p.config.MaxBodyBytes; max > 0 && hasBody {
+		if resp.Header.Get("Content-Encoding") == "" && resp.ContentLength > max {
+			return fmt.Errorf("%w: %d 字节", ErrResponseTooLarge, resp.ContentLength)
+		}
+		resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: max}
+	}
+
+	if rewrite {
+		var buf bytes.Buffer
+		err := f.rewriter.Rewrite(&buf, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(&buf)
+		resp.ContentLength = int64(buf.Len())
+		resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+		resp.Header.Del("Accept-Ranges")
+		// 内容未变时浏览器的条件请求返回 304
+		sum := sha256.Sum256(buf.Bytes())
+		resp.Header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	}
+
+	for k, v := range p.config.ResponseHeader {
+		resp.Header[k] = v
+	}
+
+	if resp.StatusCode == http.StatusOK && notModified(f.header, resp) {
+		resp.Body.Close()
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 Not Modified"
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		for _, h := range []string{"Content-Length", "Content-Encoding", "Content-Type"} {
+			resp.Header.Del(h)
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	if errors.Is(err, ErrEgressDenied) {
+		status = http.StatusForbidden
+	}
+	if !errors.Is(err, context.Canceled) {
+		f := r.Context().Value(forwardKey{}).(*forward)
+		slog.WarnContext(r.Context(), "代理请求失败", "url", f.target.Redacted(), "error", err)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// fetcherTransport 把 Fetcher 用作 http.RoundTripper
+type fetcherTransport struct {
+	fetcher Fetcher
+}
+
+func (t fetcherTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.fetcher.Do(req)
+}
+
+// acceptsEncoding 判断浏览器的 Accept-Encoding 是否包含 encoding
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(name), encoding) || name == "*" {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// decodeBody 解压响应体，解压后的长度未知
+func decodeBody(resp *http.Response, encoding string) error {
+	body := resp.Body
+	var r io.Reader
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("解压响应失败: %v", err)
+		}
+		r = zr
+	case "deflate":
+		// HTTP 的 deflate 应为 zlib 格式，也有服务器直接返回原始 deflate 数据
+		br := bufio.NewReader(body)
+		if head, err := br.Peek(2); err == nil && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 && head[0]&0x0f == 8 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return fmt.Errorf("解压响应失败: %v", err)
+			}
+			r = zr
+		} else {
+			r = flate.NewReader(br)
+		}
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{r, body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return nil
+}
+
+// notModified 判断浏览器的条件请求是否命中。If-None-Match 存在时忽略 If-Modified-Since
+func notModified(header http.Header, resp *http.Response) bool {
+	if inm := header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(resp.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/service/rewrite"
+)
+
+// newTestProxy 启动一个通过 Proxy 转发到 upstream 的服务，返回服务地址
+func newTestProxy(t *testing.T, upstream *httptest.Server, config ProxyConfig, rewriter BodyRewriter) string {
+	t.Helper()
+	p := NewProxy(upstream.Client(), config)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rewriter != nil {
+			p.ForwardRewrite(w, r, upstream.URL+r.URL.Path, rewriter)
+			return
+		}
+		p.Forward(w, r, upstream.URL+r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func proxyGet(t *testing.T, url string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// 不使用 Transport 的自动解压，检查代理返回的原始响应
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestProxyContentEncoding(t *testing.T) {
+	compressed := gzipBytes(t, []byte("hello world"))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != upstreamAcceptEncoding {
+			t.Errorf("upstream Accept-Encoding = %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Set-Cookie", "session=1")
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "1")
+		w.Write(compressed)
+	}))
+	defer upstream.Close()
+	url := newTestProxy(t, upstream, ProxyConfig{}, nil)
+
+	// 浏览器支持 gzip 时原样转发
+	resp, body := proxyGet(t, url, http.Header{"Accept-Encoding": {"gzip, br"}})
+	if resp.Header.Get("Content-Encoding") != "gzip" || body != string(compressed) {
+		t.Errorf("gzip client got Content-Encoding %q, body %q", resp.Header.Get("Content-Encoding"), body)
+	}
+	// 浏览器不支持时解压
+	resp, body = proxyGet(t, url, http.Header{"Accept-Encoding": {"gzip;q=0"}})
+	if resp.Header.Get("Content-Encoding") != "" || body != "hello world" {
+		t.Errorf("identity client got Content-Encoding %q, body %q", resp.Header.Get("Content-Encoding"), body)
+	}
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("X-Internal") != "" {
+		t.Errorf("Set-Cookie or hop-by-hop header forwarded: %v", resp.Header)
+	}
+}
+
+func TestProxyForwardsRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "" {
+			t.Errorf("Cookie forwarded to upstream: %q", r.Header.Get("Cookie"))
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+	url := newTestProxy(t, upstream, ProxyConfig{}, nil)
+
+	resp, body := proxyGet(t, url, http.Header{"Range": {"bytes=10-19"}, "Cookie": {"token=1"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "0123456789" {
+		t.Errorf("range got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Range") != "bytes 10-19/100" {
+		t.Errorf("Content-Range = %q", resp.Header.Get("Content-Range"))
+	}
+}
+
+func TestProxyRewritesBody(t *testing.T) {
+	page := `<html><head></head><body class="zh_CN"><img data-src="https://mmbiz.qpic.cn/a.png"></body></html>`
+	compressed := gzipBytes(t, []byte(page))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			t.Errorf("Range forwarded when rewriting: %q", r.Header.Get("Range"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed)
+	}))
+	defer upstream.Close()
+	url := newTestProxy(t, upstream, ProxyConfig{
+		ResponseHeader: http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+	}, rewrite.New(
+		rewrite.PromoteImages(rewrite.ProxyURL(nil)),
+		rewrite.InjectBody(`<a>open</a>`),
+	))
+
+	want := `<html><head></head><body class="zh_CN"><a>open</a><img src="/wx-images/a.png"/></body></html>`
+	resp, body := proxyGet(t, url, http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}})
+	if resp.StatusCode != http.StatusOK || body != want {
+		t.Errorf("got %d %q, want %q", resp.StatusCode, body, want)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("unexpected headers %v", resp.Header)
+	}
+
+	// 内容未变时返回 304
+	etag := resp.Header.Get("ETag")
+	resp, body = proxyGet(t, url, http.Header{"If-None-Match": {etag}})
+	if etag == "" || resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("conditional request with ETag %q got %d %q", etag, resp.StatusCode, body)
+	}
+}
+
+func TestProxyMaxBodyBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer upstream.Close()
+	url := newTestProxy(t, upstream, ProxyConfig{MaxBodyBytes: 10}, nil)
+
+	if resp, _ := proxyGet(t, url, nil); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+}
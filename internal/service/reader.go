@@ -0,0 +1,83 @@
+package service
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/service/rewrite"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ReaderCSP 阅读视图的 Content-Security-Policy：不执行任何脚本，只加载本服务的图片
+const ReaderCSP = "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'; base-uri 'none'; form-action 'none'; frame-ancestors 'self'"
+
+// readerRewriter 把保存的正文整理为阅读视图：图片经由代理，删除样式、脚本和白名单以外的内容，链接在新窗口打开
+var readerRewriter = rewrite.New(
+	rewrite.PromoteImages(rewrite.ProxyURL(nil)),
+	rewrite.Sanitize(rewrite.ArticlePolicy()),
+	func(doc *goquery.Document) {
+		doc.Find("a[href]").Not(`[href^="#"]`).SetAttr("target", "_blank").SetAttr("rel", "noopener noreferrer")
+	},
+)
+
+var readerTemplate = template.Must(template.New("reader").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="referrer" content="no-referrer">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0; background: #fff; color: #333; font: 17px/1.8 -apple-system, "PingFang SC", "Hiragino Sans GB", "Microsoft YaHei", sans-serif; }
+article { max-width: 680px; margin: 0 auto; padding: 32px 20px 64px; }
+h1 { font-size: 24px; line-height: 1.4; margin: 0 0 12px; color: #111; }
+.meta { color: #888; font-size: 14px; margin-bottom: 32px; }
+.meta span + span::before { content: "·"; margin: 0 8px; }
+.content p, .content section { margin: 0 0 1em; }
+.content section section, .content p section { margin: 0; }
+.content img { display: block; max-width: 100%; height: auto; margin: 1em auto; }
+.content a { color: #576b95; text-decoration: none; }
+.content blockquote { margin: 1em 0; padding: 0 1em; border-left: 3px solid #ddd; color: #666; }
+.content pre { overflow-x: auto; padding: 12px; background: #f6f8fa; font-size: 14px; line-height: 1.5; }
+.content table { border-collapse: collapse; max-width: 100%; overflow-x: auto; display: block; }
+.content th, .content td { border: 1px solid #ddd; padding: 6px 10px; }
+.original { margin-top: 48px; font-size: 14px; }
+.original a { color: #576b95; }
+</style>
+</head>
+<body>
+<article>
+<h1>{{.Title}}</h1>
+<div class="meta">
+{{- with .Account}}<span>{{.}}</span>{{end}}
+{{- with .Author}}<span>{{.}}</span>{{end}}
+{{- if not .PublishTime.IsZero}}<span>{{.PublishTime.Format "2006-01-02 15:04"}}</span>{{end -}}
+</div>
+<div class="content">{{.Content}}</div>
+{{- with .URL}}
+<p class="original"><a href="{{.}}" target="_blank" rel="noopener noreferrer">阅读原文</a></p>
+{{- end}}
+</article>
+</body>
+</html>
+`))
+
+// RenderReader 把文章保存的正文渲染为阅读视图：只有标题、元信息和清理后的正文，排版由本服务的样式决定。
+// 响应需要带上 ReaderCSP
+func RenderReader(w io.Writer, article *model.Article) error {
+	content, err := readerRewriter.Fragment(article.Content)
+	if err != nil {
+		return err
+	}
+
+	if err := readerTemplate.Execute(w, struct {
+		*model.Article
+		Content template.HTML
+	}{article, template.HTML(content)}); err != nil {
+		return fmt.Errorf("渲染阅读视图失败: %v", err)
+	}
+	return nil
+}
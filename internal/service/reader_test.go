@@ -0,0 +1,44 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+func TestRenderReader(t *testing.T) {
+	article := &model.Article{
+		Title:       "标题 <script>alert(1)</script>",
+		Account:     "公众号",
+		URL:         "https://mp.weixin.qq.com/s/abc",
+		PublishTime: time.Date(2024, 1, 2, 3, 4, 0, 0, time.Local),
+		Content: `<section style="color: red;"><p>正文</p>` +
+			`<img data-src="https://mmbiz.qpic.cn/mmbiz_png/abc/640?wx_fmt=png">` +
+			`<img src="https://stat.example.com/pixel.gif">` +
+			`<script>track()</script><a href="https://example.com/">链接</a></section>`,
+	}
+
+	var buf bytes.Buffer
+	if err := RenderReader(&buf, article); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"<title>标题 &lt;script&gt;alert(1)&lt;/script&gt;</title>",
+		"<span>公众号</span><span>2024-01-02 03:04</span>",
+		`<section><p>正文</p><img src="/wx-images/mmbiz_png/abc/640?wx_fmt=png"/><a href="https://example.com/" target="_blank" rel="noopener noreferrer">链接</a></section>`,
+		`<a href="https://mp.weixin.qq.com/s/abc" target="_blank" rel="noopener noreferrer">阅读原文</a>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"<script", "stat.example.com", "color: red"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output contains %q", unwanted)
+		}
+	}
+}
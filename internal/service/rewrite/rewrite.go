@@ -0,0 +1,262 @@
+// Package rewrite 解析公众号文章的 HTML 并按顺序执行一组修改：提升懒加载图片的地址、改写链接、
+// 删除脚本和注入样式。代理页面和已保存的正文使用同一套修改
+package rewrite
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// 经由本服务代理的微信域名和对应的路径前缀
+var proxyPrefixes = map[string]string{
+	"mmbiz.qpic.cn":    "/wx-images",
+	"mmbiz.qlogo.cn":   "/wx-qim",
+	"mp.weixin.qq.com": "/wx-mp",
+}
+
+// CSS 中的 url(...)，引号可有可无
+var cssURLRegexp = regexp.MustCompile(`(?i)url\(\s*(['"]?)([^'")]*)(['"]?)\s*\)`)
+
+// Pass 对解析后的文档做一项修改
+type Pass func(doc *goquery.Document)
+
+// Rewriter 依次执行一组 Pass
+type Rewriter struct {
+	passes []Pass
+}
+
+// New 创建按 passes 顺序修改文档的 Rewriter
+func New(passes ...Pass) *Rewriter {
+	return &Rewriter{passes: passes}
+}
+
+// Rewrite 解析完整的页面，修改后写入 w
+func (r *Rewriter) Rewrite(w io.Writer, src io.Reader) error {
+	doc, err := goquery.NewDocumentFromReader(src)
+	if err != nil {
+		return fmt.Errorf("解析HTML失败: %w", err)
+	}
+	r.apply(doc)
+	html, err := goquery.OuterHtml(doc.Selection)
+	if err != nil {
+		return fmt.Errorf("生成HTML失败: %v", err)
+	}
+	_, err = io.WriteString(w, html)
+	return err
+}
+
+// Fragment 修改正文片段，例如保存的 Article.Content，返回 body 内的 HTML
+func (r *Rewriter) Fragment(content string) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("解析正文失败: %v", err)
+	}
+	r.apply(doc)
+	html, err := doc.Find("body").Html()
+	if err != nil {
+		return "", fmt.Errorf("生成正文失败: %v", err)
+	}
+	return html, nil
+}
+
+func (r *Rewriter) apply(doc *goquery.Document) {
+	for _, pass := range r.passes {
+		pass(doc)
+	}
+}
+
+// ImageURL 返回 <img> 实际显示的图片地址。微信文章的图片地址在 data-src 中，src 通常为空或占位图
+func ImageURL(img *goquery.Selection) string {
+	for _, attr := range []string{"data-src", "src"} {
+		if src := strings.TrimSpace(img.AttrOr(attr, "")); src != "" && !strings.HasPrefix(src, "data:") {
+			return src
+		}
+	}
+	return strings.TrimSpace(img.AttrOr("src", ""))
+}
+
+// ProxyURL 返回把微信图片和文章地址改为本服务代理路径的函数，其他地址不变。
+// base 不为空时先按 base 解析相对地址和省略协议的地址
+func ProxyURL(base *url.URL) func(string) string {
+	return func(raw string) string {
+		// 页内锚点和空地址保持不变
+		if trimmed := strings.TrimSpace(raw); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			return raw
+		}
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil {
+			return raw
+		}
+		if base != nil {
+			u = base.ResolveReference(u)
+		} else if u.Scheme == "" && u.Host != "" {
+			u.Scheme = "https"
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return raw
+		}
+		prefix, ok := proxyPrefixes[strings.ToLower(u.Hostname())]
+		if !ok || (u.Port() != "" && u.Port() != "80" && u.Port() != "443") {
+			return raw
+		}
+		target := prefix + u.EscapedPath()
+		if !strings.HasPrefix(target, prefix+"/") {
+			target = prefix + "/"
+		}
+		if u.RawQuery != "" {
+			target += "?" + u.RawQuery
+		}
+		if u.Fragment != "" {
+			target += "#" + u.EscapedFragment()
+		}
+		return target
+	}
+}
+
+// PromoteImages 把懒加载图片的 data-src 提升为 src，并用 mapURL 改写 <img> 的 src 和 srcset、
+// <video> 的封面，以及 style 属性和 <style> 中 CSS 引用的图片
+func PromoteImages(mapURL func(string) string) Pass {
+	return func(doc *goquery.Document) {
+		doc.Find("img").Each(func(_ int, img *goquery.Selection) {
+			if src := ImageURL(img); src != "" {
+				img.SetAttr("src", mapURL(src))
+			}
+			img.RemoveAttr("data-src")
+			for _, attr := range []string{"data-srcset", "srcset"} {
+				if srcset, ok := img.Attr(attr); ok {
+					img.SetAttr("srcset", rewriteSrcset(srcset, mapURL))
+				}
+			}
+			img.RemoveAttr("data-srcset")
+		})
+
+		doc.Find("video").Each(func(_ int, video *goquery.Selection) {
+			poster := strings.TrimSpace(video.AttrOr("data-poster", ""))
+			if poster == "" {
+				poster = strings.TrimSpace(video.AttrOr("poster", ""))
+			}
+			if poster != "" {
+				video.SetAttr("poster", mapURL(poster))
+			}
+			video.RemoveAttr("data-poster")
+		})
+
+		doc.Find("[style]").Each(func(_ int, s *goquery.Selection) {
+			s.SetAttr("style", rewriteCSS(s.AttrOr("style", ""), mapURL))
+		})
+		doc.Find("style").Each(func(_ int, s *goquery.Selection) {
+			for _, node := range s.Nodes {
+				if child := node.FirstChild; child != nil && child.NextSibling == nil {
+					child.Data = rewriteCSS(child.Data, mapURL)
+				}
+			}
+		})
+	}
+}
+
+// RewriteLinks 用 mapURL 改写 <a> 和 <area> 的链接
+func RewriteLinks(mapURL func(string) string) Pass {
+	return func(doc *goquery.Document) {
+		doc.Find("a[href], area[href]").Each(func(_ int, a *goquery.Selection) {
+			a.SetAttr("href", mapURL(a.AttrOr("href", "")))
+		})
+	}
+}
+
+// StripScripts 删除 <script>、插件、自动跳转的 <meta refresh>、事件处理属性、<iframe srcdoc>、
+// 表单的提交地址，以及 javascript:、vbscript: 和 data:text/html 链接
+func StripScripts() Pass {
+	return func(doc *goquery.Document) {
+		doc.Find("script, object, embed, applet").Remove()
+		doc.Find("meta[http-equiv]").Each(func(_ int, s *goquery.Selection) {
+			if strings.EqualFold(strings.TrimSpace(s.AttrOr("http-equiv", "")), "refresh") {
+				s.Remove()
+			}
+		})
+		doc.Find("*").Each(func(_ int, s *goquery.Selection) {
+			for _, node := range s.Nodes {
+				attrs := node.Attr[:0]
+				for _, attr := range node.Attr {
+					switch key := strings.ToLower(attr.Key); {
+					case strings.HasPrefix(key, "on"), key == "srcdoc", key == "action", key == "formaction":
+						continue
+					case scriptURL(key, attr.Val):
+						continue
+					}
+					attrs = append(attrs, attr)
+				}
+				node.Attr = attrs
+			}
+		})
+	}
+}
+
+// InjectHead 在 <head> 开头插入 HTML，页面没有 <head> 时解析器会补上
+func InjectHead(html string) Pass {
+	return func(doc *goquery.Document) {
+		doc.Find("head").First().PrependHtml(html)
+	}
+}
+
+// InjectStyle 在 <head> 开头插入样式表
+func InjectStyle(css string) Pass {
+	return InjectHead("<style>" + css + "</style>")
+}
+
+// InjectBody 在 <body> 开头插入 HTML，<body> 带属性时同样有效
+func InjectBody(html string) Pass {
+	return func(doc *goquery.Document) {
+		doc.Find("body").First().PrependHtml(html)
+	}
+}
+
+// rewriteSrcset 改写 srcset 中每个候选图片的地址，保留宽度和像素密度描述
+func rewriteSrcset(srcset string, mapURL func(string) string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, candidate := range candidates {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		fields[0] = mapURL(fields[0])
+		candidates[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// rewriteCSS 改写 CSS 中 url(...) 引用的地址
+func rewriteCSS(css string, mapURL func(string) string) string {
+	if !strings.Contains(strings.ToLower(css), "url(") {
+		return css
+	}
+	return cssURLRegexp.ReplaceAllStringFunc(css, func(m string) string {
+		parts := cssURLRegexp.FindStringSubmatch(m)
+		if parts[1] != parts[3] {
+			return m
+		}
+		return "url(" + parts[1] + mapURL(parts[2]) + parts[3] + ")"
+	})
+}
+
+// scriptURL 判断属性是否为会执行脚本的地址：javascript:、vbscript: 或 data:text/html。
+// 浏览器会忽略地址中的空白和协议名的大小写，key 为小写的属性名，SVG 的 xlink:href 同样是 href
+func scriptURL(key, value string) bool {
+	switch key {
+	case "href", "src", "data":
+	default:
+		return false
+	}
+	value = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value))
+	return strings.HasPrefix(value, "javascript:") || strings.HasPrefix(value, "vbscript:") ||
+		strings.HasPrefix(value, "data:text/html")
+}
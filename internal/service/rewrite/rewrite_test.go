@@ -0,0 +1,136 @@
+package rewrite
+
+import (
+	"bytes"
+	"flag"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "重新生成 testdata 中的 .golden 文件")
+
+// checkGolden 比较输出和 testdata 中的 .golden 文件，带 -update 运行时改为写入输出
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s 与 %s 不一致:\n%s", name, path, got)
+	}
+}
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRewritePage(t *testing.T) {
+	base, _ := url.Parse("https://mp.weixin.qq.com/s/abc")
+	proxyURL := ProxyURL(base)
+	r := New(
+		PromoteImages(proxyURL),
+		RewriteLinks(proxyURL),
+		StripScripts(),
+		InjectStyle("img { max-width: 100%; }"),
+		InjectBody(`<div class="toolbar"></div>`),
+	)
+
+	var out bytes.Buffer
+	if err := r.Rewrite(&out, bytes.NewReader(readTestdata(t, "page.html"))); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "page.html", out.Bytes())
+}
+
+func TestRewriteFragment(t *testing.T) {
+	r := New(PromoteImages(ProxyURL(nil)), StripScripts())
+	out, err := r.Fragment(string(readTestdata(t, "content.html")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "content.html", []byte(out))
+}
+
+func TestSanitize(t *testing.T) {
+	out, err := New(Sanitize(ArticlePolicy())).Fragment(string(readTestdata(t, "sanitize.html")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "sanitize.html", []byte(out))
+}
+
+func TestProxyURL(t *testing.T) {
+	base, _ := url.Parse("https://mp.weixin.qq.com/s/abc")
+	for _, tc := range []struct {
+		base *url.URL
+		raw  string
+		want string
+	}{
+		{nil, "https://mmbiz.qpic.cn/mmbiz_png/a/640?wx_fmt=png", "/wx-images/mmbiz_png/a/640?wx_fmt=png"},
+		{nil, "http://MMBIZ.QLOGO.CN/mmbiz/a/0", "/wx-qim/mmbiz/a/0"},
+		{nil, "//mmbiz.qpic.cn/a.png", "/wx-images/a.png"},
+		{nil, "https://mp.weixin.qq.com/s?__biz=MzA=#wechat_redirect", "/wx-mp/s?__biz=MzA=#wechat_redirect"},
+		{nil, "https://mmbiz.qpic.cn:8443/a.png", "https://mmbiz.qpic.cn:8443/a.png"},
+		{nil, "https://example.com/a.png", "https://example.com/a.png"},
+		{nil, "/archive/images/abc.png", "/archive/images/abc.png"},
+		{nil, "data:image/gif;base64,R0lGOD", "data:image/gif;base64,R0lGOD"},
+		{base, "/s/relative", "/wx-mp/s/relative"},
+		{base, "#top", "#top"},
+		{base, "", ""},
+	} {
+		if got := ProxyURL(tc.base)(tc.raw); got != tc.want {
+			t.Errorf("ProxyURL(%v)(%q) = %q, want %q", tc.base, tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestStripScriptsKeepsText(t *testing.T) {
+	out, err := New(StripScripts()).Fragment(`<p onmouseover="x()" title="online">文字<script>x()</script></p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `<p title="online">文字</p>` {
+		t.Errorf("got %q", out)
+	}
+	if strings.Contains(out, "script") {
+		t.Errorf("script left in %q", out)
+	}
+}
+
+func TestStripScriptsRemovesActiveContent(t *testing.T) {
+	out, err := New(StripScripts()).Fragment(`<iframe srcdoc="&lt;script&gt;x()&lt;/script&gt;" src="/wx-mp/s/a"></iframe>` +
+		`<object data="x.swf"></object><embed src="x.swf"/>` +
+		`<meta http-equiv="Refresh" content="0;url=https://example.com"/><meta name="viewport" content="width=device-width"/>` +
+		`<a href=" VBScript:msgbox(1)">v</a><a href="data:text/html;base64,PHNjcmlwdD4=">d</a>` +
+		`<iframe src="DATA:text/html,x"></iframe><img src="data:image/gif;base64,R0lGOD"/>` +
+		`<form action="https://example.com/steal"><button formaction="javascript:x()">提交</button></form>` +
+		`<svg><a xlink:href="javascript:x()">s</a></svg>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<iframe src="/wx-mp/s/a"></iframe>` +
+		`<meta name="viewport" content="width=device-width"/>` +
+		`<a>v</a><a>d</a>` +
+		`<iframe></iframe><img src="data:image/gif;base64,R0lGOD"/>` +
+		`<form><button>提交</button></form>` +
+		`<svg><a>s</a></svg>`
+	if out != want {
+		t.Errorf("got  %s\nwant %s", out, want)
+	}
+}
@@ -0,0 +1,148 @@
+package rewrite
+
+import (
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// Policy HTML 清理的白名单。不在白名单中的元素去掉标签、保留内容，不在白名单中的属性删除
+type Policy struct {
+	// Elements 允许的元素及其允许的属性
+	Elements map[string][]string
+	// Drop 连同内容一起删除的元素
+	Drop []string
+	// AllowURL 检查 href、src 等地址属性，返回 false 时删除该属性。<img> 没有 src 时整个删除
+	AllowURL func(element, attr, value string) bool
+}
+
+// 值为地址的属性
+var urlAttrs = map[string]bool{"href": true, "src": true, "poster": true, "cite": true}
+
+// pathNormalizer 按浏览器解析地址的方式处理反斜杠和空白字符
+var pathNormalizer = strings.NewReplacer("\\", "/", "\t", "", "\n", "", "\r", "")
+
+// ArticlePolicy 阅读视图使用的白名单：只保留正文的结构、文字格式、表格、链接和图片，
+// 删除所有样式、脚本和嵌入的内容。图片只允许本服务的地址，未经代理的外部图片（包括统计用的像素图）删除
+func ArticlePolicy() Policy {
+	return Policy{
+		Elements: map[string][]string{
+			"section": nil, "div": nil, "p": nil, "br": nil, "hr": nil,
+			"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+			"blockquote": {"cite"}, "pre": nil, "code": nil,
+			"ul": nil, "ol": {"start"}, "li": nil,
+			"strong": nil, "b": nil, "em": nil, "i": nil, "u": nil, "s": nil, "del": nil,
+			"sup": nil, "sub": nil, "mark": nil, "small": nil,
+			"table": nil, "thead": nil, "tbody": nil, "tfoot": nil, "tr": nil,
+			"th": {"colspan", "rowspan"}, "td": {"colspan", "rowspan"},
+			"figure": nil, "figcaption": nil,
+			"a":   {"href", "title"},
+			"img": {"src", "alt", "title", "width", "height", "data-original-src"},
+		},
+		Drop: []string{
+			"script", "style", "noscript", "template", "head", "title", "meta", "link", "base",
+			"iframe", "frame", "frameset", "object", "embed", "applet", "video", "audio", "source",
+			"svg", "math", "canvas", "form", "input", "button", "select", "textarea",
+		},
+		AllowURL: func(element, attr, value string) bool {
+			value = strings.TrimSpace(value)
+			if element == "img" {
+				// 本服务的代理和归档地址，不允许 //host 形式的外部地址。
+				// 浏览器会去掉地址中的制表符和换行，并把 \ 当作 /，/\host 同样指向外部
+				value = pathNormalizer.Replace(value)
+				return strings.HasPrefix(value, "/") && !strings.HasPrefix(value, "//")
+			}
+			if strings.HasPrefix(value, "#") {
+				return true
+			}
+			scheme, _, ok := strings.Cut(value, ":")
+			if !ok {
+				return false
+			}
+			switch strings.ToLower(scheme) {
+			case "http", "https", "mailto":
+				return true
+			}
+			return false
+		},
+	}
+}
+
+// Sanitize 按 policy 清理 <body> 的内容，删除注释和白名单以外的元素、属性
+func Sanitize(policy Policy) Pass {
+	drop := make(map[string]bool, len(policy.Drop))
+	for _, tag := range policy.Drop {
+		drop[tag] = true
+	}
+	allowed := make(map[string]map[string]bool, len(policy.Elements))
+	for tag, attrs := range policy.Elements {
+		allowed[tag] = make(map[string]bool, len(attrs))
+		for _, attr := range attrs {
+			allowed[tag][attr] = true
+		}
+	}
+
+	var sanitize func(parent *html.Node)
+	sanitize = func(parent *html.Node) {
+		for n := parent.FirstChild; n != nil; {
+			next := n.NextSibling
+			switch n.Type {
+			case html.CommentNode, html.DoctypeNode:
+				parent.RemoveChild(n)
+			case html.ElementNode:
+				tag := strings.ToLower(n.Data)
+				attrs, ok := allowed[tag]
+				switch {
+				case drop[tag] || n.Namespace != "":
+					parent.RemoveChild(n)
+				case !ok:
+					// 去掉标签，子节点移到原位置后继续处理
+					first := n.FirstChild
+					for child := n.FirstChild; child != nil; child = n.FirstChild {
+						n.RemoveChild(child)
+						parent.InsertBefore(child, n)
+					}
+					parent.RemoveChild(n)
+					if first != nil {
+						next = first
+					}
+				default:
+					kept := n.Attr[:0]
+					for _, attr := range n.Attr {
+						key := strings.ToLower(attr.Key)
+						if attr.Namespace != "" || !attrs[key] {
+							continue
+						}
+						if urlAttrs[key] && policy.AllowURL != nil && !policy.AllowURL(tag, key, attr.Val) {
+							continue
+						}
+						kept = append(kept, attr)
+					}
+					n.Attr = kept
+					if tag == "img" && !hasAttr(n, "src") {
+						parent.RemoveChild(n)
+						break
+					}
+					sanitize(n)
+				}
+			}
+			n = next
+		}
+	}
+
+	return func(doc *goquery.Document) {
+		for _, node := range doc.Find("body").Nodes {
+			sanitize(node)
+		}
+	}
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, attr := range n.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/storage"
+	"wechat-reader/internal/wxurl"
+)
+
+// Scheduler 定时为到期的专辑订阅提交增量抓取任务
+type Scheduler struct {
+	db       storage.Store
+	jobs     *JobManager
+	interval time.Duration
+	now      func() time.Time
+}
+
+// NewScheduler 创建调度器，interval 为检查到期订阅的间隔
+func NewScheduler(db storage.Store, jobs *JobManager, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		jobs:     jobs,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// schedulerLease 调度器租约的名称，多个实例共用数据库时只有持有租约的实例刷新订阅
+const schedulerLease = "scheduler"
+
+// Start 在后台运行调度循环，直到 ctx 结束
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if leader, err := s.leader(ctx); err != nil {
+				slog.ErrorContext(ctx, "获取调度器租约失败", "error", err)
+			} else if leader {
+				if err := s.RefreshDue(ctx); err != nil {
+					slog.ErrorContext(ctx, "刷新订阅失败", "error", err)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// leader 获取或延长调度器租约，返回本实例是否负责刷新订阅。
+// 租约为两个调度间隔，持有租约的实例退出后由其他实例接替
+func (s *Scheduler) leader(ctx context.Context) (bool, error) {
+	return s.db.AcquireLease(ctx, schedulerLease, s.jobs.owner, time.Now().Add(2*s.interval))
+}
+
+// Subscribe 订阅专辑，立即提交第一次抓取
+func (s *Scheduler) Subscribe(ctx context.Context, albumURL string, intervalMinutes int) (*model.Subscription, error) {
+	albumURL, err := wxurl.Normalize(albumURL)
+	if err != nil {
+		return nil, err
+	}
+
+	albumID := ExtractAlbumID(albumURL)
+	if albumID == "" {
+		return nil, fmt.Errorf("链接中缺少 album_id")
+	}
+	if intervalMinutes <= 0 {
+		return nil, fmt.Errorf("刷新间隔必须大于 0")
+	}
+
+	sub, err := s.db.GetSubscription(ctx, albumID)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		sub = &model.Subscription{
+			AlbumID:    albumID,
+			CreateTime: s.now(),
+		}
+	}
+	sub.URL = albumURL
+	sub.IntervalMinutes = intervalMinutes
+	// 下一轮调度立即刷新
+	sub.NextRefreshTime = s.now()
+
+	if err := s.db.SaveSubscription(ctx, sub); err != nil {
+		return nil, err
+	}
+	if err := s.refresh(ctx, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// RefreshDue 为所有到期的订阅提交增量抓取任务
+func (s *Scheduler) RefreshDue(ctx context.Context) error {
+	subs, err := s.db.GetDueSubscriptions(ctx, s.now())
+	if err != nil {
+		return err
+	}
+
+	for i := range subs {
+		if err := s.refresh(ctx, &subs[i]); err != nil {
+			slog.ErrorContext(ctx, "刷新专辑失败", "album_id", subs[i].AlbumID, "error", err)
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) refresh(ctx context.Context, sub *model.Subscription) error {
+	// 上一次的任务还没结束时不重复提交
+	if sub.LastJobID != "" {
+		last, err := s.jobs.Get(ctx, sub.LastJobID)
+		if err != nil {
+			return err
+		}
+		if last != nil && !last.Finished() {
+			return nil
+		}
+	}
+
+	job, err := s.jobs.Submit(ctx, sub.URL, model.JobModeIncremental)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "提交订阅刷新任务", "album_id", sub.AlbumID, "job_id", job.ID)
+
+	now := s.now()
+	sub.LastJobID = job.ID
+	sub.LastRefreshTime = now
+	sub.NextRefreshTime = now.Add(time.Duration(sub.IntervalMinutes) * time.Minute)
+	return s.db.SaveSubscription(ctx, sub)
+}
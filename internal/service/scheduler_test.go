@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+func TestSchedulerRefreshDue(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+	albumID := ExtractAlbumID(testAlbumURL)
+
+	// 已保存专辑的第 4 篇文章，增量抓取应在它之前停止
+	f := &fixtureFetcher{t: t, album: "album.html", pages: []string{"album_page_1.json"}}
+	articles, err := newFixtureCrawler(f).FetchArticles(ctx, testAlbumURL)
+	if err != nil || len(articles) < 4 {
+		t.Fatalf("FetchArticles = %d articles, %v", len(articles), err)
+	}
+	if err := db.SaveArticles(ctx, articles[3:4]); err != nil {
+		t.Fatal(err)
+	}
+
+	f = &fixtureFetcher{t: t, album: "album.html", pages: []string{"album_page_1.json", "album_page_2.json"}}
+	m := NewJobManager(newFixtureCrawler(f), db, 1)
+	s := NewScheduler(db, m, time.Minute)
+	clock := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return clock }
+
+	if err := db.SaveSubscription(ctx, &model.Subscription{
+		AlbumID:         albumID,
+		URL:             testAlbumURL,
+		IntervalMinutes: 60,
+		NextRefreshTime: clock.Add(time.Minute),
+		CreateTime:      clock,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 还没到期时不提交任务
+	if err := s.RefreshDue(ctx); err != nil || len(m.queue) != 0 {
+		t.Fatalf("RefreshDue before due = %v, queued %d", err, len(m.queue))
+	}
+
+	clock = clock.Add(time.Minute)
+	if err := s.RefreshDue(ctx); err != nil || len(m.queue) != 1 {
+		t.Fatalf("RefreshDue when due = %v, queued %d", err, len(m.queue))
+	}
+	sub, err := db.GetSubscription(ctx, albumID)
+	if err != nil || sub.LastJobID == "" || !sub.NextRefreshTime.Equal(clock.Add(time.Hour)) {
+		t.Fatalf("subscription after refresh = %+v, %v", sub, err)
+	}
+
+	// 上一次的任务没结束时，即使再次到期也不重复提交
+	clock = clock.Add(2 * time.Hour)
+	if err := s.RefreshDue(ctx); err != nil || len(m.queue) != 1 {
+		t.Fatalf("RefreshDue with unfinished job = %v, queued %d", err, len(m.queue))
+	}
+
+	job := runQueued(t, m)
+	if job.ID != sub.LastJobID || job.Mode != model.JobModeIncremental || job.Status != model.JobStatusSucceeded {
+		t.Fatalf("job = %+v, want the subscription's succeeded incremental job", job)
+	}
+	// 增量任务在已保存的文章处停止，不再请求下一页
+	if job.ArticlesFound != 3 || len(f.pageRequests()) != 1 {
+		t.Errorf("incremental job found %d articles with %d page requests, want 3 and 1", job.ArticlesFound, len(f.pageRequests()))
+	}
+
+	// 任务结束后再次到期时提交新任务
+	if err := s.RefreshDue(ctx); err != nil || len(m.queue) != 1 {
+		t.Fatalf("RefreshDue after job finished = %v, queued %d", err, len(m.queue))
+	}
+	if next, _ := db.GetSubscription(ctx, albumID); next.LastJobID == job.ID || !next.LastRefreshTime.Equal(clock) {
+		t.Errorf("subscription after second refresh = %+v", next)
+	}
+}
+
+func TestSchedulerLeader(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDatabase(t)
+
+	a := NewScheduler(db, NewJobManager(nil, db, 1), time.Minute)
+	b := NewScheduler(db, NewJobManager(nil, db, 1), time.Minute)
+	// 只有一个实例刷新订阅，持有租约的实例每轮延长租约
+	for i := 0; i < 2; i++ {
+		if leader, err := a.leader(ctx); err != nil || !leader {
+			t.Fatalf("a.leader = %v, %v; want true", leader, err)
+		}
+		if leader, err := b.leader(ctx); err != nil || leader {
+			t.Fatalf("b.leader = %v, %v; want false", leader, err)
+		}
+	}
+
+	// a 退出后租约过期，由 b 接替
+	// 把 a 的租约设为已过期
+	a.interval = -time.Minute
+	if leader, err := a.leader(ctx); err != nil || !leader {
+		t.Fatalf("a.leader = %v, %v", leader, err)
+	}
+	if leader, err := b.leader(ctx); err != nil || !leader {
+		t.Errorf("b.leader after a's lease expired = %v, %v; want true", leader, err)
+	}
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/wxurl"
+)
+
+// Topic 文章列表中的一个主题。属于专辑的文章按专辑归类，ID 为专辑 ID，名称为专辑当前的标题；
+// 旧数据和手动修改过主题的文章按主题文本归类，ID 为空
+type Topic struct {
+	ID                string    `json:"id"`
+	Name              string    `json:"name"`
+	Count             int       `json:"count"`
+	Unread            int       `json:"unread"`
+	LatestPublishTime time.Time `json:"latest_publish_time"` // 最新一篇文章的发布时间
+}
+
+// 专辑、公众号和主题相关的语句使用 $n 占位符，SQLite 和 PostgreSQL 通用
+
+// saveAccount 新建或更新公众号，为空的字段不覆盖已有的值
+func saveAccount(ctx context.Context, db execQuerier, account *model.Account) error {
+	updateTime := account.UpdateTime
+	if updateTime.IsZero() {
+		updateTime = time.Now()
+	}
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO accounts (biz, name, avatar, update_time)
+        VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4)
+        ON CONFLICT (biz) DO UPDATE SET
+            name = COALESCE(excluded.name, accounts.name),
+            avatar = COALESCE(excluded.avatar, accounts.avatar),
+            update_time = excluded.update_time
+    `, account.Biz, account.Name, account.Avatar, updateTime)
+	return err
+}
+
+// saveAlbum 新建或更新专辑，并把专辑中文章的主题改为专辑当前的标题。
+// 页面上没有的描述、封面和文章数不覆盖已有的值
+func saveAlbum(ctx context.Context, tx *sql.Tx, album *model.Album) error {
+	updateTime := album.UpdateTime
+	if updateTime.IsZero() {
+		updateTime = time.Now()
+	}
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO albums (album_id, biz, title, description, cover, article_count, update_time)
+        VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7)
+        ON CONFLICT (album_id) DO UPDATE SET
+            biz = COALESCE(excluded.biz, albums.biz),
+            title = excluded.title,
+            description = COALESCE(excluded.description, albums.description),
+            cover = COALESCE(excluded.cover, albums.cover),
+            article_count = CASE WHEN excluded.article_count > 0
+                THEN excluded.article_count ELSE albums.article_count END,
+            update_time = excluded.update_time
+    `,
+		album.ID,
+		album.Biz,
+		album.Title,
+		album.Description,
+		album.Cover,
+		album.ArticleCount,
+		updateTime,
+	); err != nil {
+		return err
+	}
+
+	// 手动修改主题的文章已经脱离专辑，不受影响
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE articles SET topic = $1 WHERE album_id = $2 AND (topic IS NULL OR topic != $1)
+    `, album.Title, album.ID); err != nil {
+		return err
+	}
+	if album.Biz != "" {
+		return saveAccount(ctx, tx, &model.Account{Biz: album.Biz, UpdateTime: updateTime})
+	}
+	return nil
+}
+
+// backfillArticleBiz 从已有文章的链接中提取公众号标识，并按公众号名称建立公众号记录
+func backfillArticleBiz(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, url, COALESCE(account, '') FROM articles WHERE biz IS NULL AND url IS NOT NULL
+    `)
+	if err != nil {
+		return err
+	}
+	// 先读出全部文章再更新，事务中的连接不能同时执行查询和更新
+	var articles []model.Article
+	for rows.Next() {
+		var article model.Article
+		if err := rows.Scan(&article.ID, &article.URL, &article.Account); err != nil {
+			rows.Close()
+			return err
+		}
+		articles = append(articles, article)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, article := range articles {
+		biz := wxurl.Parse(article.URL).Biz
+		if biz == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE articles SET biz = $1 WHERE id = $2`, biz, article.ID); err != nil {
+			return err
+		}
+		if err := saveAccount(ctx, tx, &model.Account{Biz: biz, Name: article.Account}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTopics 按专辑或主题文本统计文章数和未读数，按名称排序。
+// 阅读状态按主键逐条关联，不需要把文章读到内存中
+func getTopics(ctx context.Context, db *sql.DB, dl dialect) ([]Topic, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT COALESCE(a.album_id, ''), COALESCE(al.title, a.topic)`+dl.collate+` AS name,
+               COUNT(*), COUNT(*) - COUNT(s.read_time),
+               `+dl.timeText("MAX("+dl.timeValue("a.publish_time")+")")+`
+        FROM articles a
+        LEFT JOIN albums al ON al.album_id = a.album_id
+        LEFT JOIN article_states s ON s.article_id = a.id
+        WHERE COALESCE(al.title, a.topic, '') != ''
+        GROUP BY 1, 2
+        ORDER BY 2, 1
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	topics := []Topic{}
+	for rows.Next() {
+		var topic Topic
+		var latestStr string
+		if err := rows.Scan(&topic.ID, &topic.Name, &topic.Count, &topic.Unread, &latestStr); err != nil {
+			return nil, err
+		}
+		topic.LatestPublishTime, _ = time.Parse("2006-01-02 15:04:05", latestStr)
+		topics = append(topics, topic)
+	}
+	return topics, rows.Err()
+}
+
+// getAlbums 获取全部专辑及已保存的文章数，按标题排序
+func getAlbums(ctx context.Context, db *sql.DB, dl dialect) ([]model.Album, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT al.album_id, COALESCE(al.biz, ''), al.title, COALESCE(al.description, ''),
+               COALESCE(al.cover, ''), al.article_count,
+               (SELECT COUNT(*) FROM articles a WHERE a.album_id = al.album_id),
+               `+dl.timeText("al.update_time")+`
+        FROM albums al
+        ORDER BY al.title`+dl.collate+`, al.album_id
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := []model.Album{}
+	for rows.Next() {
+		var album model.Album
+		var updateTimeStr string
+		if err := rows.Scan(
+			&album.ID,
+			&album.Biz,
+			&album.Title,
+			&album.Description,
+			&album.Cover,
+			&album.ArticleCount,
+			&album.SavedCount,
+			&updateTimeStr,
+		); err != nil {
+			return nil, err
+		}
+		album.UpdateTime, _ = time.Parse("2006-01-02 15:04:05", updateTimeStr)
+		albums = append(albums, album)
+	}
+	return albums, rows.Err()
+}
+
+// getAccounts 获取全部公众号及已保存的文章数，按名称排序
+func getAccounts(ctx context.Context, db *sql.DB, dl dialect) ([]model.Account, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT ac.biz, COALESCE(ac.name, ''), COALESCE(ac.avatar, ''),
+               (SELECT COUNT(*) FROM articles a WHERE a.biz = ac.biz),
+               `+dl.timeText("ac.update_time")+`
+        FROM accounts ac
+        ORDER BY COALESCE(ac.name, '')`+dl.collate+`, ac.biz
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []model.Account{}
+	for rows.Next() {
+		var account model.Account
+		var updateTimeStr string
+		if err := rows.Scan(
+			&account.Biz,
+			&account.Name,
+			&account.Avatar,
+			&account.ArticleCount,
+			&updateTimeStr,
+		); err != nil {
+			return nil, err
+		}
+		account.UpdateTime, _ = time.Parse("2006-01-02 15:04:05", updateTimeStr)
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// GetTopics 获取全部主题及文章数
+func (d *Database) GetTopics(ctx context.Context) ([]Topic, error) {
+	return getTopics(ctx, d.db, sqliteDialect)
+}
+
+// SaveAlbum 新建或更新专辑信息，专辑改名后其中文章的主题随之改变
+func (d *Database) SaveAlbum(ctx context.Context, album *model.Album) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveAlbum(ctx, tx, album); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveAccount 新建或更新公众号信息
+func (d *Database) SaveAccount(ctx context.Context, account *model.Account) error {
+	return saveAccount(ctx, d.db, account)
+}
+
+// GetAlbums 获取全部专辑
+func (d *Database) GetAlbums(ctx context.Context) ([]model.Album, error) {
+	return getAlbums(ctx, d.db, sqliteDialect)
+}
+
+// GetAccounts 获取全部公众号
+func (d *Database) GetAccounts(ctx context.Context) ([]model.Account, error) {
+	return getAccounts(ctx, d.db, sqliteDialect)
+}
@@ -0,0 +1,440 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/wxurl"
+)
+
+// ArticleRef 文章的 ID 和标题，用于上一篇、下一篇链接
+type ArticleRef struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// ArticleNeighbors 同一主题中按发布时间相邻的文章，不存在时为 nil
+type ArticleNeighbors struct {
+	Prev *ArticleRef `json:"prev"` // 更早发布的一篇
+	Next *ArticleRef `json:"next"` // 更晚发布的一篇
+}
+
+// ArticlePatch 手动修改文章的字段，nil 表示不修改
+type ArticlePatch struct {
+	Title   *string `json:"title"`
+	Topic   *string `json:"topic"`
+	Author  *string `json:"author"`
+	Account *string `json:"account"`
+}
+
+// articleColumns scanArticle 读取的列。文章表的别名为 a，需要关联别名为 s 的 article_states 表，
+// 没有阅读状态记录的文章为未读。withContent 为 false 时不读取正文
+func articleColumns(dl dialect, withContent bool) string {
+	content := "''"
+	if withContent {
+		content = "COALESCE(a.content, '')"
+	}
+	return `a.id, a.title, COALESCE(a.author, ''), COALESCE(a.account, ''), ` + content + `,
+               COALESCE(a.url, ''), COALESCE(a.topic, '未分类'), COALESCE(a.album_id, ''), COALESCE(a.biz, ''),
+               s.read_time IS NOT NULL, s.starred IS TRUE, s.archived IS TRUE, COALESCE(s.progress, 0),
+               ` + dl.nullTimeText("s.last_open_time") + `,
+               ` + dl.timeText("a.publish_time") + `,
+               ` + dl.timeText("a.create_time")
+}
+
+// articleStateJoin 关联文章的阅读状态
+const articleStateJoin = ` LEFT JOIN article_states s ON s.article_id = a.id`
+
+// scanArticle 读取 articleColumns 中的列，extra 为之后的其他列
+func scanArticle(row rowScanner, extra ...any) (*model.Article, error) {
+	var article model.Article
+	var lastOpenStr sql.NullString
+	var publishTimeStr, createTimeStr string
+	dest := []any{
+		&article.ID,
+		&article.Title,
+		&article.Author,
+		&article.Account,
+		&article.Content,
+		&article.URL,
+		&article.Topic,
+		&article.AlbumID,
+		&article.Biz,
+		&article.State.Read,
+		&article.State.Starred,
+		&article.State.Archived,
+		&article.State.Progress,
+		&lastOpenStr,
+		&publishTimeStr,
+		&createTimeStr,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if lastOpenStr.Valid {
+		if t, err := time.Parse("2006-01-02 15:04:05", lastOpenStr.String); err == nil {
+			article.State.LastOpenTime = &t
+		}
+	}
+	article.PublishTime, _ = time.Parse("2006-01-02 15:04:05", publishTimeStr)
+	article.CreateTime, _ = time.Parse("2006-01-02 15:04:05", createTimeStr)
+	return &article, nil
+}
+
+// replaceArticleContent 在正文仍为 old 时替换为 content，返回是否替换。
+// 与 mergeArticle 一样由 SQLite 和 PostgreSQL 共用，使用 $n 占位符
+func replaceArticleContent(ctx context.Context, db *sql.DB, id, old, content string) (bool, error) {
+	res, err := db.ExecContext(ctx, `
+        UPDATE articles SET content = $1 WHERE id = $2 AND content = $3
+    `, content, id, old)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// articleIndex 文章写入后维护全文索引，由 Database 和 Postgres 实现
+type articleIndex interface {
+	// indexArticle 按文章当前的标题和正文更新索引
+	indexArticle(ctx context.Context, db execQuerier, id string) error
+	// unindexArticle 删除文章的索引，在删除文章之前调用
+	unindexArticle(ctx context.Context, db execQuerier, id string) error
+}
+
+// saveArticles 保存抓取到的文章，SQLite 和 PostgreSQL 共用
+func saveArticles(ctx context.Context, db *sql.DB, dl dialect, index articleIndex, articles []model.Article) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 文章 ID 由链接生成，重复抓取时保留首次保存时间和已下载的正文，
+	// 手动修改过的标题、主题、作者和公众号不被覆盖，手动修改过的文章也不重新归入专辑
+	stmt, err := tx.PrepareContext(ctx, dl.bind(`
+        INSERT INTO articles (id, title, author, account, content, url, topic, album_id, biz, publish_time, create_time)
+        VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?)
+        ON CONFLICT (id) DO UPDATE SET
+            title = CASE WHEN articles.edited THEN articles.title ELSE excluded.title END,
+            author = CASE WHEN articles.edited THEN articles.author
+                ELSE COALESCE(NULLIF(excluded.author, ''), articles.author) END,
+            account = CASE WHEN articles.edited THEN articles.account
+                ELSE COALESCE(NULLIF(excluded.account, ''), articles.account) END,
+            content = COALESCE(NULLIF(excluded.content, ''), articles.content),
+            url = excluded.url,
+            topic = CASE WHEN articles.edited THEN articles.topic ELSE excluded.topic END,
+            album_id = CASE WHEN articles.edited THEN articles.album_id
+                ELSE COALESCE(excluded.album_id, articles.album_id) END,
+            biz = COALESCE(excluded.biz, articles.biz),
+            publish_time = excluded.publish_time
+    `))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, article := range articles {
+		// 跳过没有 URL 的文章
+		if article.URL == "" {
+			continue
+		}
+
+		// 同一篇文章的不同分享链接只保存一条
+		if canonical, err := wxurl.Normalize(article.URL); err == nil {
+			article.URL = canonical
+		}
+		if article.Biz == "" {
+			article.Biz = wxurl.Parse(article.URL).Biz
+		}
+		// 用户删除过的文章不再保存
+		var deleted bool
+		if err := tx.QueryRowContext(ctx, dl.bind(`
+            SELECT EXISTS(SELECT 1 FROM deleted_articles WHERE id = ? OR url = ?)
+        `), article.ID, article.URL).Scan(&deleted); err != nil {
+			return err
+		}
+		if deleted {
+			continue
+		}
+		if article.ID, err = savedArticleID(ctx, tx, dl, article.ID, article.URL); err != nil {
+			return err
+		}
+
+		_, err = stmt.ExecContext(ctx,
+			article.ID,
+			article.Title,
+			article.Author,
+			article.Account,
+			article.Content,
+			article.URL,
+			article.Topic,
+			article.AlbumID,
+			article.Biz,
+			article.PublishTime,
+			article.CreateTime,
+		)
+		if err != nil {
+			return err
+		}
+		if article.Biz != "" {
+			if err := saveAccount(ctx, tx, &model.Account{Biz: article.Biz, Name: article.Account}); err != nil {
+				return err
+			}
+		}
+		if err := index.indexArticle(ctx, tx, article.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// savedArticleID 返回同一篇文章已保存的 ID：id 是别名时为别名指向的文章，
+// 链接已保存在另一个 ID 下（由旧版本的规则生成）时沿用已有的 ID，并把 id 记为它的别名。
+// 否则原样返回 id
+func savedArticleID(ctx context.Context, tx *sql.Tx, dl dialect, id, url string) (string, error) {
+	resolved, err := resolveArticleID(ctx, tx, dl, id)
+	if err != nil || resolved != id {
+		return resolved, err
+	}
+
+	var existing string
+	err = tx.QueryRowContext(ctx, dl.bind(`SELECT id FROM articles WHERE url = ?`), url).Scan(&existing)
+	if err == sql.ErrNoRows || existing == id {
+		return id, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return existing, addAlias(ctx, tx, id, existing)
+}
+
+// getArticles 获取全部文章及正文，按保存时间从新到旧
+func getArticles(ctx context.Context, db *sql.DB, dl dialect) ([]model.Article, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT `+articleColumns(dl, true)+`
+        FROM articles a`+articleStateJoin+`
+        ORDER BY a.create_time DESC
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var articles []model.Article
+	for rows.Next() {
+		article, err := scanArticle(rows)
+		if err != nil {
+			return nil, err
+		}
+		articles = append(articles, *article)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return articles, nil
+}
+
+// hasArticle 判断指定链接的文章是否已保存，用户删除过的文章也算作已保存
+func hasArticle(ctx context.Context, db *sql.DB, dl dialect, url string) (bool, error) {
+	if canonical, err := wxurl.Normalize(url); err == nil {
+		url = canonical
+	}
+
+	var exists bool
+	err := db.QueryRowContext(ctx, dl.bind(`
+        SELECT EXISTS(SELECT 1 FROM articles WHERE url = ?) OR EXISTS(SELECT 1 FROM deleted_articles WHERE url = ?)
+    `), url, url).Scan(&exists)
+	return exists, err
+}
+
+// resolveArticleID 把旧 ID 转换为当前 ID，不是别名时原样返回
+func resolveArticleID(ctx context.Context, db execQuerier, dl dialect, id string) (string, error) {
+	var articleID string
+	err := db.QueryRowContext(ctx, dl.bind(`SELECT article_id FROM article_aliases WHERE alias = ?`), id).Scan(&articleID)
+	if err == sql.ErrNoRows {
+		return id, nil
+	}
+	return articleID, err
+}
+
+// getArticle 按 ID 获取文章及正文，旧 ID 同样可以查到。不存在时返回 nil
+func getArticle(ctx context.Context, db *sql.DB, dl dialect, id string) (*model.Article, error) {
+	id, err := resolveArticleID(ctx, db, dl, id)
+	if err != nil {
+		return nil, err
+	}
+
+	article, err := scanArticle(db.QueryRowContext(ctx, dl.bind(`
+        SELECT `+articleColumns(dl, true)+`
+        FROM articles a`+articleStateJoin+`
+        WHERE a.id = ?
+    `), id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return article, err
+}
+
+// getArticleNeighbors 获取同一主题中发布时间紧邻的上一篇和下一篇，
+// 发布时间相同时按 ID 排序，与文章列表的顺序一致
+func getArticleNeighbors(ctx context.Context, db *sql.DB, dl dialect, id string) (*ArticleNeighbors, error) {
+	// 与文章列表相同的排序表达式，cur 中没有 publish_time 列，外层查询中指 a.publish_time
+	key := dl.sortExprs["publish_time"]
+	neighbors := &ArticleNeighbors{}
+	for _, n := range []struct {
+		dest  **ArticleRef
+		op    string
+		order string
+	}{
+		{&neighbors.Prev, "<", "DESC"},
+		{&neighbors.Next, ">", "ASC"},
+	} {
+		var ref ArticleRef
+		err := db.QueryRowContext(ctx, dl.bind(`
+            WITH cur AS (
+                SELECT topic, `+key+` AS k, id FROM articles WHERE id = ?
+            )
+            SELECT a.id, a.title
+            FROM articles a, cur
+            WHERE a.topic = cur.topic
+              AND (`+key+` `+n.op+` cur.k OR (`+key+` = cur.k AND a.id `+n.op+` cur.id))
+            ORDER BY `+key+` `+n.order+`, a.id `+n.order+`
+            LIMIT 1
+        `), id).Scan(&ref.ID, &ref.Title)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*n.dest = &ref
+	}
+	return neighbors, nil
+}
+
+// updateArticle 手动修改文章标题、主题等字段。修改过的文章重新抓取时保留手动修改的值。
+// 文章不存在时返回 nil
+func updateArticle(ctx context.Context, db *sql.DB, dl dialect, index articleIndex, id string, patch ArticlePatch) (*model.Article, error) {
+	id, err := resolveArticleID(ctx, db, dl, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := []string{"edited = TRUE"}
+	var args []any
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{
+		{"title", patch.Title},
+		{"topic", patch.Topic},
+		{"author", patch.Author},
+		{"account", patch.Account},
+	} {
+		if f.value != nil {
+			sets = append(sets, f.column+" = ?")
+			args = append(args, strings.TrimSpace(*f.value))
+		}
+	}
+	// 手动修改主题后文章不再属于原专辑，专辑改名时不随之改变
+	if patch.Topic != nil {
+		sets = append(sets, "album_id = NULL")
+	}
+	args = append(args, id)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, dl.bind(`UPDATE articles SET `+strings.Join(sets, ", ")+` WHERE id = ?`), args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	if err := index.indexArticle(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getArticle(ctx, db, dl, id)
+}
+
+// deleteArticle 删除文章及其别名和阅读状态，返回文章是否存在。
+// 文章的 ID 和链接记录在 deleted_articles 中，重新抓取时不再保存
+func deleteArticle(ctx context.Context, db *sql.DB, dl dialect, index articleIndex, id string) (bool, error) {
+	id, err := resolveArticleID(ctx, db, dl, id)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := index.unindexArticle(ctx, tx, id); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, dl.bind(`
+        INSERT INTO deleted_articles (id, url, delete_time)
+        SELECT id, url, ? FROM articles WHERE id = ?
+        ON CONFLICT (id) DO UPDATE SET url = excluded.url, delete_time = excluded.delete_time
+    `), time.Now(), id); err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx, dl.bind(`DELETE FROM articles WHERE id = ?`), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, dl.bind(`DELETE FROM article_aliases WHERE article_id = ?`), id); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, dl.bind(`DELETE FROM article_states WHERE article_id = ?`), id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// GetArticle 按 ID 获取文章及正文，旧 ID 同样可以查到。不存在时返回 nil
+func (d *Database) GetArticle(ctx context.Context, id string) (*model.Article, error) {
+	return getArticle(ctx, d.db, sqliteDialect, id)
+}
+
+// GetArticleNeighbors 获取同一主题中发布时间紧邻的上一篇和下一篇
+func (d *Database) GetArticleNeighbors(ctx context.Context, id string) (*ArticleNeighbors, error) {
+	return getArticleNeighbors(ctx, d.db, sqliteDialect, id)
+}
+
+// UpdateArticle 手动修改文章标题、主题等字段。文章不存在时返回 nil
+func (d *Database) UpdateArticle(ctx context.Context, id string, patch ArticlePatch) (*model.Article, error) {
+	return updateArticle(ctx, d.db, sqliteDialect, d, id, patch)
+}
+
+// DeleteArticle 删除文章及其别名，返回文章是否存在。删除的文章重新抓取时不再保存
+func (d *Database) DeleteArticle(ctx context.Context, id string) (bool, error) {
+	return deleteArticle(ctx, d.db, sqliteDialect, d, id)
+}
+
+// ReplaceArticleContent 把文章正文从 old 改为 content，正文在此期间被重新抓取的文章不修改。
+// 只用于改写图片链接等不影响文字的修改，不更新搜索索引
+func (d *Database) ReplaceArticleContent(ctx context.Context, id, old, content string) (bool, error) {
+	return replaceArticleContent(ctx, d.db, id, old, content)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+	"wechat-reader/internal/wxurl"
+)
+
+func TestGetArticleNeighbors(t *testing.T) {
+	db := newTestDatabase(t)
+	seedArticles(t, db, 6, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	// 主题 A 为 wx_00、wx_02、wx_04
+	n, err := db.GetArticleNeighbors(ctx, "wx_02")
+	if err != nil {
+		t.Fatalf("GetArticleNeighbors: %v", err)
+	}
+	if n.Prev == nil || n.Prev.ID != "wx_00" || n.Next == nil || n.Next.ID != "wx_04" {
+		t.Errorf("neighbors of wx_02 = %+v / %+v, want wx_00 / wx_04", n.Prev, n.Next)
+	}
+
+	n, err = db.GetArticleNeighbors(ctx, "wx_04")
+	if err != nil {
+		t.Fatalf("GetArticleNeighbors: %v", err)
+	}
+	if n.Prev == nil || n.Prev.ID != "wx_02" || n.Next != nil {
+		t.Errorf("neighbors of wx_04 = %+v / %+v, want wx_02 / nil", n.Prev, n.Next)
+	}
+}
+
+func TestUpdateArticleSurvivesRecrawl(t *testing.T) {
+	db := newTestDatabase(t)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	seedArticles(t, db, 2, base)
+	ctx := context.Background()
+
+	title, topic := "手动标题", "手动主题"
+	article, err := db.UpdateArticle(ctx, "wx_00", ArticlePatch{Title: &title, Topic: &topic})
+	if err != nil || article == nil {
+		t.Fatalf("UpdateArticle = %v, %v", article, err)
+	}
+	if article.Title != title || article.Topic != topic || article.Author != "作者A" {
+		t.Errorf("updated article = %+v", article)
+	}
+
+	// 重新抓取不覆盖手动修改
+	seedArticles(t, db, 2, base)
+	article, _ = db.GetArticle(ctx, "wx_00")
+	if article.Title != title || article.Topic != topic {
+		t.Errorf("recrawl overwrote manual edit: %+v", article)
+	}
+	if article.Content == "" {
+		t.Error("GetArticle did not return content")
+	}
+
+	if article, err := db.UpdateArticle(ctx, "missing", ArticlePatch{Title: &title}); err != nil || article != nil {
+		t.Errorf("UpdateArticle(missing) = %v, %v, want nil, nil", article, err)
+	}
+}
+
+func TestDeleteArticle(t *testing.T) {
+	db := newTestDatabase(t)
+	seedArticles(t, db, 2, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	found, err := db.DeleteArticle(ctx, "wx_01")
+	if err != nil || !found {
+		t.Fatalf("DeleteArticle = %v, %v", found, err)
+	}
+	if article, _ := db.GetArticle(ctx, "wx_01"); article != nil {
+		t.Errorf("article still present after delete")
+	}
+	if found, _ := db.DeleteArticle(ctx, "wx_01"); found {
+		t.Error("second delete reported the article as found")
+	}
+
+	// 重新抓取时不再保存删除过的文章，换了 ID 也一样；增量抓取把它当作已保存
+	seedArticles(t, db, 2, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	if article, _ := db.GetArticle(ctx, "wx_01"); article != nil {
+		t.Errorf("deleted article restored by recrawl")
+	}
+	url := "https://mp.weixin.qq.com/s?__biz=MzA=&mid=1001&idx=1"
+	if err := db.SaveArticles(ctx, []model.Article{{ID: "wx_new", Title: "文章 01", URL: url}}); err != nil {
+		t.Fatal(err)
+	}
+	if articles, _ := db.GetArticles(ctx); len(articles) != 1 || articles[0].ID != "wx_00" {
+		t.Errorf("GetArticles = %+v, want only wx_00", articles)
+	}
+	if ok, err := db.HasArticle(ctx, url); err != nil || !ok {
+		t.Errorf("HasArticle(deleted) = %v, %v; want true", ok, err)
+	}
+}
+
+func TestMergeDuplicateArticlesKeepsCrawlerIDs(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+
+	// 与抓取时相同：专辑列表中的链接缺少 mid/idx，由 msgid 和 itemidx 补全
+	link, _ := wxurl.Normalize(wxurl.WithMessage("https://mp.weixin.qq.com/s?__biz=MzA=&sn=abc", "100", "2"))
+	crawled := model.Article{ID: wxurl.ArticleID(link), Title: "文章", URL: link, CreateTime: time.Now()}
+	if err := db.SaveArticles(ctx, []model.Article{crawled}); err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本保存的同一篇文章，链接带有跟踪参数
+	if _, err := db.db.ExecContext(ctx, `
+        INSERT INTO articles (id, title, url, content, create_time) VALUES ('article_1_0', '文章', ?, '<p>正文</p>', ?)
+    `, link+"&chksm=1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if merged, err := db.MergeDuplicateArticles(ctx); err != nil || merged != 1 {
+		t.Fatalf("MergeDuplicateArticles = %d, %v; want 1", merged, err)
+	}
+	for _, id := range []string{crawled.ID, "article_1_0"} {
+		if got, err := db.GetArticle(ctx, id); err != nil || got == nil || got.ID != crawled.ID || got.Content != "<p>正文</p>" {
+			t.Errorf("GetArticle(%s) = %+v, %v; want the crawled ID with merged content", id, got, err)
+		}
+	}
+
+	// 再次抓取更新同一条记录
+	if err := db.SaveArticles(ctx, []model.Article{crawled}); err != nil {
+		t.Fatal(err)
+	}
+	if articles, _ := db.GetArticles(ctx); len(articles) != 1 {
+		t.Errorf("got %d articles after recrawl, want 1", len(articles))
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"wechat-reader/internal/model"
+)
+
+// SaveAlbumCursor 新建或更新专辑的翻页进度
+func (d *Database) SaveAlbumCursor(ctx context.Context, cursor *model.AlbumCursor) error {
+	_, err := d.db.ExecContext(ctx, `
+        INSERT OR REPLACE INTO album_cursors (album_id, url, msgid, itemidx, reached_end, update_time)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `,
+		cursor.AlbumID,
+		cursor.URL,
+		cursor.Msgid,
+		cursor.Itemidx,
+		cursor.ReachedEnd,
+		cursor.UpdateTime,
+	)
+	return err
+}
+
+// GetAlbumCursor 按专辑 ID 获取翻页进度，不存在时返回 nil
+func (d *Database) GetAlbumCursor(ctx context.Context, albumID string) (*model.AlbumCursor, error) {
+	var cursor model.AlbumCursor
+	err := d.db.QueryRowContext(ctx, `
+        SELECT album_id, url, msgid, itemidx, reached_end, update_time
+        FROM album_cursors
+        WHERE album_id = ?
+    `, albumID).Scan(
+		&cursor.AlbumID,
+		&cursor.URL,
+		&cursor.Msgid,
+		&cursor.Itemidx,
+		&cursor.ReachedEnd,
+		&cursor.UpdateTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
@@ -3,155 +3,224 @@ package storage
 import (
 	"context"
 	"database/sql"
-	"time"
+	"fmt"
+	"log/slog"
 	"wechat-reader/internal/model"
+	"wechat-reader/internal/wxurl"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Database 基于 SQLite 的 Store 实现
 type Database struct {
-	db *sql.DB
+	db  *sql.DB
+	fts bool // 是否启用了 FTS5 全文索引
 }
 
-func NewDatabase(ctx context.Context, dbPath string) (*Database, error) {
+// OpenDatabase 打开 SQLite 数据库但不执行迁移，用于 migrate 命令查看和升级数据库结构
+func OpenDatabase(ctx context.Context, dbPath string) (*Database, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Database{db: db}, nil
+}
 
-	// 创建表并添加 URL 唯一索引
-	_, err = db.ExecContext(ctx, `
-        CREATE TABLE IF NOT EXISTS articles (
-            id TEXT PRIMARY KEY,
-            title TEXT NOT NULL,
-            author TEXT,
-            content TEXT,
-            url TEXT UNIQUE,
-            topic TEXT,
-            publish_time DATETIME,
-            create_time DATETIME
-        );
-        CREATE UNIQUE INDEX IF NOT EXISTS idx_articles_url ON articles(url);
-    `)
+// NewDatabase 打开 SQLite 数据库，执行未执行的迁移并建立全文索引
+func NewDatabase(ctx context.Context, dbPath string) (*Database, error) {
+	d, err := OpenDatabase(ctx, dbPath)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := d.Migrate(ctx); err != nil {
+		d.db.Close()
+		return nil, err
+	}
 
-	return &Database{db: db}, nil
-}
+	d.fts, err = initSearch(ctx, d.db)
+	if err != nil {
+		d.db.Close()
+		return nil, err
+	}
+	// 为已有文章建立全文索引
+	if err := d.syncSearchIndex(ctx); err != nil {
+		d.db.Close()
+		return nil, err
+	}
 
-func (d *Database) Close(ctx context.Context) error {
-	return d.db.Close()
+	return d, nil
 }
 
-func (d *Database) SaveArticles(ctx context.Context, articles []model.Article) error {
-	tx, err := d.db.BeginTx(ctx, nil)
-	if err != nil {
+// migrateJobMode 旧版本用 incremental 列区分增量任务，改为 mode 列
+func migrateJobMode(ctx context.Context, tx *sql.Tx) error {
+	if err := addColumnIfNotExists(ctx, tx, "jobs", "mode", "TEXT NOT NULL DEFAULT 'full'"); err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(ctx, `
-        INSERT OR REPLACE INTO articles (id, title, author, content, url, topic, publish_time, create_time)
-        VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?)
+	exists, err := columnExists(ctx, tx, "jobs", "incremental")
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE jobs SET mode = 'incremental' WHERE incremental = 1`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `ALTER TABLE jobs DROP COLUMN incremental`); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "任务表 incremental 列已迁移为 mode")
+	return nil
+}
+
+// migrateArticleIDs 将 article_<时间戳>_<序号> 形式的旧 ID 改写为由链接生成的稳定 ID，
+// 旧 ID 记录在 article_aliases 中。链接重复的文章合并为一条，保留已有的正文
+func migrateArticleIDs(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, url FROM articles
+        WHERE id LIKE 'article\_%' ESCAPE '\' AND url IS NOT NULL
     `)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	for _, article := range articles {
-		// 跳过没有 URL 的文章
-		if article.URL == "" {
-			continue
+	type legacyArticle struct {
+		id  string
+		url string
+	}
+	var legacy []legacyArticle
+	for rows.Next() {
+		var a legacyArticle
+		if err := rows.Scan(&a.id, &a.url); err != nil {
+			rows.Close()
+			return err
 		}
+		legacy = append(legacy, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-		_, err = stmt.ExecContext(ctx,
-			article.ID,
-			article.Title,
-			article.Author,
-			article.Content,
-			article.URL,
-			article.Topic,
-			article.PublishTime,
-			article.CreateTime,
-		)
+	for _, a := range legacy {
+		newID := wxurl.ArticleID(a.url)
+
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM articles WHERE id = ?)`, newID).Scan(&exists); err != nil {
+			return err
+		}
+
+		if exists {
+			// 同一篇文章已存在，合并后删除旧记录
+			err = mergeArticle(ctx, tx, a.id, newID)
+		} else {
+			err = renameArticle(ctx, tx, a.id, newID)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
-	return tx.Commit()
+	if len(legacy) > 0 {
+		slog.InfoContext(ctx, "旧文章 ID 已迁移", "articles", len(legacy))
+	}
+	return nil
 }
 
-func (d *Database) GetArticles(ctx context.Context) ([]model.Article, error) {
-	rows, err := d.db.QueryContext(ctx, `
-        SELECT id, title, COALESCE(author, ''), COALESCE(content, ''), 
-               COALESCE(url, ''), COALESCE(topic, '未分类'), 
-               strftime('%Y-%m-%d %H:%M:%S', COALESCE(publish_time, CURRENT_TIMESTAMP)), 
-               strftime('%Y-%m-%d %H:%M:%S', COALESCE(create_time, CURRENT_TIMESTAMP))
-        FROM articles
-        ORDER BY create_time DESC
-    `)
-	if err != nil {
-		return nil, err
+// mergeArticle 用 fromID 的作者、公众号和正文补全 toID 中缺少的字段，然后删除 fromID，
+// fromID 记为 toID 的别名。
+// mergeArticle、renameArticle 和 addAlias 由 SQLite 和 PostgreSQL 共用，使用 $n 占位符
+func mergeArticle(ctx context.Context, tx *sql.Tx, fromID, toID string) error {
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE articles SET
+            author = COALESCE(NULLIF(author, ''), (SELECT author FROM articles WHERE id = $1)),
+            account = COALESCE(NULLIF(account, ''), (SELECT account FROM articles WHERE id = $1)),
+            content = COALESCE(NULLIF(content, ''), (SELECT content FROM articles WHERE id = $1))
+        WHERE id = $2
+    `, fromID, toID); err != nil {
+		return err
 	}
-	defer rows.Close()
-
-	var articles []model.Article
-	for rows.Next() {
-		var article model.Article
-		var publishTimeStr, createTimeStr string
-
-		err := rows.Scan(
-			&article.ID,
-			&article.Title,
-			&article.Author,
-			&article.Content,
-			&article.URL,
-			&article.Topic,
-			&publishTimeStr,
-			&createTimeStr,
-		)
-		if err != nil {
-			return nil, err
-		}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM articles WHERE id = $1`, fromID); err != nil {
+		return err
+	}
+	return addAlias(ctx, tx, fromID, toID)
+}
 
-		// 解析时间字符串
-		article.PublishTime, _ = time.Parse("2006-01-02 15:04:05", publishTimeStr)
-		article.CreateTime, _ = time.Parse("2006-01-02 15:04:05", createTimeStr)
+// renameArticle 修改文章 ID，旧 ID 记为别名
+func renameArticle(ctx context.Context, tx *sql.Tx, fromID, toID string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE articles SET id = $1 WHERE id = $2`, toID, fromID); err != nil {
+		return err
+	}
+	return addAlias(ctx, tx, fromID, toID)
+}
 
-		articles = append(articles, article)
+func addAlias(ctx context.Context, tx *sql.Tx, alias, articleID string) error {
+	// 指向旧 ID 的别名一并改为新 ID
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE article_aliases SET article_id = $1 WHERE article_id = $2
+    `, articleID, alias); err != nil {
+		return err
 	}
+	_, err := tx.ExecContext(ctx, `
+        INSERT INTO article_aliases (alias, article_id) VALUES ($1, $2)
+        ON CONFLICT(alias) DO UPDATE SET article_id = excluded.article_id
+    `, alias, articleID)
+	return err
+}
 
-	if err = rows.Err(); err != nil {
-		return nil, err
+// addColumnIfNotExists 在列不存在时为表添加新列
+func addColumnIfNotExists(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	exists, err := columnExists(ctx, tx, table, column)
+	if err != nil || exists {
+		return err
 	}
 
-	return articles, nil
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
-// 添加获取主题列表的方法
-func (d *Database) GetTopics(ctx context.Context) ([]string, error) {
-	rows, err := d.db.QueryContext(ctx, `
-        SELECT DISTINCT topic 
-        FROM articles 
-        WHERE topic IS NOT NULL AND topic != ''
-        ORDER BY topic
-    `)
+// columnExists 检查表中是否有指定的列
+func columnExists(ctx context.Context, tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	defer rows.Close()
 
-	var topics []string
 	for rows.Next() {
-		var topic string
-		if err := rows.Scan(&topic); err != nil {
-			return nil, err
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
 		}
-		topics = append(topics, topic)
 	}
+	return false, rows.Err()
+}
+
+func (d *Database) Close(ctx context.Context) error {
+	return d.db.Close()
+}
+
+func (d *Database) SaveArticles(ctx context.Context, articles []model.Article) error {
+	return saveArticles(ctx, d.db, sqliteDialect, d, articles)
+}
+
+func (d *Database) GetArticles(ctx context.Context) ([]model.Article, error) {
+	return getArticles(ctx, d.db, sqliteDialect)
+}
 
-	return topics, nil
+// HasArticle 判断指定链接的文章是否已保存
+func (d *Database) HasArticle(ctx context.Context, url string) (bool, error) {
+	return hasArticle(ctx, d.db, sqliteDialect, url)
 }
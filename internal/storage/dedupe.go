@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+
+	"wechat-reader/internal/wxurl"
+)
+
+// MergeDuplicateArticles 按规范化链接合并重复的文章：每组保留一条，
+// 链接改为规范形式、ID 改为由链接生成的稳定 ID，返回删除的重复记录数
+func (d *Database) MergeDuplicateArticles(ctx context.Context) (int, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	merged, _, err := mergeDuplicates(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	// 合并和改名后的文章重新建立索引
+	return merged, d.syncSearchIndex(ctx)
+}
+
+// mergeDuplicates 在事务中合并重复文章，返回删除的记录数和合并后保留的文章 ID。
+// SQLite 和 PostgreSQL 共用，使用 $n 占位符
+func mergeDuplicates(ctx context.Context, tx *sql.Tx) (merged int, kept []string, err error) {
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, url, COALESCE(content, '') != ''
+        FROM articles
+        WHERE url IS NOT NULL
+        ORDER BY create_time
+    `)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	type storedArticle struct {
+		id         string
+		url        string
+		hasContent bool
+	}
+
+	// 按稳定 ID 分组，保持首次保存的顺序
+	groups := make(map[string][]storedArticle)
+	canonicalURLs := make(map[string]string)
+	var order []string
+	for rows.Next() {
+		var a storedArticle
+		if err := rows.Scan(&a.id, &a.url, &a.hasContent); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+
+		canonical, err := wxurl.Normalize(a.url)
+		if err != nil {
+			continue
+		}
+		// 与抓取时相同，只由链接计算 ID。抓取时专辑列表的 msgid 已写入保存的链接，
+		// 因此抓取保存的文章 ID 不会在合并时被改写
+		id := wxurl.ArticleID(canonical)
+		if _, ok := groups[id]; !ok {
+			order = append(order, id)
+			canonicalURLs[id] = canonical
+		}
+		groups[id] = append(groups[id], a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	for _, id := range order {
+		group := groups[id]
+
+		// 优先保留 ID 已经正确的记录，其次是有正文的记录
+		keep := 0
+		for i, a := range group {
+			if a.id == id {
+				keep = i
+				break
+			}
+			if a.hasContent && !group[keep].hasContent {
+				keep = i
+			}
+		}
+
+		keeper := group[keep]
+		if len(group) > 1 {
+			kept = append(kept, id)
+		}
+		for i, a := range group {
+			if i == keep {
+				continue
+			}
+			if err := moveArticleState(ctx, tx, a.id, keeper.id); err != nil {
+				return 0, nil, err
+			}
+			if err := mergeArticle(ctx, tx, a.id, keeper.id); err != nil {
+				return 0, nil, err
+			}
+			slog.DebugContext(ctx, "合并重复文章", "from", a.id, "to", id)
+			merged++
+		}
+
+		if keeper.id != id {
+			if err := moveArticleState(ctx, tx, keeper.id, id); err != nil {
+				return 0, nil, err
+			}
+			if err := renameArticle(ctx, tx, keeper.id, id); err != nil {
+				return 0, nil, err
+			}
+		}
+		if keeper.url != canonicalURLs[id] {
+			if _, err := tx.ExecContext(ctx, `UPDATE articles SET url = $1 WHERE id = $2`, canonicalURLs[id], id); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	return merged, kept, nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+// 抓取任务可以由共用数据库的多个实例中的任意一个执行。执行前用 ClaimJob 领取任务，
+// 执行期间定期用 RenewJobLease 延长租约，用 UpdateJob 写入进度；实例退出后租约过期，任务由其他实例接手
+
+// jobColumns scanJob 读取的列
+const jobColumns = `id, url, mode, status, pages_fetched, articles_found, contents_fetched,
+               COALESCE(errors, ''), COALESCE(error, ''), COALESCE(resume_msgid, ''), resume_itemidx,
+               create_time, update_time, COALESCE(owner, ''), lease_until, cancel_requested`
+
+// saveJob 新建或更新抓取任务。领取者、租约和取消请求只由对应的方法修改，
+// 执行任务的实例写入进度时不会覆盖其他实例发出的取消请求
+func saveJob(ctx context.Context, db *sql.DB, dl dialect, job *model.Job) error {
+	errorsJSON, err := json.Marshal(job.Errors)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, dl.bind(`
+        INSERT INTO jobs (id, url, mode, status, pages_fetched, articles_found, contents_fetched, errors, error, resume_msgid, resume_itemidx, create_time, update_time)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (id) DO UPDATE SET
+            url = excluded.url,
+            mode = excluded.mode,
+            status = excluded.status,
+            pages_fetched = excluded.pages_fetched,
+            articles_found = excluded.articles_found,
+            contents_fetched = excluded.contents_fetched,
+            errors = excluded.errors,
+            error = excluded.error,
+            resume_msgid = excluded.resume_msgid,
+            resume_itemidx = excluded.resume_itemidx,
+            create_time = excluded.create_time,
+            update_time = excluded.update_time
+    `),
+		job.ID,
+		job.URL,
+		job.Mode,
+		job.Status,
+		job.PagesFetched,
+		job.ArticlesFound,
+		job.ContentsFetched,
+		string(errorsJSON),
+		job.Error,
+		job.ResumeMsgid,
+		job.ResumeItemidx,
+		job.CreateTime,
+		job.UpdateTime,
+	)
+	return err
+}
+
+// getJob 按 ID 获取抓取任务，不存在时返回 nil
+func getJob(ctx context.Context, db *sql.DB, dl dialect, id string) (*model.Job, error) {
+	row := db.QueryRowContext(ctx, dl.bind(`
+        SELECT `+jobColumns+`
+        FROM jobs
+        WHERE id = ?
+    `), id)
+
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// getJobs 获取最近的抓取任务，可按状态过滤
+func getJobs(ctx context.Context, db *sql.DB, dl dialect, status string, limit int) ([]model.Job, error) {
+	rows, err := db.QueryContext(ctx, dl.bind(`
+        SELECT `+jobColumns+`
+        FROM jobs
+        WHERE ? = '' OR status = ?
+        ORDER BY create_time DESC
+        LIMIT ?
+    `), status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []model.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// claimJob 领取排队中或租约已过期的任务，把任务标记为执行中并记录领取者和租约，
+// 同时清除之前的取消请求。任务已被其他实例领取或已结束时返回 false
+func claimJob(ctx context.Context, db *sql.DB, dl dialect, id, owner string, until time.Time) (bool, error) {
+	now := time.Now()
+	res, err := db.ExecContext(ctx, dl.bind(`
+        UPDATE jobs SET status = ?, owner = ?, lease_until = ?, cancel_requested = FALSE, update_time = ?
+        WHERE id = ? AND (status = ?
+            OR (status = ? AND (lease_until IS NULL OR `+dl.timeValue("lease_until")+` < `+dl.timeValue("?")+`)))
+    `), model.JobStatusRunning, owner, until, now, id, model.JobStatusPending, model.JobStatusRunning, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// updateJob 由领取任务的 owner 写入进度和结果。任务已被其他实例接手、owner 的租约已过期
+// 或任务不在执行中时不修改，返回 false，执行的实例应停止
+func updateJob(ctx context.Context, db *sql.DB, dl dialect, job *model.Job, owner string) (bool, error) {
+	errorsJSON, err := json.Marshal(job.Errors)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := db.ExecContext(ctx, dl.bind(`
+        UPDATE jobs SET status = ?, pages_fetched = ?, articles_found = ?, contents_fetched = ?, errors = ?, error = ?,
+            resume_msgid = ?, resume_itemidx = ?, update_time = ?
+        WHERE id = ? AND owner = ? AND status = ? AND `+dl.timeValue("lease_until")+` > `+dl.timeValue("?")+`
+    `),
+		job.Status,
+		job.PagesFetched,
+		job.ArticlesFound,
+		job.ContentsFetched,
+		string(errorsJSON),
+		job.Error,
+		job.ResumeMsgid,
+		job.ResumeItemidx,
+		job.UpdateTime,
+		job.ID,
+		owner,
+		model.JobStatusRunning,
+		time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// renewJobLease 延长 owner 持有的租约。任务已被其他实例接手、已结束或被请求取消时返回 false
+func renewJobLease(ctx context.Context, db *sql.DB, dl dialect, id, owner string, until time.Time) (bool, error) {
+	res, err := db.ExecContext(ctx, dl.bind(`
+        UPDATE jobs SET lease_until = ?
+        WHERE id = ? AND owner = ? AND status = ? AND NOT cancel_requested
+    `), until, id, owner, model.JobStatusRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// requestJobCancel 排队中的任务直接标记为已取消，执行中的任务记录取消请求，
+// 由执行它的实例在下次延长租约时停止。返回任务是否存在
+func requestJobCancel(ctx context.Context, db *sql.DB, dl dialect, id string) (bool, error) {
+	res, err := db.ExecContext(ctx, dl.bind(`
+        UPDATE jobs SET
+            status = CASE WHEN status = ? THEN ? ELSE status END,
+            cancel_requested = (status = ?),
+            update_time = ?
+        WHERE id = ?
+    `), model.JobStatusPending, model.JobStatusCancelled, model.JobStatusRunning, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// acquireLease 获取名为 name 的租约：没有人持有、已过期或 owner 自己持有时获取并延长到 until。
+// 用于只能由一个实例执行的工作，例如订阅调度
+func acquireLease(ctx context.Context, db *sql.DB, dl dialect, name, owner string, until time.Time) (bool, error) {
+	res, err := db.ExecContext(ctx, dl.bind(`
+        INSERT INTO leases (name, owner, lease_until) VALUES (?, ?, ?)
+        ON CONFLICT (name) DO UPDATE SET owner = excluded.owner, lease_until = excluded.lease_until
+        WHERE leases.owner = excluded.owner OR `+dl.timeValue("leases.lease_until")+` < `+dl.timeValue("?")+`
+    `), name, owner, until, time.Now())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SaveJob 新建或更新抓取任务，不修改任务的租约
+func (d *Database) SaveJob(ctx context.Context, job *model.Job) error {
+	return saveJob(ctx, d.db, sqliteDialect, job)
+}
+
+// GetJob 按 ID 获取抓取任务，不存在时返回 nil
+func (d *Database) GetJob(ctx context.Context, id string) (*model.Job, error) {
+	return getJob(ctx, d.db, sqliteDialect, id)
+}
+
+// GetJobs 获取最近的抓取任务，可按状态过滤
+func (d *Database) GetJobs(ctx context.Context, status string, limit int) ([]model.Job, error) {
+	return getJobs(ctx, d.db, sqliteDialect, status, limit)
+}
+
+// ClaimJob 由 owner 领取任务，租约到 until 为止
+func (d *Database) ClaimJob(ctx context.Context, id, owner string, until time.Time) (bool, error) {
+	return claimJob(ctx, d.db, sqliteDialect, id, owner, until)
+}
+
+// UpdateJob 由持有租约的 owner 写入任务的进度和结果，租约已失效时返回 false
+func (d *Database) UpdateJob(ctx context.Context, job *model.Job, owner string) (bool, error) {
+	return updateJob(ctx, d.db, sqliteDialect, job, owner)
+}
+
+// RenewJobLease 延长 owner 持有的任务租约
+func (d *Database) RenewJobLease(ctx context.Context, id, owner string, until time.Time) (bool, error) {
+	return renewJobLease(ctx, d.db, sqliteDialect, id, owner, until)
+}
+
+// RequestJobCancel 取消任务，正在执行的任务由执行它的实例停止
+func (d *Database) RequestJobCancel(ctx context.Context, id string) (bool, error) {
+	return requestJobCancel(ctx, d.db, sqliteDialect, id)
+}
+
+// AcquireLease 获取或延长名为 name 的租约
+func (d *Database) AcquireLease(ctx context.Context, name, owner string, until time.Time) (bool, error) {
+	return acquireLease(ctx, d.db, sqliteDialect, name, owner, until)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row rowScanner) (*model.Job, error) {
+	var job model.Job
+	var errorsJSON string
+	var leaseUntil sql.NullTime
+
+	err := row.Scan(
+		&job.ID,
+		&job.URL,
+		&job.Mode,
+		&job.Status,
+		&job.PagesFetched,
+		&job.ArticlesFound,
+		&job.ContentsFetched,
+		&errorsJSON,
+		&job.Error,
+		&job.ResumeMsgid,
+		&job.ResumeItemidx,
+		&job.CreateTime,
+		&job.UpdateTime,
+		&job.Owner,
+		&leaseUntil,
+		&job.CancelRequested,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if leaseUntil.Valid {
+		job.LeaseUntil = &leaseUntil.Time
+	}
+
+	if errorsJSON != "" {
+		if err := json.Unmarshal([]byte(errorsJSON), &job.Errors); err != nil {
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
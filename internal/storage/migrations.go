@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Migration 一次数据库结构升级。Version 从 1 开始连续编号，已发布的迁移不能修改，
+// 新的结构变化只能追加新的迁移
+type Migration struct {
+	Version int
+	Name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations 按版本排列的全部迁移。
+// 1 到 7 对应引入版本号之前的结构变化，需要兼容没有 schema_version 表的旧数据库，
+// 因此都写成可以重复执行的形式
+var migrations = []Migration{
+	{1, "创建文章表", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS articles (
+                id TEXT PRIMARY KEY,
+                title TEXT NOT NULL,
+                author TEXT,
+                content TEXT,
+                url TEXT UNIQUE,
+                topic TEXT,
+                publish_time DATETIME,
+                create_time DATETIME
+            );
+            CREATE UNIQUE INDEX IF NOT EXISTS idx_articles_url ON articles(url);
+        `)
+		return err
+	}},
+	{2, "文章添加公众号名称", func(ctx context.Context, tx *sql.Tx) error {
+		return addColumnIfNotExists(ctx, tx, "articles", "account", "TEXT")
+	}},
+	{3, "文章改用稳定 ID", func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS article_aliases (
+                alias TEXT PRIMARY KEY,
+                article_id TEXT NOT NULL
+            );
+        `); err != nil {
+			return err
+		}
+		return migrateArticleIDs(ctx, tx)
+	}},
+	{4, "创建抓取任务表", func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS jobs (
+                id TEXT PRIMARY KEY,
+                url TEXT NOT NULL,
+                mode TEXT NOT NULL DEFAULT 'full',
+                status TEXT NOT NULL,
+                pages_fetched INTEGER NOT NULL DEFAULT 0,
+                articles_found INTEGER NOT NULL DEFAULT 0,
+                contents_fetched INTEGER NOT NULL DEFAULT 0,
+                errors TEXT,
+                error TEXT,
+                resume_msgid TEXT,
+                resume_itemidx INTEGER NOT NULL DEFAULT 0,
+                create_time DATETIME,
+                update_time DATETIME
+            );
+            CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
+        `); err != nil {
+			return err
+		}
+		if err := migrateJobMode(ctx, tx); err != nil {
+			return err
+		}
+		if err := addColumnIfNotExists(ctx, tx, "jobs", "resume_msgid", "TEXT"); err != nil {
+			return err
+		}
+		return addColumnIfNotExists(ctx, tx, "jobs", "resume_itemidx", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{5, "创建订阅表", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS subscriptions (
+                album_id TEXT PRIMARY KEY,
+                url TEXT NOT NULL,
+                interval_minutes INTEGER NOT NULL,
+                last_job_id TEXT,
+                last_refresh_time DATETIME,
+                next_refresh_time DATETIME,
+                create_time DATETIME
+            );
+            CREATE INDEX IF NOT EXISTS idx_subscriptions_next_refresh ON subscriptions(next_refresh_time);
+        `)
+		return err
+	}},
+	{6, "创建专辑分页游标表", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE IF NOT EXISTS album_cursors (
+                album_id TEXT PRIMARY KEY,
+                url TEXT NOT NULL,
+                msgid TEXT NOT NULL,
+                itemidx INTEGER NOT NULL DEFAULT 0,
+                reached_end INTEGER NOT NULL DEFAULT 0,
+                update_time DATETIME
+            );
+        `)
+		return err
+	}},
+	{7, "文章添加手动修改标记", func(ctx context.Context, tx *sql.Tx) error {
+		return addColumnIfNotExists(ctx, tx, "articles", "edited", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{8, "创建公众号和专辑表", func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+            CREATE TABLE accounts (
+                biz TEXT PRIMARY KEY,
+                name TEXT,
+                avatar TEXT,
+                update_time DATETIME
+            );
+            CREATE TABLE albums (
+                album_id TEXT PRIMARY KEY,
+                biz TEXT,
+                title TEXT NOT NULL,
+                description TEXT,
+                cover TEXT,
+                article_count INTEGER NOT NULL DEFAULT 0,
+                update_time DATETIME
+            );
+            ALTER TABLE articles ADD COLUMN album_id TEXT;
+            ALTER TABLE articles ADD COLUMN biz TEXT;
+            CREATE INDEX idx_articles_album_id ON articles(album_id);
+            CREATE INDEX idx_articles_biz ON articles(biz);
+        `); err != nil {
+			return err
+		}
+		// 已有文章无法确定所属专辑，重新抓取专辑时补上
+		return backfillArticleBiz(ctx, tx)
+	}},
+	{9, "创建文章阅读状态表", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE article_states (
+                article_id TEXT PRIMARY KEY,
+                read_time DATETIME
+            );
+            CREATE INDEX idx_articles_topic_publish_time ON articles(topic, publish_time);
+        `)
+		return err
+	}},
+	{10, "文章阅读状态添加星标、归档和阅读进度", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            ALTER TABLE article_states ADD COLUMN starred INTEGER NOT NULL DEFAULT 0;
+            ALTER TABLE article_states ADD COLUMN archived INTEGER NOT NULL DEFAULT 0;
+            ALTER TABLE article_states ADD COLUMN progress INTEGER NOT NULL DEFAULT 0;
+            ALTER TABLE article_states ADD COLUMN last_open_time DATETIME;
+            CREATE INDEX idx_article_states_starred ON article_states(article_id) WHERE starred;
+            CREATE INDEX idx_article_states_archived ON article_states(article_id) WHERE archived;
+        `)
+		return err
+	}},
+	{11, "创建已删除文章表", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE deleted_articles (
+                id TEXT PRIMARY KEY,
+                url TEXT,
+                delete_time DATETIME NOT NULL
+            );
+            CREATE INDEX idx_deleted_articles_url ON deleted_articles(url);
+        `)
+		return err
+	}},
+	{12, "任务添加租约", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            ALTER TABLE jobs ADD COLUMN owner TEXT;
+            ALTER TABLE jobs ADD COLUMN lease_until DATETIME;
+            ALTER TABLE jobs ADD COLUMN cancel_requested INTEGER NOT NULL DEFAULT 0;
+            CREATE TABLE leases (
+                name TEXT PRIMARY KEY,
+                owner TEXT NOT NULL,
+                lease_until DATETIME NOT NULL
+            );
+        `)
+		return err
+	}},
+}
+
+// MigrationStatus 数据库当前的结构版本和尚未执行的迁移
+type MigrationStatus struct {
+	Version int
+	Latest  int
+	Pending []Migration
+}
+
+// ensureSchemaVersion 创建记录已执行迁移的 schema_version 表。
+// 迁移记录相关的语句使用 $n 占位符，SQLite 和 PostgreSQL 通用
+func ensureSchemaVersion(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_version (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_time TIMESTAMP
+        )
+    `)
+	return err
+}
+
+// schemaVersion 返回已执行的最大迁移版本，没有记录时为 0
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// MigrationStatus 查看数据库结构版本，不执行迁移
+func (d *Database) MigrationStatus(ctx context.Context) (*MigrationStatus, error) {
+	return migrationStatus(ctx, d.db, migrations)
+}
+
+// Migrate 执行所有未执行的迁移，返回执行的迁移
+func (d *Database) Migrate(ctx context.Context) ([]Migration, error) {
+	return applyMigrations(ctx, d.db, migrations)
+}
+
+func migrationStatus(ctx context.Context, db *sql.DB, list []Migration) (*MigrationStatus, error) {
+	if err := ensureSchemaVersion(ctx, db); err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MigrationStatus{Version: version, Latest: list[len(list)-1].Version}
+	for _, m := range list {
+		if m.Version > version {
+			status.Pending = append(status.Pending, m)
+		}
+	}
+	return status, nil
+}
+
+// applyMigrations 按版本依次执行迁移，每个迁移和它的版本记录在同一个事务中提交，
+// 失败时数据库停留在上一个版本。数据库版本比程序已知的更新时拒绝执行，避免旧程序写坏新结构
+func applyMigrations(ctx context.Context, db *sql.DB, list []Migration) ([]Migration, error) {
+	if err := ensureSchemaVersion(ctx, db); err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if latest := list[len(list)-1].Version; version > latest {
+		return nil, fmt.Errorf("数据库结构版本 %d 高于程序支持的版本 %d，请升级程序", version, latest)
+	}
+
+	var applied []Migration
+	for _, m := range list {
+		if m.Version <= version {
+			continue
+		}
+		if err := applyMigration(ctx, db, m); err != nil {
+			return applied, fmt.Errorf("执行迁移 %d（%s）失败: %v", m.Version, m.Name, err)
+		}
+		slog.DebugContext(ctx, "数据库迁移完成", "version", m.Version, "name", m.Name)
+		applied = append(applied, m)
+	}
+	if len(applied) > 0 {
+		slog.InfoContext(ctx, "数据库结构已升级", "from", version, "to", applied[len(applied)-1].Version)
+	}
+	return applied, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO schema_version (version, name, applied_time) VALUES ($1, $2, $3)
+    `, m.Version, m.Name, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateNewDatabase(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+
+	status, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != status.Latest || len(status.Pending) != 0 {
+		t.Errorf("status = %+v, want latest version and no pending migrations", status)
+	}
+
+	applied, err := db.Migrate(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("second Migrate applied %d migrations, err = %v", len(applied), err)
+	}
+}
+
+// 没有 schema_version 的旧数据库按原有数据升级
+func TestMigrateLegacyDatabase(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec(`
+        CREATE TABLE articles (
+            id TEXT PRIMARY KEY, title TEXT NOT NULL, author TEXT, content TEXT,
+            url TEXT UNIQUE, topic TEXT, publish_time DATETIME, create_time DATETIME
+        );
+        INSERT INTO articles (id, title, url, topic, publish_time, create_time)
+        VALUES ('article_1700000000_0', '旧文章', 'https://mp.weixin.qq.com/s?__biz=MzA=&mid=1&idx=1&sn=abc', 'A',
+                '2024-01-01 00:00:00+00:00', '2024-01-01 00:00:00+00:00');
+        CREATE TABLE jobs (
+            id TEXT PRIMARY KEY, url TEXT NOT NULL, incremental INTEGER NOT NULL DEFAULT 0,
+            status TEXT NOT NULL, pages_fetched INTEGER NOT NULL DEFAULT 0,
+            articles_found INTEGER NOT NULL DEFAULT 0, contents_fetched INTEGER NOT NULL DEFAULT 0,
+            errors TEXT, error TEXT, create_time DATETIME, update_time DATETIME
+        );
+        INSERT INTO jobs (id, url, incremental, status, create_time, update_time)
+        VALUES ('job_1', 'https://example.com', 1, 'completed', '2024-01-01 00:00:00+00:00', '2024-01-01 00:00:00+00:00');
+    `); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	db, err := NewDatabase(ctx, path)
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	defer db.Close(ctx)
+
+	article, err := db.GetArticle(ctx, "article_1700000000_0")
+	if err != nil || article == nil {
+		t.Fatalf("GetArticle by legacy id = %v, %v", article, err)
+	}
+	if article.ID == "article_1700000000_0" || article.Title != "旧文章" || article.Biz != "MzA=" {
+		t.Errorf("article = %+v, want migrated id and biz", article)
+	}
+	if accounts, err := db.GetAccounts(ctx); err != nil || len(accounts) != 1 || accounts[0].ArticleCount != 1 {
+		t.Errorf("GetAccounts = %+v, %v", accounts, err)
+	}
+
+	job, err := db.GetJob(ctx, "job_1")
+	if err != nil || job == nil || job.Mode != "incremental" {
+		t.Errorf("job = %+v, %v; want incremental mode", job, err)
+	}
+
+	status, err := db.MigrationStatus(ctx)
+	if err != nil || status.Version != status.Latest {
+		t.Errorf("status = %+v, %v", status, err)
+	}
+}
+
+func TestMigrateRollsBackFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenDatabase(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(ctx)
+
+	list := []Migration{
+		{1, "创建表", func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE t (id INTEGER)`)
+			return err
+		}},
+		{2, "失败的迁移", func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `ALTER TABLE t ADD COLUMN name TEXT`); err != nil {
+				return err
+			}
+			return errors.New("失败")
+		}},
+	}
+	applied, err := applyMigrations(ctx, db.db, list)
+	if err == nil || len(applied) != 1 {
+		t.Fatalf("applied %d migrations, err = %v; want 1 and an error", len(applied), err)
+	}
+
+	version, err := schemaVersion(ctx, db.db)
+	if err != nil || version != 1 {
+		t.Errorf("version = %d, %v; want 1", version, err)
+	}
+	if _, err := db.db.Exec(`SELECT name FROM t`); err == nil {
+		t.Error("column from failed migration was not rolled back")
+	}
+
+	// 数据库版本高于程序已知的版本时拒绝执行
+	if _, err := db.db.Exec(`INSERT INTO schema_version (version, name) VALUES (3, '新版本')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyMigrations(ctx, db.db, list); err == nil {
+		t.Error("expected error for database newer than known migrations")
+	}
+}
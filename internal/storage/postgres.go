@@ -0,0 +1,471 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/model"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Postgres 基于 PostgreSQL 的 Store 实现，多个服务实例可以共用一个数据库。
+// 文章的全文索引保存在 articles.search_vector 列中，使用与 SQLite 相同的中文二元组切分
+type Postgres struct {
+	db *sql.DB
+}
+
+// 执行迁移时持有的 advisory lock，避免多个实例同时启动时重复执行迁移
+const postgresMigrationLock = 7265636861740001
+
+var postgresDialect = dialect{
+	sortExprs: map[string]string{
+		"publish_time": "COALESCE(EXTRACT(EPOCH FROM publish_time)::float8, 0)",
+		"create_time":  "COALESCE(EXTRACT(EPOCH FROM create_time)::float8, 0)",
+		"title":        "title",
+	},
+	timeValue: func(expr string) string { return expr },
+	timeText:  pgTimeText,
+	nullTimeText: func(column string) string {
+		return "to_char(" + column + " AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')"
+	},
+	bind:    rebind,
+	collate: ` COLLATE "C"`,
+}
+
+// postgresMigrations PostgreSQL 的迁移，版本号与 SQLite 的迁移相互独立。
+// id 和 title 使用 "C" 排序规则，排序结果与 SQLite 一致
+var postgresMigrations = []Migration{
+	{1, "创建表结构", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE articles (
+                id TEXT COLLATE "C" PRIMARY KEY,
+                title TEXT COLLATE "C" NOT NULL,
+                author TEXT,
+                account TEXT,
+                content TEXT,
+                url TEXT UNIQUE,
+                topic TEXT,
+                publish_time TIMESTAMPTZ,
+                create_time TIMESTAMPTZ,
+                edited BOOLEAN NOT NULL DEFAULT FALSE,
+                search_vector TSVECTOR
+            );
+            CREATE INDEX idx_articles_topic_publish_time ON articles(topic, publish_time);
+            CREATE INDEX idx_articles_search ON articles USING GIN (search_vector);
+
+            CREATE TABLE article_aliases (
+                alias TEXT PRIMARY KEY,
+                article_id TEXT NOT NULL
+            );
+
+            CREATE TABLE jobs (
+                id TEXT PRIMARY KEY,
+                url TEXT NOT NULL,
+                mode TEXT NOT NULL DEFAULT 'full',
+                status TEXT NOT NULL,
+                pages_fetched INTEGER NOT NULL DEFAULT 0,
+                articles_found INTEGER NOT NULL DEFAULT 0,
+                contents_fetched INTEGER NOT NULL DEFAULT 0,
+                errors TEXT,
+                error TEXT,
+                resume_msgid TEXT,
+                resume_itemidx INTEGER NOT NULL DEFAULT 0,
+                create_time TIMESTAMPTZ,
+                update_time TIMESTAMPTZ
+            );
+            CREATE INDEX idx_jobs_status ON jobs(status);
+
+            CREATE TABLE subscriptions (
+                album_id TEXT PRIMARY KEY,
+                url TEXT NOT NULL,
+                interval_minutes INTEGER NOT NULL,
+                last_job_id TEXT,
+                last_refresh_time TIMESTAMPTZ,
+                next_refresh_time TIMESTAMPTZ,
+                create_time TIMESTAMPTZ
+            );
+            CREATE INDEX idx_subscriptions_next_refresh ON subscriptions(next_refresh_time);
+
+            CREATE TABLE album_cursors (
+                album_id TEXT PRIMARY KEY,
+                url TEXT NOT NULL,
+                msgid TEXT NOT NULL,
+                itemidx INTEGER NOT NULL DEFAULT 0,
+                reached_end BOOLEAN NOT NULL DEFAULT FALSE,
+                update_time TIMESTAMPTZ
+            );
+        `)
+		return err
+	}},
+	{2, "创建公众号和专辑表", func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+            CREATE TABLE accounts (
+                biz TEXT PRIMARY KEY,
+                name TEXT,
+                avatar TEXT,
+                update_time TIMESTAMPTZ
+            );
+            CREATE TABLE albums (
+                album_id TEXT PRIMARY KEY,
+                biz TEXT,
+                title TEXT NOT NULL,
+                description TEXT,
+                cover TEXT,
+                article_count INTEGER NOT NULL DEFAULT 0,
+                update_time TIMESTAMPTZ
+            );
+            ALTER TABLE articles ADD COLUMN album_id TEXT, ADD COLUMN biz TEXT;
+            CREATE INDEX idx_articles_album_id ON articles(album_id);
+            CREATE INDEX idx_articles_biz ON articles(biz);
+        `); err != nil {
+			return err
+		}
+		return backfillArticleBiz(ctx, tx)
+	}},
+	{3, "创建文章阅读状态表", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE article_states (
+                article_id TEXT PRIMARY KEY,
+                read_time TIMESTAMPTZ
+            );
+        `)
+		return err
+	}},
+	{4, "文章阅读状态添加星标、归档和阅读进度", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            ALTER TABLE article_states
+                ADD COLUMN starred BOOLEAN NOT NULL DEFAULT FALSE,
+                ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE,
+                ADD COLUMN progress INTEGER NOT NULL DEFAULT 0,
+                ADD COLUMN last_open_time TIMESTAMPTZ;
+            CREATE INDEX idx_article_states_starred ON article_states(article_id) WHERE starred;
+            CREATE INDEX idx_article_states_archived ON article_states(article_id) WHERE archived;
+        `)
+		return err
+	}},
+	{5, "创建已删除文章表", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            CREATE TABLE deleted_articles (
+                id TEXT PRIMARY KEY,
+                url TEXT,
+                delete_time TIMESTAMPTZ NOT NULL
+            );
+            CREATE INDEX idx_deleted_articles_url ON deleted_articles(url);
+        `)
+		return err
+	}},
+	{6, "任务添加租约", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+            ALTER TABLE jobs
+                ADD COLUMN owner TEXT,
+                ADD COLUMN lease_until TIMESTAMPTZ,
+                ADD COLUMN cancel_requested BOOLEAN NOT NULL DEFAULT FALSE;
+            CREATE TABLE leases (
+                name TEXT PRIMARY KEY,
+                owner TEXT NOT NULL,
+                lease_until TIMESTAMPTZ NOT NULL
+            );
+        `)
+		return err
+	}},
+}
+
+// OpenPostgres 连接 PostgreSQL 但不执行迁移，用于 migrate 命令查看和升级数据库结构
+func OpenPostgres(ctx context.Context, dsn string) (*Postgres, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Postgres{db: db}, nil
+}
+
+// NewPostgres 连接 PostgreSQL 并执行未执行的迁移
+func NewPostgres(ctx context.Context, dsn string) (*Postgres, error) {
+	p, err := OpenPostgres(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.Migrate(ctx); err != nil {
+		p.db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Postgres) Close(ctx context.Context) error {
+	return p.db.Close()
+}
+
+// MigrationStatus 查看数据库结构版本，不执行迁移
+func (p *Postgres) MigrationStatus(ctx context.Context) (*MigrationStatus, error) {
+	return migrationStatus(ctx, p.db, postgresMigrations)
+}
+
+// Migrate 执行所有未执行的迁移。迁移期间持有 advisory lock，
+// 同时启动的其他实例等待迁移完成后发现已是最新版本
+func (p *Postgres) Migrate(ctx context.Context) ([]Migration, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+
+	return applyMigrations(ctx, p.db, postgresMigrations)
+}
+
+// rebind 把 ? 占位符改为 PostgreSQL 的 $1、$2 …，查询中的字符串常量不能包含问号
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pgTimeText 与 SQLite 的 strftime 相同，把时间转换为 UTC 的文本，方便共用解析代码
+func pgTimeText(column string) string {
+	return "to_char(COALESCE(" + column + ", now()) AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')"
+}
+
+// SaveJob 新建或更新抓取任务，不修改任务的租约
+func (p *Postgres) SaveJob(ctx context.Context, job *model.Job) error {
+	return saveJob(ctx, p.db, postgresDialect, job)
+}
+
+// GetJob 按 ID 获取抓取任务，不存在时返回 nil
+func (p *Postgres) GetJob(ctx context.Context, id string) (*model.Job, error) {
+	return getJob(ctx, p.db, postgresDialect, id)
+}
+
+// GetJobs 获取最近的抓取任务，可按状态过滤
+func (p *Postgres) GetJobs(ctx context.Context, status string, limit int) ([]model.Job, error) {
+	return getJobs(ctx, p.db, postgresDialect, status, limit)
+}
+
+// ClaimJob 由 owner 领取任务，租约到 until 为止
+func (p *Postgres) ClaimJob(ctx context.Context, id, owner string, until time.Time) (bool, error) {
+	return claimJob(ctx, p.db, postgresDialect, id, owner, until)
+}
+
+// UpdateJob 由持有租约的 owner 写入任务的进度和结果，租约已失效时返回 false
+func (p *Postgres) UpdateJob(ctx context.Context, job *model.Job, owner string) (bool, error) {
+	return updateJob(ctx, p.db, postgresDialect, job, owner)
+}
+
+// RenewJobLease 延长 owner 持有的任务租约
+func (p *Postgres) RenewJobLease(ctx context.Context, id, owner string, until time.Time) (bool, error) {
+	return renewJobLease(ctx, p.db, postgresDialect, id, owner, until)
+}
+
+// RequestJobCancel 取消任务，正在执行的任务由执行它的实例停止
+func (p *Postgres) RequestJobCancel(ctx context.Context, id string) (bool, error) {
+	return requestJobCancel(ctx, p.db, postgresDialect, id)
+}
+
+// AcquireLease 获取或延长名为 name 的租约
+func (p *Postgres) AcquireLease(ctx context.Context, name, owner string, until time.Time) (bool, error) {
+	return acquireLease(ctx, p.db, postgresDialect, name, owner, until)
+}
+
+// SaveSubscription 新建或更新专辑订阅
+func (p *Postgres) SaveSubscription(ctx context.Context, sub *model.Subscription) error {
+	_, err := p.db.ExecContext(ctx, rebind(`
+        INSERT INTO subscriptions (album_id, url, interval_minutes, last_job_id, last_refresh_time, next_refresh_time, create_time)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (album_id) DO UPDATE SET
+            url = excluded.url,
+            interval_minutes = excluded.interval_minutes,
+            last_job_id = excluded.last_job_id,
+            last_refresh_time = excluded.last_refresh_time,
+            next_refresh_time = excluded.next_refresh_time,
+            create_time = excluded.create_time
+    `),
+		sub.AlbumID,
+		sub.URL,
+		sub.IntervalMinutes,
+		sub.LastJobID,
+		sub.LastRefreshTime,
+		sub.NextRefreshTime,
+		sub.CreateTime,
+	)
+	return err
+}
+
+// GetSubscription 按专辑 ID 获取订阅，不存在时返回 nil
+func (p *Postgres) GetSubscription(ctx context.Context, albumID string) (*model.Subscription, error) {
+	row := p.db.QueryRowContext(ctx, rebind(`
+        SELECT album_id, url, interval_minutes, COALESCE(last_job_id, ''),
+               last_refresh_time, next_refresh_time, create_time
+        FROM subscriptions
+        WHERE album_id = ?
+    `), albumID)
+
+	sub, err := scanSubscription(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+// GetSubscriptions 获取全部订阅
+func (p *Postgres) GetSubscriptions(ctx context.Context) ([]model.Subscription, error) {
+	return p.querySubscriptions(ctx, `
+        SELECT album_id, url, interval_minutes, COALESCE(last_job_id, ''),
+               last_refresh_time, next_refresh_time, create_time
+        FROM subscriptions
+        ORDER BY create_time
+    `)
+}
+
+// GetDueSubscriptions 获取到期需要刷新的订阅
+func (p *Postgres) GetDueSubscriptions(ctx context.Context, now time.Time) ([]model.Subscription, error) {
+	return p.querySubscriptions(ctx, `
+        SELECT album_id, url, interval_minutes, COALESCE(last_job_id, ''),
+               last_refresh_time, next_refresh_time, create_time
+        FROM subscriptions
+        WHERE next_refresh_time <= ?
+        ORDER BY next_refresh_time
+    `, now)
+}
+
+// DeleteSubscription 删除订阅，已保存的文章不受影响
+func (p *Postgres) DeleteSubscription(ctx context.Context, albumID string) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM subscriptions WHERE album_id = $1`, albumID)
+	return err
+}
+
+func (p *Postgres) querySubscriptions(ctx context.Context, query string, args ...any) ([]model.Subscription, error) {
+	rows, err := p.db.QueryContext(ctx, rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []model.Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+// SaveAlbumCursor 新建或更新专辑的翻页进度
+func (p *Postgres) SaveAlbumCursor(ctx context.Context, cursor *model.AlbumCursor) error {
+	_, err := p.db.ExecContext(ctx, rebind(`
+        INSERT INTO album_cursors (album_id, url, msgid, itemidx, reached_end, update_time)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (album_id) DO UPDATE SET
+            url = excluded.url,
+            msgid = excluded.msgid,
+            itemidx = excluded.itemidx,
+            reached_end = excluded.reached_end,
+            update_time = excluded.update_time
+    `),
+		cursor.AlbumID,
+		cursor.URL,
+		cursor.Msgid,
+		cursor.Itemidx,
+		cursor.ReachedEnd,
+		cursor.UpdateTime,
+	)
+	return err
+}
+
+// GetAlbumCursor 按专辑 ID 获取翻页进度，不存在时返回 nil
+func (p *Postgres) GetAlbumCursor(ctx context.Context, albumID string) (*model.AlbumCursor, error) {
+	var cursor model.AlbumCursor
+	err := p.db.QueryRowContext(ctx, rebind(`
+        SELECT album_id, url, msgid, itemidx, reached_end, update_time
+        FROM album_cursors
+        WHERE album_id = ?
+    `), albumID).Scan(
+		&cursor.AlbumID,
+		&cursor.URL,
+		&cursor.Msgid,
+		&cursor.Itemidx,
+		&cursor.ReachedEnd,
+		&cursor.UpdateTime,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// GetTopics 获取全部主题及文章数
+func (p *Postgres) GetTopics(ctx context.Context) ([]Topic, error) {
+	return getTopics(ctx, p.db, postgresDialect)
+}
+
+// SaveAlbum 新建或更新专辑信息，专辑改名后其中文章的主题随之改变
+func (p *Postgres) SaveAlbum(ctx context.Context, album *model.Album) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := saveAlbum(ctx, tx, album); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SaveAccount 新建或更新公众号信息
+func (p *Postgres) SaveAccount(ctx context.Context, account *model.Account) error {
+	return saveAccount(ctx, p.db, account)
+}
+
+// GetAlbums 获取全部专辑
+func (p *Postgres) GetAlbums(ctx context.Context) ([]model.Album, error) {
+	return getAlbums(ctx, p.db, postgresDialect)
+}
+
+// GetAccounts 获取全部公众号
+func (p *Postgres) GetAccounts(ctx context.Context) ([]model.Account, error) {
+	return getAccounts(ctx, p.db, postgresDialect)
+}
+
+// UpdateArticleState 修改文章的阅读状态，旧 ID 同样可以使用。文章不存在时返回 nil
+func (p *Postgres) UpdateArticleState(ctx context.Context, id string, patch ArticleStatePatch) (*model.ArticleState, error) {
+	id, err := resolveArticleID(ctx, p.db, postgresDialect, id)
+	if err != nil {
+		return nil, err
+	}
+	return updateArticleState(ctx, p.db, postgresDialect, id, patch)
+}
+
+// MarkArticlesRead 把专辑或主题中的文章全部标记为已读，返回新标记的文章数
+func (p *Postgres) MarkArticlesRead(ctx context.Context, albumID, topic string) (int, error) {
+	return markArticlesRead(ctx, p.db, postgresDialect, albumID, topic)
+}
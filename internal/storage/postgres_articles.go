@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"wechat-reader/internal/model"
+)
+
+// tsvector 中词的最大位置，以及每个词最多记录的位置数
+const (
+	pgMaxPosition  = 16383
+	pgMaxPositions = 256
+)
+
+func (p *Postgres) SaveArticles(ctx context.Context, articles []model.Article) error {
+	return saveArticles(ctx, p.db, postgresDialect, p, articles)
+}
+
+func (p *Postgres) GetArticles(ctx context.Context) ([]model.Article, error) {
+	return getArticles(ctx, p.db, postgresDialect)
+}
+
+// HasArticle 判断指定链接的文章是否已保存
+func (p *Postgres) HasArticle(ctx context.Context, url string) (bool, error) {
+	return hasArticle(ctx, p.db, postgresDialect, url)
+}
+
+// QueryArticles 按条件分页查询文章，与 SQLite 的实现共用查询逻辑
+func (p *Postgres) QueryArticles(ctx context.Context, q ArticleQuery) (*ArticleList, error) {
+	return queryArticles(ctx, p.db, postgresDialect, q)
+}
+
+// GetArticle 按 ID 获取文章及正文，旧 ID 同样可以查到。不存在时返回 nil
+func (p *Postgres) GetArticle(ctx context.Context, id string) (*model.Article, error) {
+	return getArticle(ctx, p.db, postgresDialect, id)
+}
+
+// GetArticleNeighbors 获取同一主题中发布时间紧邻的上一篇和下一篇
+func (p *Postgres) GetArticleNeighbors(ctx context.Context, id string) (*ArticleNeighbors, error) {
+	return getArticleNeighbors(ctx, p.db, postgresDialect, id)
+}
+
+// UpdateArticle 手动修改文章标题、主题等字段。文章不存在时返回 nil
+func (p *Postgres) UpdateArticle(ctx context.Context, id string, patch ArticlePatch) (*model.Article, error) {
+	return updateArticle(ctx, p.db, postgresDialect, p, id, patch)
+}
+
+// DeleteArticle 删除文章及其别名，返回文章是否存在。删除的文章重新抓取时不再保存
+func (p *Postgres) DeleteArticle(ctx context.Context, id string) (bool, error) {
+	return deleteArticle(ctx, p.db, postgresDialect, p, id)
+}
+
+// MergeDuplicateArticles 按规范化链接合并重复的文章，返回删除的重复记录数
+func (p *Postgres) MergeDuplicateArticles(ctx context.Context) (int, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	merged, kept, err := mergeDuplicates(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	// 合并时可能补全了正文，重新建立索引
+	for _, id := range kept {
+		if err := p.indexArticle(ctx, tx, id); err != nil {
+			return 0, err
+		}
+	}
+	return merged, tx.Commit()
+}
+
+// indexArticle 按当前的标题和正文更新文章的 search_vector
+func (p *Postgres) indexArticle(ctx context.Context, db execQuerier, id string) error {
+	var title, content string
+	err := db.QueryRowContext(ctx, `
+        SELECT title, COALESCE(content, '') FROM articles WHERE id = $1
+    `, id).Scan(&title, &content)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+        UPDATE articles SET search_vector = $1::text::tsvector WHERE id = $2
+    `, tsvectorLiteral(title, plainText(content)), id)
+	return err
+}
+
+// unindexArticle search_vector 保存在文章的行中，随文章一起删除
+func (p *Postgres) unindexArticle(ctx context.Context, db execQuerier, id string) error {
+	return nil
+}
+
+// Search 在标题和正文中搜索，按 ts_rank 排序，标题匹配的权重更高
+func (p *Postgres) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	return search(ctx, p.db, postgresDialect, q, func(terms []string) *searchPlan {
+		expr := tsqueryLiteral(q.Query)
+		if expr == "" {
+			return nil
+		}
+		return &searchPlan{
+			from:  "(SELECT ?::text::tsquery AS q) tq, articles a",
+			where: []string{"a.search_vector @@ tq.q"},
+			args:  []any{expr},
+			order: "ts_rank(a.search_vector, tq.q) DESC, a.publish_time DESC",
+		}
+	})
+}
+
+// tsvectorLiteral 把标题和正文切分后的词写成 tsvector 文本，标题的权重为 A，正文为 B。
+// 正文的位置与标题隔开一位，短语不会跨标题和正文匹配
+func tsvectorLiteral(title, body string) string {
+	positions := make(map[string][]string)
+	var order []string
+	pos := 0
+	add := func(text, weight string) {
+		for _, token := range strings.Fields(segment(text)) {
+			pos++
+			if pos > pgMaxPosition {
+				return
+			}
+			if _, ok := positions[token]; !ok {
+				order = append(order, token)
+			}
+			if len(positions[token]) < pgMaxPositions {
+				positions[token] = append(positions[token], strconv.Itoa(pos)+weight)
+			}
+		}
+	}
+	add(title, "A")
+	pos++
+	add(body, "B")
+
+	var b strings.Builder
+	for i, token := range order {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		// 切分出的词只包含字母和数字，不需要转义
+		b.WriteString("'" + token + "':" + strings.Join(positions[token], ","))
+	}
+	return b.String()
+}
+
+// tsqueryLiteral 与 matchExpr 相同的规则生成 tsquery：中日韩片段是二元组组成的短语，
+// 单字使用前缀查询，各片段之间为 AND。没有可搜索的词时返回空字符串
+func tsqueryLiteral(query string) string {
+	var terms []string
+	for _, run := range segmentRuns(query) {
+		rs := []rune(run)
+		switch {
+		case !isCJK(rs[0]):
+			terms = append(terms, "'"+run+"'")
+		case len(rs) == 1:
+			terms = append(terms, "'"+run+"':*")
+		default:
+			grams := bigrams(run)
+			phrase := make([]string, len(grams)-1)
+			for i, g := range grams[:len(grams)-1] {
+				phrase[i] = "'" + g + "'"
+			}
+			terms = append(terms, "("+strings.Join(phrase, " <-> ")+")")
+		}
+	}
+	return strings.Join(terms, " & ")
+}
+
+// ReplaceArticleContent 把文章正文从 old 改为 content，正文在此期间被重新抓取的文章不修改
+func (p *Postgres) ReplaceArticleContent(ctx context.Context, id, old, content string) (bool, error) {
+	return replaceArticleContent(ctx, p.db, id, old, content)
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+// ErrInvalidQuery 查询参数无效，例如不支持的排序字段或不匹配的分页游标
+var ErrInvalidQuery = errors.New("无效的查询参数")
+
+const (
+	defaultArticleLimit = 20
+	maxArticleLimit     = 100
+)
+
+// dialect 文章查询中 SQLite 和 PostgreSQL 写法不同的部分
+type dialect struct {
+	// sortExprs 可排序的字段及其排序表达式
+	sortExprs map[string]string
+	// timeValue 把时间列或参数转换为可以比较大小的值
+	timeValue func(expr string) string
+	// timeText 把时间列转换为 UTC 的 "2006-01-02 15:04:05" 文本，NULL 时为当前时间
+	timeText func(column string) string
+	// nullTimeText 与 timeText 相同，但 NULL 时仍为 NULL
+	nullTimeText func(column string) string
+	// bind 把 ? 占位符转换为数据库使用的形式
+	bind func(query string) string
+	// collate 按文本排序时追加的排序规则，使两种数据库的排序结果一致
+	collate string
+}
+
+// SQLite 的时间按 julianday 比较，不受存储时区格式影响
+var sqliteDialect = dialect{
+	sortExprs: map[string]string{
+		"publish_time": "COALESCE(julianday(publish_time), 0)",
+		"create_time":  "COALESCE(julianday(create_time), 0)",
+		"title":        "title",
+	},
+	timeValue: func(expr string) string { return "julianday(" + expr + ")" },
+	timeText: func(column string) string {
+		return "strftime('%Y-%m-%d %H:%M:%S', COALESCE(" + column + ", CURRENT_TIMESTAMP))"
+	},
+	nullTimeText: func(column string) string {
+		return "strftime('%Y-%m-%d %H:%M:%S', " + column + ")"
+	},
+	bind: func(query string) string { return query },
+}
+
+// ArticleQuery 文章列表的过滤、排序和分页条件，零值表示不限制
+type ArticleQuery struct {
+	Topic   string
+	AlbumID string
+	Author  string
+	// Read、Starred 和 Archived 按阅读状态过滤，nil 表示不限制
+	Read     *bool
+	Starred  *bool
+	Archived *bool
+	// From 和 To 限制发布时间，From 包含在内，To 不包含
+	From time.Time
+	To   time.Time
+	// Sort 排序字段：publish_time（默认）、create_time 或 title
+	Sort string
+	// Order 排序方向：asc 或 desc。时间默认从新到旧，标题默认升序
+	Order string
+	// Limit 每页数量，默认 20，最多 100
+	Limit int
+	// Cursor 上一页返回的 NextCursor，为空时从第一页开始
+	Cursor string
+}
+
+// ArticleList 一页文章列表，文章不包含正文
+type ArticleList struct {
+	Articles   []model.Article
+	NextCursor string // 没有下一页时为空
+	Total      int    // 符合过滤条件的文章总数
+}
+
+// articleCursor 分页游标，记录上一页最后一篇文章的排序值和 ID
+type articleCursor struct {
+	Sort string `json:"s"`
+	Key  any    `json:"k"`
+	ID   string `json:"id"`
+}
+
+// QueryArticles 按条件分页查询文章，使用上一页最后一条记录作为游标，
+// 翻页期间插入的新文章不会导致重复或遗漏
+func (d *Database) QueryArticles(ctx context.Context, q ArticleQuery) (*ArticleList, error) {
+	return queryArticles(ctx, d.db, sqliteDialect, q)
+}
+
+func queryArticles(ctx context.Context, db *sql.DB, dl dialect, q ArticleQuery) (*ArticleList, error) {
+	if q.Sort == "" {
+		q.Sort = "publish_time"
+	}
+	sortExpr, ok := dl.sortExprs[q.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: 不支持的排序字段 %s", ErrInvalidQuery, q.Sort)
+	}
+	if q.Order == "" {
+		q.Order = "desc"
+		if q.Sort == "title" {
+			q.Order = "asc"
+		}
+	}
+	if q.Order != "asc" && q.Order != "desc" {
+		return nil, fmt.Errorf("%w: 不支持的排序方向 %s", ErrInvalidQuery, q.Order)
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultArticleLimit
+	}
+	if q.Limit > maxArticleLimit {
+		q.Limit = maxArticleLimit
+	}
+
+	var where []string
+	var args []any
+	if q.Topic != "" {
+		where = append(where, "topic = ?")
+		args = append(args, q.Topic)
+	}
+	if q.AlbumID != "" {
+		where = append(where, "album_id = ?")
+		args = append(args, q.AlbumID)
+	}
+	if q.Author != "" {
+		where = append(where, "author = ?")
+		args = append(args, q.Author)
+	}
+	for _, f := range []struct {
+		value   *bool
+		yes, no string
+	}{
+		{q.Read, "s.read_time IS NOT NULL", "s.read_time IS NULL"},
+		{q.Starred, "s.starred IS TRUE", "s.starred IS NOT TRUE"},
+		{q.Archived, "s.archived IS TRUE", "s.archived IS NOT TRUE"},
+	} {
+		if f.value == nil {
+			continue
+		}
+		if *f.value {
+			where = append(where, f.yes)
+		} else {
+			where = append(where, f.no)
+		}
+	}
+	if !q.From.IsZero() {
+		where = append(where, dl.timeValue("publish_time")+" >= "+dl.timeValue("?"))
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		where = append(where, dl.timeValue("publish_time")+" < "+dl.timeValue("?"))
+		args = append(args, q.To)
+	}
+
+	list := &ArticleList{Articles: []model.Article{}}
+	countQuery := "SELECT COUNT(*) FROM articles a" + articleStateJoin + whereClause(where)
+	if err := db.QueryRowContext(ctx, dl.bind(countQuery), args...).Scan(&list.Total); err != nil {
+		return nil, err
+	}
+
+	sortKey := q.Sort + " " + q.Order
+	if q.Cursor != "" {
+		cursor, err := decodeArticleCursor(q.Cursor)
+		if err != nil || cursor.Sort != sortKey {
+			return nil, fmt.Errorf("%w: 分页游标与排序条件不匹配", ErrInvalidQuery)
+		}
+		op := "<"
+		if q.Order == "asc" {
+			op = ">"
+		}
+		where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", sortExpr, op))
+		args = append(args, cursor.Key, cursor.Key, cursor.ID)
+	}
+
+	// 多取一条用于判断是否还有下一页
+	query := fmt.Sprintf(`
+        SELECT %[4]s,
+               %[1]s
+        FROM articles a%[5]s%[2]s
+        ORDER BY %[1]s %[3]s, id %[3]s
+        LIMIT ?
+    `, sortExpr, whereClause(where), q.Order, articleColumns(dl, false), articleStateJoin)
+	args = append(args, q.Limit+1)
+
+	rows, err := db.QueryContext(ctx, dl.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []any
+	for rows.Next() {
+		var key any
+		article, err := scanArticle(rows, &key)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := key.([]byte); ok {
+			key = string(b)
+		}
+
+		list.Articles = append(list.Articles, *article)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(list.Articles) > q.Limit {
+		list.Articles = list.Articles[:q.Limit]
+		last := list.Articles[q.Limit-1]
+		list.NextCursor, err = encodeArticleCursor(articleCursor{Sort: sortKey, Key: keys[q.Limit-1], ID: last.ID})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func encodeArticleCursor(c articleCursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeArticleCursor(s string) (*articleCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c articleCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
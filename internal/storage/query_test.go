@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	ctx := context.Background()
+	db, err := NewDatabase(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	t.Cleanup(func() { db.Close(ctx) })
+	return db
+}
+
+// seedArticles 保存 n 篇文章，第 i 篇在 base 之后 i 天发布，偶数篇属于主题 A
+func seedArticles(t *testing.T, db Store, n int, base time.Time) {
+	t.Helper()
+	var articles []model.Article
+	for i := 0; i < n; i++ {
+		topic := "B"
+		if i%2 == 0 {
+			topic = "A"
+		}
+		articles = append(articles, model.Article{
+			ID:          fmt.Sprintf("wx_%02d", i),
+			Title:       fmt.Sprintf("文章 %02d", i),
+			Author:      "作者" + topic,
+			Content:     "<p>正文</p>",
+			URL:         fmt.Sprintf("https://mp.weixin.qq.com/s?__biz=MzA=&mid=%d&idx=1", 1000+i),
+			Topic:       topic,
+			PublishTime: base.AddDate(0, 0, i),
+			CreateTime:  base,
+		})
+	}
+	if err := db.SaveArticles(context.Background(), articles); err != nil {
+		t.Fatalf("SaveArticles: %v", err)
+	}
+}
+
+func TestQueryArticlesPaginates(t *testing.T) {
+	db := newTestDatabase(t)
+	// 发布时间使用不同时区，排序仍按实际时间
+	base := time.Date(2025, 1, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	seedArticles(t, db, 7, base)
+
+	var ids []string
+	query := ArticleQuery{Limit: 3}
+	for page := 0; ; page++ {
+		list, err := db.QueryArticles(context.Background(), query)
+		if err != nil {
+			t.Fatalf("QueryArticles: %v", err)
+		}
+		if list.Total != 7 {
+			t.Errorf("total = %d, want 7", list.Total)
+		}
+		for _, a := range list.Articles {
+			if a.Content != "" {
+				t.Errorf("article %s includes content", a.ID)
+			}
+			ids = append(ids, a.ID)
+		}
+		if list.NextCursor == "" {
+			break
+		}
+		if page > 3 {
+			t.Fatal("pagination did not terminate")
+		}
+		query.Cursor = list.NextCursor
+	}
+
+	want := []string{"wx_06", "wx_05", "wx_04", "wx_03", "wx_02", "wx_01", "wx_00"}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("ids = %v, want newest first %v", ids, want)
+	}
+}
+
+func TestQueryArticlesFilters(t *testing.T) {
+	db := newTestDatabase(t)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	seedArticles(t, db, 6, base)
+	ctx := context.Background()
+
+	list, err := db.QueryArticles(ctx, ArticleQuery{
+		Topic: "A",
+		From:  base.AddDate(0, 0, 1),
+		To:    base.AddDate(0, 0, 5),
+		Sort:  "title",
+	})
+	if err != nil {
+		t.Fatalf("QueryArticles: %v", err)
+	}
+	if list.Total != 2 || len(list.Articles) != 2 || list.Articles[0].ID != "wx_02" || list.Articles[1].ID != "wx_04" {
+		t.Errorf("got total %d, %+v; want wx_02, wx_04", list.Total, list.Articles)
+	}
+
+	list, err = db.QueryArticles(ctx, ArticleQuery{Author: "作者B", Sort: "title", Order: "desc", Limit: 1})
+	if err != nil {
+		t.Fatalf("QueryArticles: %v", err)
+	}
+	if list.Total != 3 || list.Articles[0].ID != "wx_05" {
+		t.Errorf("got total %d, first %s; want 3, wx_05", list.Total, list.Articles[0].ID)
+	}
+
+	// 游标只能用于生成它的排序条件
+	_, err = db.QueryArticles(ctx, ArticleQuery{Sort: "create_time", Cursor: list.NextCursor})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("mismatched cursor error = %v, want ErrInvalidQuery", err)
+	}
+	_, err = db.QueryArticles(ctx, ArticleQuery{Sort: "content"})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("unknown sort error = %v, want ErrInvalidQuery", err)
+	}
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+// 搜索结果摘要的最大长度（字符数）
+const snippetRunes = 120
+
+// SearchQuery 全文搜索条件
+type SearchQuery struct {
+	Query   string
+	Topic   string
+	AlbumID string
+	// From 和 To 限制发布时间，From 包含在内，To 不包含
+	From time.Time
+	To   time.Time
+	// Limit 返回数量，默认 20，最多 100
+	Limit int
+}
+
+// SearchResult 一条搜索结果。TitleHighlight 和 Snippet 已转义，匹配部分用 <mark> 标出
+type SearchResult struct {
+	model.Article
+	TitleHighlight string `json:"title_highlight"`
+	Snippet        string `json:"snippet"`
+}
+
+// execQuerier 由 *sql.DB 和 *sql.Tx 实现
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// initSearch 创建 FTS5 索引表。go-sqlite3 需要 sqlite_fts5 编译标签才包含 FTS5，
+// 不支持时返回 false，搜索退化为 LIKE 匹配
+func initSearch(ctx context.Context, db *sql.DB) (bool, error) {
+	// 索引中的 title、body 是 segment 切分后的词，rowid 与 articles 的 rowid 相同
+	_, err := db.ExecContext(ctx, `
+        CREATE VIRTUAL TABLE IF NOT EXISTS articles_fts USING fts5(article_id UNINDEXED, title, body)
+    `)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			slog.WarnContext(ctx, "SQLite 未启用 FTS5，搜索使用 LIKE 匹配。使用 -tags sqlite_fts5 编译以启用全文索引")
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// syncSearchIndex 修复与 articles 不一致的索引：删除已不存在或 ID 已变化的记录，
+// 补充缺少的记录。用于首次建立索引、数据迁移和合并重复文章之后
+func (d *Database) syncSearchIndex(ctx context.Context) error {
+	if !d.fts {
+		return nil
+	}
+
+	if _, err := d.db.ExecContext(ctx, `
+        DELETE FROM articles_fts
+        WHERE article_id IS NOT (SELECT id FROM articles WHERE articles.rowid = articles_fts.rowid)
+    `); err != nil {
+		return err
+	}
+
+	rows, err := d.db.QueryContext(ctx, `
+        SELECT id FROM articles a
+        WHERE NOT EXISTS (SELECT 1 FROM articles_fts f WHERE f.rowid = a.rowid)
+    `)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range missing {
+		if err := d.indexArticle(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "全文索引已更新", "articles", len(missing))
+	return nil
+}
+
+// indexArticle 按 articles 中当前的标题和正文重建一篇文章的索引
+func (d *Database) indexArticle(ctx context.Context, db execQuerier, id string) error {
+	if !d.fts {
+		return nil
+	}
+
+	var rowid int64
+	var title, content string
+	err := db.QueryRowContext(ctx, `
+        SELECT rowid, title, COALESCE(content, '') FROM articles WHERE id = ?
+    `, id).Scan(&rowid, &title, &content)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM articles_fts WHERE rowid = ?`, rowid); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+        INSERT INTO articles_fts (rowid, article_id, title, body) VALUES (?, ?, ?, ?)
+    `, rowid, id, segment(title), segment(plainText(content)))
+	return err
+}
+
+// unindexArticle 删除一篇文章的索引，在删除文章之前调用
+func (d *Database) unindexArticle(ctx context.Context, db execQuerier, id string) error {
+	if !d.fts {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `
+        DELETE FROM articles_fts WHERE rowid = (SELECT rowid FROM articles WHERE id = ?)
+    `, id)
+	return err
+}
+
+// searchPlan 全文匹配部分的写法，由各数据库根据搜索词生成
+type searchPlan struct {
+	// from 查询的表，文章表的别名为 a
+	from string
+	// where 匹配搜索词的条件，args 为 from 和 where 中的参数
+	where []string
+	args  []any
+	// order 按相关度排序的表达式，orderArgs 为其中的参数
+	order     string
+	orderArgs []any
+}
+
+// search 按 plan 匹配搜索词，再按主题、专辑和发布时间过滤。SQLite 和 PostgreSQL 共用，
+// plan 返回 nil 时表示没有可搜索的词
+func search(ctx context.Context, db *sql.DB, dl dialect, q SearchQuery, plan func(terms []string) *searchPlan) ([]SearchResult, error) {
+	terms := strings.Fields(q.Query)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%w: 搜索词不能为空", ErrInvalidQuery)
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultArticleLimit
+	}
+	if q.Limit > maxArticleLimit {
+		q.Limit = maxArticleLimit
+	}
+	p := plan(terms)
+	if p == nil {
+		return []SearchResult{}, nil
+	}
+
+	where := p.where
+	args := p.args
+	if q.Topic != "" {
+		where = append(where, "a.topic = ?")
+		args = append(args, q.Topic)
+	}
+	if q.AlbumID != "" {
+		where = append(where, "a.album_id = ?")
+		args = append(args, q.AlbumID)
+	}
+	if !q.From.IsZero() {
+		where = append(where, dl.timeValue("a.publish_time")+" >= "+dl.timeValue("?"))
+		args = append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		where = append(where, dl.timeValue("a.publish_time")+" < "+dl.timeValue("?"))
+		args = append(args, q.To)
+	}
+	args = append(append(args, p.orderArgs...), q.Limit)
+
+	rows, err := db.QueryContext(ctx, dl.bind(`
+        SELECT `+articleColumns(dl, true)+`
+        FROM `+p.from+articleStateJoin+whereClause(where)+`
+        ORDER BY `+p.order+`
+        LIMIT ?
+    `), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		article, err := scanArticle(rows)
+		if err != nil {
+			return nil, err
+		}
+		r := SearchResult{Article: *article}
+		r.TitleHighlight = highlight(r.Title, terms, 0)
+		r.Snippet = highlight(plainText(r.Content), terms, snippetRunes)
+		// 结果中不返回正文
+		r.Content = ""
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
+
+// Search 在标题和正文中搜索，按相关度排序。启用 FTS5 时标题匹配的权重更高，
+// 否则按标题是否匹配和发布时间排序
+func (d *Database) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	return search(ctx, d.db, sqliteDialect, q, func(terms []string) *searchPlan {
+		if d.fts {
+			expr := matchExpr(q.Query)
+			if expr == "" {
+				return nil
+			}
+			return &searchPlan{
+				from:  "articles_fts f JOIN articles a ON a.rowid = f.rowid",
+				where: []string{"articles_fts MATCH ?"},
+				args:  []any{expr},
+				order: "bm25(articles_fts, 0, 10.0, 1.0)",
+			}
+		}
+
+		p := &searchPlan{from: "articles a"}
+		var titleMatch []string
+		for _, term := range terms {
+			p.where = append(p.where, "(instr(lower(a.title), ?) > 0 OR instr(lower(a.content), ?) > 0)")
+			p.args = append(p.args, strings.ToLower(term), strings.ToLower(term))
+			titleMatch = append(titleMatch, "instr(lower(a.title), ?) > 0")
+			p.orderArgs = append(p.orderArgs, strings.ToLower(term))
+		}
+		p.order = "(" + strings.Join(titleMatch, " AND ") + ") DESC, julianday(a.publish_time) DESC"
+		return p
+	})
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+func TestSegment(t *testing.T) {
+	got := segment("硅谷教父Paul Graham：创业")
+	want := "硅谷 谷教 教父 父 paul graham 创业 业"
+	if got != want {
+		t.Errorf("segment = %q, want %q", got, want)
+	}
+
+	if got := matchExpr("创业者 AI 金"); got != `"创业 业者" AND "ai" AND "金"*` {
+		t.Errorf("matchExpr = %q", got)
+	}
+}
+
+func TestPostgresSearchLiterals(t *testing.T) {
+	if got := tsqueryLiteral("创业者 AI 金"); got != `('创业' <-> '业者') & 'ai' & '金':*` {
+		t.Errorf("tsqueryLiteral = %q", got)
+	}
+	// 正文位置与标题隔开一位
+	if got := tsvectorLiteral("创业", "AI 创业"); got != `'创业':1A,5B '业':2A,6B 'ai':4B` {
+		t.Errorf("tsvectorLiteral = %q", got)
+	}
+	if got := rebind(`SELECT 1 WHERE a = ? AND b = ?`); got != `SELECT 1 WHERE a = $1 AND b = $2` {
+		t.Errorf("rebind = %q", got)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got := highlight("Tesla <b>创业</b>故事", []string{"tesla", "创业"}, 0)
+	want := "<mark>Tesla</mark> &lt;b&gt;<mark>创业</mark>&lt;/b&gt;故事"
+	if got != want {
+		t.Errorf("highlight = %q, want %q", got, want)
+	}
+
+	long := strings.Repeat("前", 200) + "目标" + strings.Repeat("后", 200)
+	snippet := highlight(long, []string{"目标"}, 40)
+	if !strings.HasPrefix(snippet, "…") || !strings.HasSuffix(snippet, "…") || !strings.Contains(snippet, "<mark>目标</mark>") {
+		t.Errorf("snippet = %q", snippet)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := db.SaveArticles(ctx, []model.Article{
+		{ID: "wx_1", Title: "英伟达的三十年", Content: "<p>从显卡到 AI 的<b>创业</b>故事</p>",
+			URL: "https://mp.weixin.qq.com/s?__biz=MzA=&mid=1&idx=1", Topic: "A", PublishTime: base},
+		{ID: "wx_2", Title: "创业者的金点子", Content: "<p>Paul Graham 谈创业</p>",
+			URL: "https://mp.weixin.qq.com/s?__biz=MzA=&mid=2&idx=1", Topic: "B", PublishTime: base.AddDate(0, 0, 1)},
+		{ID: "wx_3", Title: "无关文章", Content: "<p>天气很好</p>",
+			URL: "https://mp.weixin.qq.com/s?__biz=MzA=&mid=3&idx=1", Topic: "A", PublishTime: base.AddDate(0, 0, 2)},
+	})
+	if err != nil {
+		t.Fatalf("SaveArticles: %v", err)
+	}
+
+	results, err := db.Search(ctx, SearchQuery{Query: "创业"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	// 标题匹配的文章排在前面
+	if results[0].ID != "wx_2" || results[1].ID != "wx_1" {
+		t.Errorf("order = %s, %s; want wx_2, wx_1", results[0].ID, results[1].ID)
+	}
+	if results[0].TitleHighlight != "<mark>创业</mark>者的金点子" {
+		t.Errorf("title highlight = %q", results[0].TitleHighlight)
+	}
+	if !strings.Contains(results[1].Snippet, "<mark>创业</mark>故事") || results[1].Content != "" {
+		t.Errorf("snippet = %q, content = %q", results[1].Snippet, results[1].Content)
+	}
+
+	// 单字、英文不区分大小写、主题过滤
+	if results, _ := db.Search(ctx, SearchQuery{Query: "卡"}); len(results) != 1 || results[0].ID != "wx_1" {
+		t.Errorf("single character search = %+v", results)
+	}
+	if results, _ := db.Search(ctx, SearchQuery{Query: "paul"}); len(results) != 1 || results[0].ID != "wx_2" {
+		t.Errorf("latin search = %+v", results)
+	}
+	if results, _ := db.Search(ctx, SearchQuery{Query: "创业", Topic: "A"}); len(results) != 1 || results[0].ID != "wx_1" {
+		t.Errorf("topic filter = %+v", results)
+	}
+
+	// 修改标题和删除文章后索引同步
+	title := "天气"
+	if _, err := db.UpdateArticle(ctx, "wx_2", ArticlePatch{Title: &title}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeleteArticle(ctx, "wx_1"); err != nil {
+		t.Fatal(err)
+	}
+	results, _ = db.Search(ctx, SearchQuery{Query: "天气"})
+	if len(results) != 2 {
+		t.Errorf("after update got %d results for new title, want 2", len(results))
+	}
+	if results, _ := db.Search(ctx, SearchQuery{Query: "显卡"}); len(results) != 0 {
+		t.Errorf("deleted article still found: %+v", results)
+	}
+
+	if _, err := db.Search(ctx, SearchQuery{Query: "  "}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("empty query error = %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// isCJK 中日韩文字没有空格分词，按二元组切分
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// segmentRuns 把文本切分为连续的中日韩文字和字母数字片段，字母统一小写
+func segmentRuns(text string) (runs []string) {
+	var cur []rune
+	curCJK := false
+	flush := func() {
+		if len(cur) > 0 {
+			runs = append(runs, string(cur))
+			cur = cur[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			if !curCJK {
+				flush()
+			}
+			curCJK = true
+			cur = append(cur, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if curCJK {
+				flush()
+			}
+			curCJK = false
+			cur = append(cur, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return runs
+}
+
+// bigrams 把中日韩文字片段切分为相邻两字的二元组，最后一个字单独作为一个词，
+// 这样任意单字都是某个词的前缀
+func bigrams(run string) []string {
+	rs := []rune(run)
+	var tokens []string
+	for i := 0; i+1 < len(rs); i++ {
+		tokens = append(tokens, string(rs[i:i+2]))
+	}
+	return append(tokens, string(rs[len(rs)-1:]))
+}
+
+// segment 把文本转换为以空格分隔的词，写入全文索引
+func segment(text string) string {
+	var tokens []string
+	for _, run := range segmentRuns(text) {
+		if isCJK([]rune(run)[0]) {
+			tokens = append(tokens, bigrams(run)...)
+		} else {
+			tokens = append(tokens, run)
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// matchExpr 把搜索词转换为 FTS5 查询：每个中日韩片段是其二元组组成的短语，
+// 单字使用前缀查询，各片段之间为 AND。没有可搜索的词时返回空字符串
+func matchExpr(query string) string {
+	var terms []string
+	for _, run := range segmentRuns(query) {
+		rs := []rune(run)
+		switch {
+		case !isCJK(rs[0]):
+			terms = append(terms, `"`+run+`"`)
+		case len(rs) == 1:
+			terms = append(terms, `"`+run+`"*`)
+		default:
+			grams := bigrams(run)
+			terms = append(terms, `"`+strings.Join(grams[:len(grams)-1], " ")+`"`)
+		}
+	}
+	return strings.Join(terms, " AND ")
+}
+
+// plainText 提取正文 HTML 中的文字
+func plainText(content string) string {
+	if content == "" {
+		return ""
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+	return strings.Join(strings.Fields(doc.Text()), " ")
+}
+
+// highlight 转义文本并用 <mark> 标出 terms 出现的位置。
+// maxRunes 大于 0 时截取第一个匹配附近的一段
+func highlight(text string, terms []string, maxRunes int) string {
+	rs := []rune(text)
+	lower := make([]rune, len(rs))
+	for i, r := range rs {
+		lower[i] = unicode.ToLower(r)
+	}
+	var needles [][]rune
+	for _, t := range terms {
+		if t = strings.ToLower(t); t != "" {
+			needles = append(needles, []rune(t))
+		}
+	}
+
+	matchAt := func(i int) int {
+		for _, n := range needles {
+			if i+len(n) <= len(lower) && string(lower[i:i+len(n)]) == string(n) {
+				return len(n)
+			}
+		}
+		return 0
+	}
+
+	start, end := 0, len(rs)
+	if maxRunes > 0 && len(rs) > maxRunes {
+		first := -1
+		for i := range lower {
+			if matchAt(i) > 0 {
+				first = i
+				break
+			}
+		}
+		// 匹配位置之前保留一小段上下文
+		if first > maxRunes/4 {
+			start = first - maxRunes/4
+		}
+		end = min(start+maxRunes, len(rs))
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		if n := matchAt(i); n > 0 {
+			n = min(n, end-i)
+			b.WriteString("<mark>")
+			b.WriteString(html.EscapeString(string(rs[i : i+n])))
+			b.WriteString("</mark>")
+			i += n
+			continue
+		}
+		b.WriteString(html.EscapeString(string(rs[i])))
+		i++
+	}
+	if end < len(rs) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
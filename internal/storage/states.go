@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+// 文章的阅读状态单独保存在 article_states 表中，重新抓取文章时不受影响。
+// 没有记录的文章为未读、未加星标、未归档
+
+// ArticleStatePatch 修改文章阅读状态的字段，nil 表示不修改
+type ArticleStatePatch struct {
+	Read     *bool `json:"read"`
+	Starred  *bool `json:"starred"`
+	Archived *bool `json:"archived"`
+	Progress *int  `json:"progress"` // 阅读进度百分比，0 到 100
+	Opened   bool  `json:"opened"`   // 为 true 时把最近打开时间记为当前时间
+}
+
+// updateArticleState 修改文章的阅读状态并返回修改后的状态，文章不存在时返回 nil。
+// 已读的文章再次标记已读时保留第一次的已读时间
+func updateArticleState(ctx context.Context, db *sql.DB, dl dialect, id string, patch ArticleStatePatch) (*model.ArticleState, error) {
+	if patch.Progress != nil && (*patch.Progress < 0 || *patch.Progress > 100) {
+		return nil, fmt.Errorf("%w: 阅读进度应在 0 到 100 之间", ErrInvalidQuery)
+	}
+
+	now := time.Now()
+	var sets []string
+	var args []any
+	if patch.Read != nil {
+		if *patch.Read {
+			sets = append(sets, "read_time = COALESCE(read_time, ?)")
+			args = append(args, now)
+		} else {
+			sets = append(sets, "read_time = NULL")
+		}
+	}
+	if patch.Starred != nil {
+		sets = append(sets, "starred = ?")
+		args = append(args, *patch.Starred)
+	}
+	if patch.Archived != nil {
+		sets = append(sets, "archived = ?")
+		args = append(args, *patch.Archived)
+	}
+	if patch.Progress != nil {
+		sets = append(sets, "progress = ?")
+		args = append(args, *patch.Progress)
+	}
+	if patch.Opened {
+		sets = append(sets, "last_open_time = ?")
+		args = append(args, now)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, dl.bind(`SELECT EXISTS(SELECT 1 FROM articles WHERE id = ?)`), id).Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	if len(sets) > 0 {
+		if _, err := tx.ExecContext(ctx, dl.bind(`
+            INSERT INTO article_states (article_id) VALUES (?) ON CONFLICT (article_id) DO NOTHING
+        `), id); err != nil {
+			return nil, err
+		}
+		query := `UPDATE article_states SET ` + strings.Join(sets, ", ") + ` WHERE article_id = ?`
+		if _, err := tx.ExecContext(ctx, dl.bind(query), append(args, id)...); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &model.ArticleState{}
+	var lastOpenStr sql.NullString
+	err = tx.QueryRowContext(ctx, dl.bind(`
+        SELECT read_time IS NOT NULL, starred IS TRUE, archived IS TRUE, progress,
+               `+dl.nullTimeText("last_open_time")+`
+        FROM article_states
+        WHERE article_id = ?
+    `), id).Scan(&state.Read, &state.Starred, &state.Archived, &state.Progress, &lastOpenStr)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if lastOpenStr.Valid {
+		if t, err := time.Parse("2006-01-02 15:04:05", lastOpenStr.String); err == nil {
+			state.LastOpenTime = &t
+		}
+	}
+	return state, tx.Commit()
+}
+
+// markArticlesRead 把专辑或主题中的未读文章标记为已读，都为空时标记全部文章，返回新标记的文章数
+func markArticlesRead(ctx context.Context, db *sql.DB, dl dialect, albumID, topic string) (int, error) {
+	var where []string
+	var args []any
+	if albumID != "" {
+		where = append(where, "album_id = ?")
+		args = append(args, albumID)
+	}
+	if topic != "" {
+		where = append(where, "topic = ?")
+		args = append(args, topic)
+	}
+	// INSERT ... SELECT 后接 ON CONFLICT 时 SQLite 要求 SELECT 带有 WHERE
+	cond := " WHERE TRUE"
+	if len(where) > 0 {
+		cond = whereClause(where)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, dl.bind(`
+        INSERT INTO article_states (article_id)
+        SELECT id FROM articles`+cond+`
+        ON CONFLICT (article_id) DO NOTHING
+    `), args...); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, dl.bind(`
+        UPDATE article_states SET read_time = ?
+        WHERE read_time IS NULL AND article_id IN (SELECT id FROM articles`+cond+`)
+    `), append([]any{time.Now()}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// moveArticleState 合并重复文章时把 fromID 的阅读状态并入 toID：
+// 任意一条已读、加星标或归档即保留该状态，进度取较大的值，已读时间和打开时间优先保留 toID 的。
+// 与 mergeArticle 一样由 SQLite 和 PostgreSQL 共用，使用 $n 占位符
+func moveArticleState(ctx context.Context, tx *sql.Tx, fromID, toID string) error {
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO article_states (article_id, read_time, starred, archived, progress, last_open_time)
+        SELECT CAST($2 AS TEXT), read_time, starred, archived, progress, last_open_time
+        FROM article_states WHERE article_id = $1
+        ON CONFLICT (article_id) DO UPDATE SET
+            read_time = COALESCE(article_states.read_time, excluded.read_time),
+            starred = article_states.starred OR excluded.starred,
+            archived = article_states.archived OR excluded.archived,
+            progress = CASE WHEN excluded.progress > article_states.progress
+                THEN excluded.progress ELSE article_states.progress END,
+            last_open_time = COALESCE(article_states.last_open_time, excluded.last_open_time)
+    `, fromID, toID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM article_states WHERE article_id = $1`, fromID)
+	return err
+}
+
+// UpdateArticleState 修改文章的阅读状态，旧 ID 同样可以使用。文章不存在时返回 nil
+func (d *Database) UpdateArticleState(ctx context.Context, id string, patch ArticleStatePatch) (*model.ArticleState, error) {
+	id, err := resolveArticleID(ctx, d.db, sqliteDialect, id)
+	if err != nil {
+		return nil, err
+	}
+	return updateArticleState(ctx, d.db, sqliteDialect, id, patch)
+}
+
+// MarkArticlesRead 把专辑或主题中的文章全部标记为已读，返回新标记的文章数
+func (d *Database) MarkArticlesRead(ctx context.Context, albumID, topic string) (int, error) {
+	return markArticlesRead(ctx, d.db, sqliteDialect, albumID, topic)
+}
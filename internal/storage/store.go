@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+// Store 文章、专辑、公众号、抓取任务、订阅和专辑翻页进度的存储。
+// Database 基于 SQLite，适合单机部署；Postgres 基于 PostgreSQL，可以由多个服务实例共用
+type Store interface {
+	Close(ctx context.Context) error
+
+	// Migrate 执行未执行的数据库迁移，MigrationStatus 只查看不执行
+	Migrate(ctx context.Context) ([]Migration, error)
+	MigrationStatus(ctx context.Context) (*MigrationStatus, error)
+
+	SaveArticles(ctx context.Context, articles []model.Article) error
+	GetArticles(ctx context.Context) ([]model.Article, error)
+	HasArticle(ctx context.Context, url string) (bool, error)
+	GetTopics(ctx context.Context) ([]Topic, error)
+	QueryArticles(ctx context.Context, q ArticleQuery) (*ArticleList, error)
+	GetArticle(ctx context.Context, id string) (*model.Article, error)
+	GetArticleNeighbors(ctx context.Context, id string) (*ArticleNeighbors, error)
+	UpdateArticle(ctx context.Context, id string, patch ArticlePatch) (*model.Article, error)
+	DeleteArticle(ctx context.Context, id string) (bool, error)
+	ReplaceArticleContent(ctx context.Context, id, old, content string) (bool, error)
+	Search(ctx context.Context, q SearchQuery) ([]SearchResult, error)
+	MergeDuplicateArticles(ctx context.Context) (int, error)
+	UpdateArticleState(ctx context.Context, id string, patch ArticleStatePatch) (*model.ArticleState, error)
+	MarkArticlesRead(ctx context.Context, albumID, topic string) (int, error)
+
+	SaveAlbum(ctx context.Context, album *model.Album) error
+	GetAlbums(ctx context.Context) ([]model.Album, error)
+	SaveAccount(ctx context.Context, account *model.Account) error
+	GetAccounts(ctx context.Context) ([]model.Account, error)
+
+	SaveJob(ctx context.Context, job *model.Job) error
+	GetJob(ctx context.Context, id string) (*model.Job, error)
+	GetJobs(ctx context.Context, status string, limit int) ([]model.Job, error)
+	ClaimJob(ctx context.Context, id, owner string, until time.Time) (bool, error)
+	UpdateJob(ctx context.Context, job *model.Job, owner string) (bool, error)
+	RenewJobLease(ctx context.Context, id, owner string, until time.Time) (bool, error)
+	RequestJobCancel(ctx context.Context, id string) (bool, error)
+	AcquireLease(ctx context.Context, name, owner string, until time.Time) (bool, error)
+
+	SaveSubscription(ctx context.Context, sub *model.Subscription) error
+	GetSubscription(ctx context.Context, albumID string) (*model.Subscription, error)
+	GetSubscriptions(ctx context.Context) ([]model.Subscription, error)
+	GetDueSubscriptions(ctx context.Context, now time.Time) ([]model.Subscription, error)
+	DeleteSubscription(ctx context.Context, albumID string) error
+
+	SaveAlbumCursor(ctx context.Context, cursor *model.AlbumCursor) error
+	GetAlbumCursor(ctx context.Context, albumID string) (*model.AlbumCursor, error)
+}
+
+var (
+	_ Store = (*Database)(nil)
+	_ Store = (*Postgres)(nil)
+)
+
+// NewStore 按 DSN 打开存储并执行未执行的迁移。
+// postgres:// 或 postgresql:// 开头的 DSN 使用 PostgreSQL，其余作为 SQLite 数据库文件路径，
+// 可以带 sqlite:// 前缀
+func NewStore(ctx context.Context, dsn string) (Store, error) {
+	if isPostgresDSN(dsn) {
+		return NewPostgres(ctx, dsn)
+	}
+	return NewDatabase(ctx, sqlitePath(dsn))
+}
+
+// OpenStore 按 DSN 打开存储但不执行迁移，用于 migrate 命令
+func OpenStore(ctx context.Context, dsn string) (Store, error) {
+	if isPostgresDSN(dsn) {
+		return OpenPostgres(ctx, dsn)
+	}
+	return OpenDatabase(ctx, sqlitePath(dsn))
+}
+
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+func sqlitePath(dsn string) string {
+	return strings.TrimPrefix(dsn, "sqlite://")
+}
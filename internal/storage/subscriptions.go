@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"wechat-reader/internal/model"
+)
+
+// SaveSubscription 新建或更新专辑订阅
+func (d *Database) SaveSubscription(ctx context.Context, sub *model.Subscription) error {
+	_, err := d.db.ExecContext(ctx, `
+        INSERT OR REPLACE INTO subscriptions (album_id, url, interval_minutes, last_job_id, last_refresh_time, next_refresh_time, create_time)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `,
+		sub.AlbumID,
+		sub.URL,
+		sub.IntervalMinutes,
+		sub.LastJobID,
+		sub.LastRefreshTime,
+		sub.NextRefreshTime,
+		sub.CreateTime,
+	)
+	return err
+}
+
+// GetSubscription 按专辑 ID 获取订阅，不存在时返回 nil
+func (d *Database) GetSubscription(ctx context.Context, albumID string) (*model.Subscription, error) {
+	row := d.db.QueryRowContext(ctx, `
+        SELECT album_id, url, interval_minutes, COALESCE(last_job_id, ''),
+               last_refresh_time, next_refresh_time, create_time
+        FROM subscriptions
+        WHERE album_id = ?
+    `, albumID)
+
+	sub, err := scanSubscription(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+// GetSubscriptions 获取全部订阅
+func (d *Database) GetSubscriptions(ctx context.Context) ([]model.Subscription, error) {
+	return d.querySubscriptions(ctx, `
+        SELECT album_id, url, interval_minutes, COALESCE(last_job_id, ''),
+               last_refresh_time, next_refresh_time, create_time
+        FROM subscriptions
+        ORDER BY create_time
+    `)
+}
+
+// GetDueSubscriptions 获取到期需要刷新的订阅
+func (d *Database) GetDueSubscriptions(ctx context.Context, now time.Time) ([]model.Subscription, error) {
+	return d.querySubscriptions(ctx, `
+        SELECT album_id, url, interval_minutes, COALESCE(last_job_id, ''),
+               last_refresh_time, next_refresh_time, create_time
+        FROM subscriptions
+        WHERE julianday(next_refresh_time) <= julianday(?)
+        ORDER BY next_refresh_time
+    `, now)
+}
+
+// DeleteSubscription 删除订阅，已保存的文章不受影响
+func (d *Database) DeleteSubscription(ctx context.Context, albumID string) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM subscriptions WHERE album_id = ?`, albumID)
+	return err
+}
+
+func (d *Database) querySubscriptions(ctx context.Context, query string, args ...any) ([]model.Subscription, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []model.Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+func scanSubscription(row rowScanner) (*model.Subscription, error) {
+	var sub model.Subscription
+	err := row.Scan(
+		&sub.AlbumID,
+		&sub.URL,
+		&sub.IntervalMinutes,
+		&sub.LastJobID,
+		&sub.LastRefreshTime,
+		&sub.NextRefreshTime,
+		&sub.CreateTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
@@ -0,0 +1,197 @@
+// Package wxurl 解析和规范化微信公众号文章链接
+package wxurl
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Host 微信公众号文章所在的域名
+const Host = "mp.weixin.qq.com"
+
+// ErrNotWechatURL 链接不是微信公众号链接
+var ErrNotWechatURL = errors.New("无效的微信文章链接")
+
+// 各类页面需要保留的参数，其余的 chksm、scene、sessionid 等都是分享和跟踪参数
+var keptParams = map[string][]string{
+	"/s":              {"__biz", "mid", "idx", "sn"},
+	"/mp/appmsgalbum": {"__biz", "action", "album_id", "is_reverse"},
+}
+
+// 其他页面中需要去掉的分享和跟踪参数
+var trackingParams = map[string]bool{
+	"chksm":                  true,
+	"scene":                  true,
+	"subscene":               true,
+	"sessionid":              true,
+	"clicktime":              true,
+	"enterid":                true,
+	"ascene":                 true,
+	"devicetype":             true,
+	"version":                true,
+	"nettype":                true,
+	"lang":                   true,
+	"exportkey":              true,
+	"pass_ticket":            true,
+	"wx_header":              true,
+	"abtest_cookie":          true,
+	"key":                    true,
+	"uin":                    true,
+	"from":                   true,
+	"srcid":                  true,
+	"sharer_shareinfo":       true,
+	"sharer_shareinfo_first": true,
+}
+
+// Params 文章链接中标识文章的参数
+type Params struct {
+	Biz string // 公众号标识 __biz
+	Mid string // 图文消息 ID，与专辑接口中的 msgid 相同
+	Idx string // 图文在消息中的位置，与专辑接口中的 itemidx 相同
+	Sn  string // 文章签名
+}
+
+// Parse 从文章链接中提取 __biz、mid、idx 和 sn，缺少的字段为空
+func Parse(rawURL string) Params {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return Params{}
+	}
+	return paramsOf(parseQuery(u))
+}
+
+func paramsOf(query url.Values) Params {
+	p := Params{
+		Biz: query.Get("__biz"),
+		Mid: query.Get("mid"),
+		Idx: query.Get("idx"),
+		Sn:  query.Get("sn"),
+	}
+	// 旧版链接使用 appmsgid/itemidx
+	if p.Mid == "" {
+		p.Mid = query.Get("appmsgid")
+	}
+	if p.Idx == "" {
+		p.Idx = query.Get("itemidx")
+	}
+	return p
+}
+
+// Normalize 将微信公众号链接转换为规范形式：统一使用 https，去掉锚点和跟踪参数，
+// 文章链接只保留 __biz、mid、idx 和 sn。同一篇文章的不同分享链接规范化后相同
+func Normalize(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNotWechatURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || strings.ToLower(u.Hostname()) != Host {
+		return "", ErrNotWechatURL
+	}
+
+	return normalize(u).String(), nil
+}
+
+// IsWechatURL 判断链接是否为微信公众号链接
+func IsWechatURL(rawURL string) bool {
+	_, err := Normalize(rawURL)
+	return err == nil
+}
+
+func normalize(u *url.URL) *url.URL {
+	query := parseQuery(u)
+	path := strings.TrimSuffix(u.Path, "/")
+
+	// 旧版文章链接 /mp/appmsg/show 统一为 /s
+	if path == "/mp/appmsg/show" {
+		p := paramsOf(query)
+		if p.Biz != "" && p.Mid != "" && p.Idx != "" {
+			path = "/s"
+			query = url.Values{"__biz": {p.Biz}, "mid": {p.Mid}, "idx": {p.Idx}, "sn": {p.Sn}}
+		}
+	}
+
+	kept := url.Values{}
+	if keys, ok := keptParams[path]; ok {
+		for _, key := range keys {
+			if v := query.Get(key); v != "" {
+				kept.Set(key, v)
+			}
+		}
+	} else {
+		for key, values := range query {
+			if !trackingParams[key] && len(values) > 0 && values[0] != "" {
+				kept.Set(key, values[0])
+			}
+		}
+	}
+
+	return &url.URL{
+		Scheme:   "https",
+		Host:     strings.ToLower(u.Host),
+		Path:     path,
+		RawQuery: kept.Encode(),
+	}
+}
+
+// parseQuery 解析查询参数，链接中的 &amp; 来自未解码的 HTML 属性
+func parseQuery(u *url.URL) url.Values {
+	query, _ := url.ParseQuery(strings.ReplaceAll(u.RawQuery, "&amp;", "&"))
+	return query
+}
+
+// WithMessage 为缺少 mid/idx 的文章链接补上专辑列表中的 msgid 和 itemidx，
+// 补全后文章 ID 只由链接决定，保存后的链接可以重新算出相同的 ID
+func WithMessage(link, msgid, itemidx string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return link
+	}
+	query := parseQuery(u)
+	p := paramsOf(query)
+	if strings.TrimSuffix(u.Path, "/") != "/s" || p.Biz == "" || (p.Mid != "" && p.Idx != "") {
+		return link
+	}
+	if p.Mid == "" && msgid != "" {
+		query.Set("mid", msgid)
+	}
+	if p.Idx == "" && itemidx != "" {
+		query.Set("idx", itemidx)
+	}
+	u.RawQuery = query.Encode()
+	return normalize(u).String()
+}
+
+// ArticleID 根据文章链接生成稳定的文章 ID，同一篇文章重复抓取得到的 ID 相同。
+// 抓取、迁移和合并重复文章都只用链接计算 ID，专辑列表中的 msgid 先用 WithMessage 写入链接
+func ArticleID(rawURL string) string {
+	p := Parse(rawURL)
+
+	var key string
+	if p.Biz != "" && p.Mid != "" && p.Idx != "" {
+		key = p.Biz + "|" + p.Mid + "|" + p.Idx
+	} else {
+		// 短链接（/s/xxxx）等没有 __biz 的情况，使用规范化后的链接
+		key = canonicalKey(rawURL)
+	}
+
+	sum := sha1.Sum([]byte(key))
+	return "wx_" + hex.EncodeToString(sum[:])[:16]
+}
+
+// canonicalKey 去掉协议、跟踪参数和锚点后的链接
+func canonicalKey(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return strings.TrimSpace(rawURL)
+	}
+	return strings.TrimPrefix(normalize(u).String(), "https://")
+}
@@ -0,0 +1,30 @@
+package wxurl
+
+import "testing"
+
+func TestArticleIDFromSavedLink(t *testing.T) {
+	full, err := Normalize("https://mp.weixin.qq.com/s?__biz=MzA=&mid=100&idx=2&sn=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 专辑列表中的链接缺少 mid/idx 时，补全后与完整链接的 ID 相同
+	link := WithMessage("https://mp.weixin.qq.com/s?__biz=MzA=&sn=abc", "100", "2")
+	if link != full {
+		t.Errorf("WithMessage = %s, want %s", link, full)
+	}
+	if ArticleID(link) != ArticleID(full) {
+		t.Errorf("ArticleID(%s) differs from ArticleID(%s)", link, full)
+	}
+	// 保存的链接经过规范化后 ID 不变
+	if canonical, err := Normalize(link + "&chksm=1#rd"); err != nil || ArticleID(canonical) != ArticleID(link) {
+		t.Errorf("Normalize = %s, %v; ID changed", canonical, err)
+	}
+
+	// 已有 mid/idx 的链接和短链接不修改
+	for _, link := range []string{full, "https://mp.weixin.qq.com/s/AbCdEf"} {
+		if got := WithMessage(link, "999", "9"); got != link {
+			t.Errorf("WithMessage(%s) = %s, want unchanged", link, got)
+		}
+	}
+}
@@ -4,37 +4,63 @@ import TopicList from './components/TopicList';
 import ArticleList from './components/ArticleList';
 import ArticleModal from './components/ArticleModal';
 
+// 不按主题过滤
+const ALL_TOPICS = { id: '', name: '全部', all: true };
+
 function App() {
   const [articles, setArticles] = useState([]);
-  const [topics, setTopics] = useState(['全部']);
-  const [selectedTopic, setSelectedTopic] = useState('全部');
+  const [nextCursor, setNextCursor] = useState('');
+  const [total, setTotal] = useState(0);
+  const [topics, setTopics] = useState([ALL_TOPICS]);
+  const [selectedTopic, setSelectedTopic] = useState(ALL_TOPICS);
   const [urlInput, setUrlInput] = useState('');
   const [modalOpen, setModalOpen] = useState(false);
-  const [currentArticleUrl, setCurrentArticleUrl] = useState('');
+  const [currentArticle, setCurrentArticle] = useState(null);
   const [isLoading, setIsLoading] = useState(true);
   const [error, setError] = useState(null);
 
   useEffect(() => {
     loadTopics();
-    loadArticles();
   }, []);
 
+  // 切换主题时由服务端过滤，重新加载第一页
+  useEffect(() => {
+    loadArticles(selectedTopic);
+  }, [selectedTopic]);
+
   const loadTopics = async () => {
     try {
       const response = await fetch('/api/topics');
       const data = await response.json();
-      setTopics(['全部', ...(data.data || [])]);
+      const list = data.data || [];
+      const count = list.reduce((sum, topic) => sum + topic.count, 0);
+      const unread = list.reduce((sum, topic) => sum + topic.unread, 0);
+      setTopics([{ ...ALL_TOPICS, count, unread }, ...list]);
     } catch (error) {
       console.error('加载主题失败:', error);
       setError('加载主题失败，请刷新页面重试');
     }
   };
 
-  const loadArticles = async () => {
+  // cursor 为空时加载第一页，否则追加下一页
+  const loadArticles = async (topic, cursor = '') => {
     try {
-      const response = await fetch('/api/articles');
+      const params = new URLSearchParams({ limit: '50' });
+      // 专辑按 ID 过滤，专辑改名后仍是同一组文章
+      if (topic.id) {
+        params.set('album_id', topic.id);
+      } else if (!topic.all) {
+        params.set('topic', topic.name);
+      }
+      if (cursor) {
+        params.set('cursor', cursor);
+      }
+      const response = await fetch(`/api/articles?${params}`);
       const data = await response.json();
-      setArticles(data.data || []);
+      const page = data.data || [];
+      setArticles(prev => (cursor ? [...prev, ...page] : page));
+      setNextCursor(data.next_cursor || '');
+      setTotal(data.total || 0);
     } catch (error) {
       console.error('加载文章失败:', error);
       setError('加载文章失败，请刷新页面重试');
@@ -43,6 +69,20 @@ function App() {
     }
   };
 
+  const waitForJob = async (jobId) => {
+    for (;;) {
+      const response = await fetch(`/api/jobs/${jobId}`);
+      if (!response.ok) {
+        throw new Error(`HTTP error! status: ${response.status}`);
+      }
+      const result = await response.json();
+      if (result.data.status === 'succeeded' || result.data.status === 'failed') {
+        return result.data;
+      }
+      await new Promise(resolve => setTimeout(resolve, 2000));
+    }
+  };
+
   const fetchArticles = async () => {
     if (!urlInput.trim()) {
       alert('请输入文章链接');
@@ -66,14 +106,23 @@ function App() {
       }
 
       const result = await response.json();
-      if (result.success && Array.isArray(result.data)) {
-        setUrlInput('');
-        setArticles(prevArticles => [...prevArticles, ...result.data]);
-        await loadTopics();
-        setSelectedTopic('全部');
-      } else {
+      if (!result.success || !result.data) {
         throw new Error(result.message || '获取文章失败');
       }
+
+      // 抓取在后台执行，轮询任务状态直到结束
+      const job = await waitForJob(result.data.id);
+      if (job.status === 'failed') {
+        throw new Error(job.error || '获取文章失败');
+      }
+
+      setUrlInput('');
+      await loadTopics();
+      if (selectedTopic.all) {
+        await loadArticles(ALL_TOPICS);
+      } else {
+        setSelectedTopic(ALL_TOPICS);
+      }
     } catch (error) {
       console.error('获取文章时发生错误:', error);
       alert(error.message || '获取文章失败，请检查网络连接');
@@ -82,15 +131,22 @@ function App() {
     }
   };
 
-  const handleOpenArticle = (url) => {
-    setCurrentArticleUrl(url);
+  // 打开文章时标记为已读，并刷新主题的未读数
+  const handleOpenArticle = async (article) => {
+    setCurrentArticle(article);
     setModalOpen(true);
+    try {
+      await fetch(`/api/articles/${encodeURIComponent(article.id)}/state`, {
+        method: 'PATCH',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ read: true, opened: true }),
+      });
+      await loadTopics();
+    } catch (error) {
+      console.error('标记已读失败:', error);
+    }
   };
 
-  const filteredArticles = selectedTopic === '全部'
-    ? articles
-    : articles.filter(article => article.topic === selectedTopic);
-
   if (isLoading) {
     return (
       <Container sx={{ display: 'flex', justifyContent: 'center', alignItems: 'center', height: '100vh' }}>
@@ -143,21 +199,26 @@ function App() {
             topics={topics}
             selectedTopic={selectedTopic}
             onTopicSelect={setSelectedTopic}
-            articles={articles}
           />
         </Grid>
         <Grid item xs={12} md={9}>
           <ArticleList
-            articles={filteredArticles}
+            articles={articles}
+            total={total}
             onArticleClick={handleOpenArticle}
           />
+          {nextCursor && (
+            <Button fullWidth sx={{ mt: 2 }} onClick={() => loadArticles(selectedTopic, nextCursor)}>
+              加载更多
+            </Button>
+          )}
         </Grid>
       </Grid>
 
       <ArticleModal
         open={modalOpen}
         onClose={() => setModalOpen(false)}
-        articleUrl={currentArticleUrl}
+        article={currentArticle}
       />
     </Container>
   );
@@ -1,13 +1,13 @@
 import React from 'react';
 import { Paper, Typography, Grid, Card, CardContent, CardActions, Button } from '@mui/material';
 
-function ArticleList({ articles = [], onArticleClick }) {
+function ArticleList({ articles = [], total, onArticleClick }) {
   if (!Array.isArray(articles)) return null;
 
   return (
     <Paper sx={{ p: 2 }}>
       <Typography variant="h6" gutterBottom>
-        文章列表 ({articles.length})
+        文章列表 ({total ?? articles.length})
       </Typography>
       <Grid container spacing={2}>
         {articles.map((article) => (
@@ -28,7 +28,7 @@ function ArticleList({ articles = [], onArticleClick }) {
                 </Typography>
               </CardContent>
               <CardActions>
-                <Button size="small" color="primary" onClick={() => onArticleClick(article.url)}>
+                <Button size="small" color="primary" onClick={() => onArticleClick(article)}>
                   阅读原文
                 </Button>
               </CardActions>
@@ -2,16 +2,13 @@ import React from 'react';
 import { Dialog, DialogContent, IconButton } from '@mui/material';
 import OpenInNewIcon from '@mui/icons-material/OpenInNew';
 
-function ArticleModal({ open, onClose, articleUrl }) {
-  const getProxiedUrl = (url) => {
-    if (!url) return '';
-    // 所有微信文章链接都通过代理访问
-    return `/api/proxy?url=${encodeURIComponent(url)}`;
-  };
+function ArticleModal({ open, onClose, article }) {
+  // 阅读视图显示保存的正文，正文尚未下载时服务端跳转到代理的原文页面
+  const getReaderUrl = (article) => `/api/articles/${encodeURIComponent(article.id)}/reader`;
 
   const handleOpenInNewTab = () => {
-    if (articleUrl) {
-      window.open(articleUrl, '_blank');
+    if (article?.url) {
+      window.open(article.url, '_blank');
     }
   };
 
@@ -42,9 +39,9 @@ function ArticleModal({ open, onClose, articleUrl }) {
         <OpenInNewIcon />
       </IconButton>
       <DialogContent sx={{ p: 0, height: '100%' }}>
-        {articleUrl && (
+        {article && (
           <iframe
-            src={getProxiedUrl(articleUrl)}
+            src={getReaderUrl(article)}
             style={{
               width: '100%',
               height: '100%',
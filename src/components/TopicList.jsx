@@ -1,14 +1,9 @@
 import React from 'react';
 import { Paper, List, ListItem, ListItemText, Typography } from '@mui/material';
 
-function TopicList({ topics = [], selectedTopic, onTopicSelect, articles = [] }) {
-  const getTopicCount = (topic) => {
-    if (!Array.isArray(articles)) return 0;
-    if (topic === '全部') {
-      return articles.length;
-    }
-    return articles.filter(article => article.topic === topic).length;
-  };
+// topics 为 { id, name, count, unread }，属于专辑的主题 id 为专辑 ID，其余为空。
+// 没有数量的主题只显示名称
+function TopicList({ topics = [], selectedTopic, onTopicSelect }) {
 
   if (!Array.isArray(topics)) return null;
 
@@ -20,9 +15,9 @@ function TopicList({ topics = [], selectedTopic, onTopicSelect, articles = [] })
       <List>
         {topics.map((topic) => (
           <ListItem
-            key={topic}
+            key={`${topic.id}:${topic.name}`}
             button
-            selected={selectedTopic === topic}
+            selected={selectedTopic.id === topic.id && selectedTopic.name === topic.name}
             onClick={() => onTopicSelect(topic)}
             sx={{
               '&.Mui-selected': {
@@ -36,9 +31,10 @@ function TopicList({ topics = [], selectedTopic, onTopicSelect, articles = [] })
             <ListItemText
               primary={
                 <Typography variant="body1">
-                  {topic} ({getTopicCount(topic)})
+                  {topic.name}{topic.count !== undefined && ` (${topic.count})`}
                 </Typography>
               }
+              secondary={topic.unread > 0 ? `${topic.unread} 篇未读` : null}
             />
           </ListItem>
         ))}